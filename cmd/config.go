@@ -25,11 +25,18 @@ func initConf() {
 }
 
 func initDBConf() {
+	viper.SetDefault("db.dialect", "postgres")
+	viper.SetDefault("db.sqlite.path", "arke.db")
+	viper.SetDefault("db.mysql.host", "localhost:3306")
+	viper.SetDefault("db.mysql.user", "root")
+	viper.SetDefault("db.mysql.pass", "")
+	viper.SetDefault("db.mysql.dbname", "arke")
 	viper.SetDefault("db.postgres.host", "localhost")
 	viper.SetDefault("db.postgres.user", "postgres")
 	viper.SetDefault("db.postgres.pass", "")
 	viper.SetDefault("db.postgres.dbname", "arke")
 	viper.SetDefault("db.postgres.sslmode", "verify-full")
+	viper.SetDefault("db.postgres.tenants.parallel", 4)
 }
 
 func initLogConf() {
@@ -0,0 +1,9 @@
+//go:build mysql
+// +build mysql
+
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	// Import go-sql-driver/mysql for mysql support, it's only built with the mysql tag
+	_ "github.com/go-sql-driver/mysql"
+)
@@ -0,0 +1,9 @@
+//go:build sqlite
+// +build sqlite
+
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	// Import go-sqlite3 for sqlite support, it requires cgo so it's only built with the sqlite tag
+	_ "github.com/mattn/go-sqlite3"
+)
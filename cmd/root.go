@@ -9,6 +9,9 @@ import (
 
 var log *zap.Logger
 
+// Version is the version of the arke build, it is recorded in the migration history
+var Version = "dev"
+
 // RootCmd exports the main arke command interface, including all subcommands
 var RootCmd = &cobra.Command{
 	Use:   "arke",
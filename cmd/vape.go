@@ -1,15 +1,23 @@
 package cmd // import "iris.arke.works/forum/cmd"
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	// Import lib/pq for postgres support
 	_ "github.com/lib/pq"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
 	"iris.arke.works/forum/db/mig"
-	"sync"
 )
 
 var vapeCmd = &cobra.Command{
@@ -20,149 +28,301 @@ var vapeCmd = &cobra.Command{
 }
 
 func init() {
-	vapeCmd.Flags().String("migtarget", "default", "Migration Target")
+	vapeCmd.PersistentFlags().String("migtarget", "default", "Migration Target")
+	vapeCmd.PersistentFlags().String("env", "", "Environment to migrate, units limited to other environments are skipped")
+	viper.BindPFlag("db.migrations.environment", vapeCmd.PersistentFlags().Lookup("env"))
+	vapeCmd.PersistentFlags().StringSliceVar(&migDirFlag, "migdir", nil,
+		"Directory of additional migration units, can be repeated, overrides db.migrations.dirs")
+	vapeCmd.Flags().Bool("allow-drift", false, "Only warn about executed units that have been modified instead of aborting")
+	vapeCmd.Flags().Bool("parallel", false, "Execute independent units outside of a transaction concurrently if the dialect supports it")
+	vapeCmd.Flags().Bool("no-wait", false, "Fail instead of waiting if another migration holds the migration lock")
+	vapeCmd.Flags().Bool("dry-run", false, "Print the execution rounds and SQL of pending units without changing the database")
+	vapeCmd.Flags().String("emit-sql", "", "Write a SQL script of the pending units and their bookkeeping to the given file instead of migrating")
 	RootCmd.AddCommand(vapeCmd)
 }
 
-func run(cmd *cobra.Command, args []string) {
-	log, err := zap.NewProduction()
-	if err != nil {
-		println("Error while creating logger:", err)
-		return
+// openDatabase connects to the database of the dialect configured in db.dialect, verifies the connection
+// and returns it together with the matching migration dialect
+func openDatabase() (*sql.DB, mig.Dialect, error) {
+	return openDialect(viper.GetString("db.dialect"), "")
+}
+
+// openDialect connects to the configured database of the given dialect. If schema is set, the connection uses
+// the Postgres schema, with the migration lock of a tenant, or the MySQL database of that name instead. SQLite
+// opens an in-memory database.
+func openDialect(dialect, schema string) (*sql.DB, mig.Dialect, error) {
+	var driver, connString string
+	switch dialect {
+	case mig.DialectPostgres:
+		dbconf := viper.Sub("db.postgres")
+		driver = "postgres"
+		connString = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
+			dbconf.GetString("user"),
+			dbconf.GetString("pass"),
+			dbconf.GetString("host"),
+			dbconf.GetString("dbname"),
+			dbconf.GetString("sslmode"))
+		if schema != "" {
+			connString += "&search_path=" + url.QueryEscape(schema)
+		}
+	case mig.DialectSQLite:
+		driver = "sqlite3"
+		connString = viper.GetString("db.sqlite.path")
+		if schema != "" {
+			connString = ":memory:"
+		}
+	case mig.DialectMySQL:
+		dbconf := viper.Sub("db.mysql")
+		driver = "mysql"
+		dbname := dbconf.GetString("dbname")
+		if schema != "" {
+			dbname = schema
+		}
+		connString = fmt.Sprintf("%s:%s@tcp(%s)/%s?multiStatements=true&parseTime=true",
+			dbconf.GetString("user"),
+			dbconf.GetString("pass"),
+			dbconf.GetString("host"),
+			dbname)
+	default:
+		return nil, nil, fmt.Errorf("Unknown database dialect %q", dialect)
 	}
-	dbconf := viper.Sub("db.postgres")
-	connString := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
-		dbconf.GetString("user"),
-		dbconf.GetString("pass"),
-		dbconf.GetString("host"),
-		dbconf.GetString("dbname"),
-		dbconf.GetString("sslmode"))
-	log.Info("Opening Database")
-	db, err := sql.Open("postgres", connString)
+	if !hasDriver(driver) {
+		return nil, nil, fmt.Errorf("Database driver %s is not compiled in, rebuild with the matching build tag", driver)
+	}
+	db, err := sql.Open(driver, connString)
 	if err != nil {
-		log.Fatal("Error while opening connection to database", zap.Error(err))
-		return
+		return nil, nil, err
 	}
 	err = db.Ping()
 	if err != nil {
-		log.Fatal("Error while verifying connection to database", zap.Error(err))
-		return
+		db.Close()
+		return nil, nil, err
 	}
-	defer db.Close()
+	switch driver {
+	case "sqlite3":
+		if schema != "" {
+			// Every connection to :memory: opens a new database
+			db.SetMaxOpenConns(1)
+		}
+		return db, mig.OpenFromSQLiteConn(db), nil
+	case "mysql":
+		return db, mig.OpenFromMySQLConn(db), nil
+	}
+	if schema != "" {
+		return db, mig.OpenTenantFromPGConn(db), nil
+	}
+	return db, mig.OpenFromPGConn(db), nil
+}
+
+// hasDriver checks if a database driver with the given name has been registered
+func hasDriver(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlDirConf is an entry of db.migrations.sql_dirs, a directory of NNN_name.up.sql migrations imported into the graph
+type sqlDirConf struct {
+	Dir       string   `mapstructure:"dir"`
+	Prefix    string   `mapstructure:"prefix"`
+	Target    string   `mapstructure:"target"`
+	Dialect   string   `mapstructure:"dialect"`
+	DependsOn []string `mapstructure:"depends_on"`
+}
+
+// migDirFlag holds the unit directories given with --migdir
+var migDirFlag []string
+
+// migDirs returns the unit directories given with --migdir, or those of db.migrations.dirs if the flag is not set
+func migDirs() []string {
+	if len(migDirFlag) > 0 {
+		return migDirFlag
+	}
+	return viper.GetStringSlice("db.migrations.dirs")
+}
+
+// loadGraph loads and validates the built-in migration units, their SQL is rendered with db.migrations.vars
+func loadGraph() (*mig.Graph, error) {
+	return loadGraphVars(graphVars())
+}
+
+// graphVars returns a copy of the template variables of db.migrations.vars. Viper folds the keys to lower case,
+// they are restored to the case of the config file if it is a YAML or JSON file.
+func graphVars() map[string]string {
+	names := configVarNames()
+	var vars = map[string]string{}
+	for key, value := range viper.GetStringMapString("db.migrations.vars") {
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		vars[key] = value
+	}
+	return vars
+}
 
-	log.Info("Verifying and Loading Migration Data from Database")
-	migDB := mig.OpenFromPGConn(db)
-	err = migDB.CheckAndLoadTables()
+// configVarNames maps the lower case names of the variables of db.migrations.vars in the config file to their
+// names as written in the file
+func configVarNames() map[string]string {
+	var config struct {
+		DB struct {
+			Migrations struct {
+				Vars map[string]interface{} `yaml:"vars" json:"vars"`
+			} `yaml:"migrations" json:"migrations"`
+		} `yaml:"db" json:"db"`
+	}
+	var names = map[string]string{}
+	dat, err := ioutil.ReadFile(viper.ConfigFileUsed())
 	if err != nil {
-		log.Fatal("Error while loading migration tables", zap.Error(err))
-		return
+		return names
+	}
+	switch filepath.Ext(viper.ConfigFileUsed()) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(dat, &config)
+	case ".json":
+		err = json.Unmarshal(dat, &config)
+	default:
+		return names
+	}
+	if err != nil {
+		return names
+	}
+	for name := range config.DB.Migrations.Vars {
+		names[strings.ToLower(name)] = name
 	}
+	return names
+}
 
-	log.Info("Loading Migration Units")
+// loadGraphVars loads and validates the built-in migration units, the unit directories of db.migrations.dirs and
+// the directories of db.migrations.sql_dirs for the environment of db.migrations.environment, the SQL of the units
+// is rendered with the variables
+func loadGraphVars(vars map[string]string) (*mig.Graph, error) {
 	rootGraph := mig.NewGraph()
-	err = rootGraph.Load("db/mig/arke")
+	rootGraph.SetVars(vars)
+	rootGraph.SetEnvironment(viper.GetString("db.migrations.environment"))
+	err := rootGraph.Load("db/mig/arke")
 	if err != nil {
-		log.Fatal("Could not load migration data", zap.Error(err))
-		return
+		return nil, err
+	}
+	for _, dir := range migDirs() {
+		err = rootGraph.LoadFS(os.DirFS(dir))
+		if err != nil {
+			return nil, fmt.Errorf("Could not load units from %s: %s", dir, err)
+		}
+	}
+	var sqlDirs []sqlDirConf
+	err = viper.UnmarshalKey("db.migrations.sql_dirs", &sqlDirs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid db.migrations.sql_dirs: %s", err)
+	}
+	for _, conf := range sqlDirs {
+		if conf.Dialect == "" {
+			conf.Dialect = viper.GetString("db.dialect")
+		}
+		err = rootGraph.LoadSQLDir(os.DirFS(conf.Dir), mig.SQLDirOptions{
+			Prefix:    conf.Prefix,
+			Target:    conf.Target,
+			Dialect:   conf.Dialect,
+			DependsOn: conf.DependsOn,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Could not import %s: %s", conf.Dir, err)
+		}
 	}
-
-	log.Info("Validating Migration Units")
 	err = rootGraph.ValidateNodes()
 	if err != nil {
-		log.Fatal("Migration Graph Validation Failed", zap.Error(err))
-		return
+		return nil, fmt.Errorf("Migration Graph Validation Failed: %s", err)
 	}
+	return rootGraph, nil
+}
 
-	target, err := cmd.Flags().GetString("migtarget")
+func run(cmd *cobra.Command, args []string) {
+	log, err := zap.NewProduction()
 	if err != nil {
-		log.Fatal("Migration Target not specified", zap.Error(err))
+		println("Error while creating logger:", err)
+		return
 	}
-	log.Info("Loading Migration Target", zap.String("target", target))
-	migGraph, err := rootGraph.GetTargetSubgraph(target)
-	if err != nil {
-		log.Fatal("Could not load Subgraph", zap.Error(err))
+	if tenantsConfigured() {
+		runTenants(cmd, log)
 		return
 	}
 
-	log.Info("Loading already executed Units")
-	executedUnits, err := migDB.GetExecutedUnits()
+	log.Info("Opening Database")
+	db, migDB, err := openDatabase()
 	if err != nil {
-		log.Fatal("Error loading executed units", zap.Error(err))
+		log.Fatal("Error while connecting to database", zap.Error(err))
+		return
 	}
+	defer db.Close()
 
-	log.Info("Marking units as already executed", zap.Int("unit_num", len(executedUnits)))
-	migGraph.MarkNodesRun(executedUnits...)
-
-	log.Info("Entering Database Transaction")
-	tx, err := db.Begin()
+	log.Info("Loading Migration Units")
+	rootGraph, err := loadGraph()
 	if err != nil {
-		log.Fatal("Transaction failed", zap.Error(err))
+		log.Fatal("Could not load migration data", zap.Error(err))
 		return
 	}
 
-	log.Info("Starting Migration", zap.Int("unit_num", migGraph.RemainingSize()))
-	hasErrored := false
-	for nodes := migGraph.GetAllRunnableNodes(); len(nodes) > 0 && !hasErrored; nodes = migGraph.GetAllRunnableNodes() {
-		log.Info("Executing Round", zap.Int("unit_num", len(nodes)), zap.Strings("nodes", nodes))
-		wg := sync.WaitGroup{}
-		wg.Add(len(nodes))
-		for _, v := range nodes {
-			go func(v string) {
-				defer wg.Done()
-				node, err := migGraph.GetUnit(v)
-				if err != nil {
-					tx.Rollback()
-					log.Error("Attempted to migrate non-existant unit", zap.String("unit", v))
-					hasErrored = true
-					return
-				}
-				_, err = tx.Exec(node.SQL.Postgres)
-				if err != nil {
-					tx.Rollback()
-					log.Error("Unit failed", zap.String("unit", v), zap.Error(err))
-					hasErrored = true
-					return
-				}
-				err = migDB.MarkExecuted(node)
-				if err != nil {
-					tx.Rollback()
-					log.Error("Unit could not be marked as finished", zap.String("unit", v), zap.Error(err))
-					hasErrored = true
-					return
-				}
-			}(v)
-		}
-
-		log.Info("Waiting for Units to finish", zap.Int("unit_num", len(nodes)))
-		wg.Wait()
-
-		if hasErrored {
-			tx.Rollback()
-			log.Fatal("One or More Routines failed, aborting migration")
-			return
-		}
+	target, err := cmd.Flags().GetString("migtarget")
+	if err != nil {
+		log.Fatal("Migration Target not specified", zap.Error(err))
+	}
 
-		err := migGraph.MarkNodesRun(nodes...)
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun || cmd.Flags().Changed("emit-sql") {
+		log.Info("Loading Migration Target", zap.String("target", target))
+		migGraph, err := rootGraph.GetTargetSubgraph(target)
 		if err != nil {
-			tx.Rollback()
-			log.Fatal("Could not mark units as executed: ", zap.Error(err))
-			return
-		}
-		// Check if the graph is still shrinkable
-		if migGraph.IsStuck() {
-			log.Fatal("Migration got stuck on nodes", zap.Strings("nodes", nodes))
+			log.Fatal("Could not load Subgraph", zap.Error(err))
 			return
 		}
-
-		log.Info("Beginning next round")
+		runPlan(cmd, log, migDB, migGraph)
+		return
 	}
 
-	log.Info("Committing Migration")
-	err = tx.Commit()
+	report, err := migrate(context.Background(), cmd, log, migDB, rootGraph, target)
 	if err != nil {
-		log.Fatal("Could not commit migration: %s", zap.Error(err))
+		logMigrationError(log.Fatal, err)
+		return
+	}
+	log.Info("Migration finished", zap.Int("unit_num", len(report.Executed)),
+		zap.Duration("duration", report.Duration))
+}
+
+// migrate migrates the target of the graph with the settings of the flags of the command
+func migrate(ctx context.Context, cmd *cobra.Command, log *zap.Logger, migDB mig.Dialect, rootGraph *mig.Graph,
+	target string) (*mig.Report, error) {
+	migrator := mig.NewMigrator(migDB, log)
+	migrator.AllowDrift, _ = cmd.Flags().GetBool("allow-drift")
+	migrator.Parallel, _ = cmd.Flags().GetBool("parallel")
+	migrator.NoWait, _ = cmd.Flags().GetBool("no-wait")
+	migrator.Version = Version
+	return migrator.Migrate(ctx, rootGraph, target)
+}
+
+// logMigrationError logs the error of a failed migration with the given logger function, e.g. log.Fatal
+func logMigrationError(logFunc func(string, ...zapcore.Field), err error) {
+	if err == mig.ErrLocked {
+		logFunc("Another migration holds the migration lock, migrate again once it has finished")
+		return
+	}
+	if drift, ok := err.(*mig.DriftError); ok {
+		logFunc("Executed units have been modified, use --allow-drift to migrate anyway",
+			zap.Strings("units", drift.Units))
+		return
+	}
+	if invalid, ok := err.(*mig.InvalidIndexError); ok {
+		logFunc("Invalid indexes left behind by failed units, drop them with DROP INDEX CONCURRENTLY and migrate again",
+			zap.Strings("indexes", invalid.Indexes))
+		return
+	}
+	if partial, ok := err.(*mig.PartialMigrationError); ok {
+		logFunc("Migration failed, executed units have been committed and the next run resumes with the failed unit",
+			zap.Strings("executed", partial.Executed),
+			zap.String("failed", partial.Failed),
+			zap.Strings("pending", partial.Pending),
+			zap.Error(partial.Err))
 		return
 	}
-	log.Info("Migration finished")
-	return
+	logFunc("Migration failed", zap.Error(err))
 }
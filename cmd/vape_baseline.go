@@ -0,0 +1,143 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+	"os"
+	"text/tabwriter"
+)
+
+var vapeBaselineCmd = &cobra.Command{
+	Use:   "baseline",
+	Short: "Adopt an existing database into the migration table",
+	Long: "Checks that the tables, columns and indexes created by the pending units of the migration target " +
+		"already exist in the database and records the units as executed without running them. " +
+		"If objects are missing, nothing is recorded unless --force is given. Units that create no tables, " +
+		"columns or indexes, like code units and units changing data, cannot be verified and are only recorded " +
+		"with --allow-unverified. All units are recorded in a single transaction holding the migration lock.",
+	Run: runBaseline,
+}
+
+func init() {
+	vapeBaselineCmd.Flags().Bool("force", false, "Record the units even if the database does not match them")
+	vapeBaselineCmd.Flags().Bool("allow-unverified", false, "Record units that create no tables, columns or indexes")
+	vapeBaselineCmd.Flags().Bool("dry-run", false, "Only print the comparison without recording any unit")
+	vapeCmd.AddCommand(vapeBaselineCmd)
+}
+
+func runBaseline(cmd *cobra.Command, args []string) {
+	force, _ := cmd.Flags().GetBool("force")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	allowUnverified, _ := cmd.Flags().GetBool("allow-unverified")
+
+	log.Info("Opening Database")
+	db, migDB, err := openDatabase()
+	if err != nil {
+		log.Fatal("Error while connecting to database", zap.Error(err))
+		return
+	}
+	defer db.Close()
+
+	inspector, ok := migDB.(mig.SchemaInspector)
+	if !ok {
+		log.Fatal("Database dialect cannot inspect the schema", zap.String("dialect", migDB.Name()))
+		return
+	}
+
+	rootGraph, err := loadGraph()
+	if err != nil {
+		log.Fatal("Could not load migration data", zap.Error(err))
+		return
+	}
+	target, err := cmd.Flags().GetString("migtarget")
+	if err != nil {
+		log.Fatal("Migration Target not specified", zap.Error(err))
+		return
+	}
+	migGraph, err := rootGraph.GetTargetSubgraph(target)
+	if err != nil {
+		log.Fatal("Could not load Subgraph", zap.Error(err))
+		return
+	}
+
+	err = migDB.CheckAndLoadTables()
+	if err != nil {
+		log.Fatal("Error while loading migration tables", zap.Error(err))
+		return
+	}
+	executedUnits, err := migDB.GetExecutedUnits()
+	if err != nil {
+		log.Fatal("Error loading executed units", zap.Error(err))
+		return
+	}
+	migGraph.MarkNodesRun(executedUnits...)
+	_, err = migGraph.EvaluateConditions(context.Background(), migDB)
+	if err != nil {
+		log.Fatal("Could not evaluate run_if queries", zap.Error(err))
+		return
+	}
+
+	plan, err := migGraph.GetPlan()
+	if err != nil {
+		log.Fatal("Could not determine execution plan", zap.Error(err))
+		return
+	}
+	var units = []mig.Unit{}
+	for _, round := range plan {
+		units = append(units, round...)
+	}
+
+	schema, err := inspector.InspectSchema()
+	if err != nil {
+		log.Fatal("Could not inspect the database schema", zap.Error(err))
+		return
+	}
+	report := mig.CheckBaseline(schema, migDB.Name(), units)
+	if len(report.Units) == 0 {
+		fmt.Println("Nothing to baseline")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "UNIT\tSTATE\tDETAILS")
+	for _, unit := range report.Units {
+		switch {
+		case len(unit.Mismatches) > 0:
+			for i, mismatch := range unit.Mismatches {
+				if i == 0 {
+					fmt.Fprintf(w, "%s\tmismatch\t%s\n", unit.Name, mismatch)
+				} else {
+					fmt.Fprintf(w, "\t\t%s\n", mismatch)
+				}
+			}
+		case unit.Verified():
+			fmt.Fprintf(w, "%s\tverified\t%d tables, columns and indexes exist\n", unit.Name, len(unit.Objects))
+		default:
+			fmt.Fprintf(w, "%s\tunverified\tcreates no tables, columns or indexes\n", unit.Name)
+		}
+	}
+	w.Flush()
+
+	if dryRun {
+		return
+	}
+	if report.HasMismatches() && !force {
+		log.Fatal("Database does not match the migration target, nothing has been recorded")
+		return
+	}
+	if unverified := report.Unverified(); len(unverified) > 0 && !allowUnverified {
+		log.Fatal("Units cannot be verified against the schema, use --allow-unverified to record them anyway",
+			zap.Strings("units", unverified))
+		return
+	}
+	// Seed units are not recorded, the next migration seeds the rows
+	recorded, err := mig.NewRunner(migDB, log).RecordUnits(context.Background(), units)
+	if err != nil {
+		log.Fatal("Could not record units", zap.Error(err))
+		return
+	}
+	log.Info("Units recorded as executed", zap.Int("unit_num", len(recorded)))
+}
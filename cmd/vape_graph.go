@@ -0,0 +1,108 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"context"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+	"os"
+)
+
+var vapeGraphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Render the migration graph",
+	Long: "Renders the units of the migration target as Graphviz DOT, Mermaid or JSON. " +
+		"With --with-state the units are colored by their state in the migration table.",
+	Run: runGraph,
+}
+
+func init() {
+	vapeGraphCmd.Flags().String("format", "dot", "Output format, one of dot, mermaid or json")
+	vapeGraphCmd.Flags().Bool("with-state", false, "Connect to the database and include the state of every unit")
+	vapeCmd.AddCommand(vapeGraphCmd)
+}
+
+func runGraph(cmd *cobra.Command, args []string) {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		log.Fatal("Output format not specified", zap.Error(err))
+		return
+	}
+	var write func(*mig.Graph, map[string]mig.UnitState) error
+	switch format {
+	case "dot":
+		write = func(g *mig.Graph, states map[string]mig.UnitState) error { return g.WriteDOT(os.Stdout, states) }
+	case "mermaid":
+		write = func(g *mig.Graph, states map[string]mig.UnitState) error { return g.WriteMermaid(os.Stdout, states) }
+	case "json":
+		write = func(g *mig.Graph, states map[string]mig.UnitState) error { return g.WriteJSON(os.Stdout, states) }
+	default:
+		log.Fatal("Unknown output format", zap.String("format", format))
+		return
+	}
+
+	rootGraph, err := loadGraph()
+	if err != nil {
+		log.Fatal("Could not load migration data", zap.Error(err))
+		return
+	}
+
+	target, err := cmd.Flags().GetString("migtarget")
+	if err != nil {
+		log.Fatal("Migration Target not specified", zap.Error(err))
+		return
+	}
+	migGraph, err := rootGraph.GetTargetSubgraph(target)
+	if err != nil {
+		log.Fatal("Could not load Subgraph", zap.Error(err))
+		return
+	}
+
+	var states map[string]mig.UnitState
+	if withState, _ := cmd.Flags().GetBool("with-state"); withState {
+		states, err = loadStates(migGraph)
+		if err != nil {
+			log.Fatal("Could not load unit states", zap.Error(err))
+			return
+		}
+	}
+
+	err = write(migGraph, states)
+	if err != nil {
+		log.Fatal("Could not render graph", zap.Error(err))
+	}
+}
+
+// loadStates reads the migration table without modifying it and returns the state of every unit on the graph
+func loadStates(migGraph *mig.Graph) (map[string]mig.UnitState, error) {
+	db, migDB, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	hasTable, err := migDB.HasMigrationTable()
+	if err != nil {
+		return nil, err
+	}
+	var executedUnits = []mig.ExecutedUnit{}
+	if hasTable {
+		executedUnits, err = migDB.GetExecutedUnitInfo()
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = migGraph.EvaluateConditions(context.Background(), migDB)
+	if err != nil {
+		return nil, err
+	}
+	status, err := migGraph.GetStatus(migDB.Name(), executedUnits)
+	if err != nil {
+		return nil, err
+	}
+	var states = map[string]mig.UnitState{}
+	for _, v := range status {
+		states[v.Name] = v.State
+	}
+	return states, nil
+}
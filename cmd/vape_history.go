@@ -0,0 +1,97 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var vapeHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the recorded attempts to execute migration units",
+	Long: "Prints the attempts to execute migration units as recorded in the history table, newest first. Every " +
+		"retry is an attempt of its own, attempts of units whose transaction was rolled back are included.",
+	Run: runHistory,
+}
+
+func init() {
+	vapeHistoryCmd.Flags().String("unit", "", "Only show the attempts of this unit")
+	vapeHistoryCmd.Flags().Bool("failed", false, "Only show failed attempts")
+	vapeHistoryCmd.Flags().Int("limit", 50, "Maximum number of attempts to show, 0 shows all")
+	vapeHistoryCmd.Flags().String("format", "table", "Output format, either table or json")
+	vapeCmd.AddCommand(vapeHistoryCmd)
+}
+
+func runHistory(cmd *cobra.Command, args []string) {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		log.Fatal("Output format not specified", zap.Error(err))
+		return
+	}
+	if format != "table" && format != "json" {
+		log.Fatal("Unknown output format", zap.String("format", format))
+		return
+	}
+	var filter mig.HistoryFilter
+	filter.Unit, _ = cmd.Flags().GetString("unit")
+	filter.Failed, _ = cmd.Flags().GetBool("failed")
+	filter.Limit, _ = cmd.Flags().GetInt("limit")
+
+	db, migDB, err := openDatabase()
+	if err != nil {
+		log.Fatal("Error while connecting to database", zap.Error(err))
+		return
+	}
+	defer db.Close()
+
+	// The history table is only created by a migration, databases migrated by older versions have none yet
+	hasTable, err := migDB.HasHistoryTable()
+	if err != nil {
+		log.Fatal("Error while checking history table", zap.Error(err))
+		return
+	}
+	if !hasTable && format == "table" {
+		fmt.Println("No history recorded yet")
+		return
+	}
+	var history = []mig.Attempt{}
+	if hasTable {
+		history, err = migDB.GetHistory(filter)
+		if err != nil {
+			log.Fatal("Could not load migration history", zap.Error(err))
+			return
+		}
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(history)
+	} else {
+		err = printHistoryTable(history)
+	}
+	if err != nil {
+		log.Fatal("Could not print history", zap.Error(err))
+	}
+}
+
+func printHistoryTable(history []mig.Attempt) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED ON\tUNIT\tATTEMPT\tRESULT\tDURATION\tTARGET\tHOST\tOPERATOR\tVERSION\tERROR")
+	for _, v := range history {
+		errText := "-"
+		if v.Error != "" {
+			// Errors of multi-line statements would break the table
+			errText = strings.Join(strings.Fields(v.Error), " ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", v.StartedOn.Format(time.RFC3339), v.Unit,
+			v.Number, v.Result, v.Duration, v.Target, v.Hostname, v.Operator, v.Version, errText)
+	}
+	return w.Flush()
+}
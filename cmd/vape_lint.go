@@ -0,0 +1,41 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+)
+
+var vapeLintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check the migration unit files",
+	Long: "Checks the unit files in the unit directory of the source tree without connecting to the database. " +
+		"Unknown keys, unknown unit types, migrations without SQL, targets with SQL and all problems found by " +
+		"the graph validation are reported.",
+	Run: runLint,
+}
+
+func init() {
+	vapeLintCmd.Flags().String("dir", "db/mig/arke", "Directory of the unit files")
+	vapeCmd.AddCommand(vapeLintCmd)
+}
+
+func runLint(cmd *cobra.Command, args []string) {
+	dir, err := cmd.Flags().GetString("dir")
+	if err != nil {
+		log.Fatal("Unit directory not specified", zap.Error(err))
+		return
+	}
+	problems, err := mig.LintDir(dir, graphVars())
+	if err != nil {
+		log.Fatal("Could not read unit files", zap.Error(err))
+		return
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		log.Fatal("Unit files have problems", zap.Int("problem_num", len(problems)))
+	}
+}
@@ -0,0 +1,67 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+)
+
+var vapeNewCmd = &cobra.Command{
+	Use:   "new <unit>",
+	Short: "Create a new migration unit file",
+	Long: "Creates the file of a new unit in the unit directory of the source tree and adds it to the " +
+		"dependencies of the target given with --target. The SQL sections are left empty.",
+	Run: runNew,
+}
+
+func init() {
+	vapeNewCmd.Flags().String("dir", "db/mig/arke", "Directory of the unit files")
+	vapeNewCmd.Flags().String("type", string(mig.UnitTypeMigration), "Unit type, one of migration, batch, code, seed or target")
+	vapeNewCmd.Flags().String("description", "", "Description of the unit, required")
+	vapeNewCmd.Flags().StringSlice("depends-on", nil, "Dependencies of the unit, defaults to nothing")
+	vapeNewCmd.Flags().String("target", "", "Target to add the unit to")
+	vapeCmd.AddCommand(vapeNewCmd)
+}
+
+func runNew(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Expected the name of the unit as only argument", zap.Strings("args", args))
+		return
+	}
+	var opts mig.ScaffoldOptions
+	dir, err := cmd.Flags().GetString("dir")
+	if err != nil {
+		log.Fatal("Unit directory not specified", zap.Error(err))
+		return
+	}
+	unitType, err := cmd.Flags().GetString("type")
+	if err != nil {
+		log.Fatal("Unit type not specified", zap.Error(err))
+		return
+	}
+	opts.Type = mig.UnitType(unitType)
+	switch opts.Type {
+	case mig.UnitTypeMigration, mig.UnitTypeBatch, mig.UnitTypeCode, mig.UnitTypeSeed, mig.UnitTypeVirtualTarget:
+	default:
+		log.Fatal("Unknown unit type", zap.String("type", unitType))
+		return
+	}
+	opts.Description, _ = cmd.Flags().GetString("description")
+	if opts.Description == "" {
+		log.Fatal("Description of the unit not specified, use --description")
+		return
+	}
+	opts.DependsOn, _ = cmd.Flags().GetStringSlice("depends-on")
+	opts.Target, _ = cmd.Flags().GetString("target")
+
+	err = mig.ScaffoldUnit(dir, args[0], opts)
+	if err != nil {
+		log.Fatal("Could not create unit", zap.Error(err))
+		return
+	}
+	log.Info("Unit created", zap.String("unit", args[0]), zap.String("target", opts.Target))
+	if opts.Target == "" {
+		log.Warn("Unit is not part of any target, it is only executed once a target depends on it",
+			zap.String("unit", args[0]))
+	}
+}
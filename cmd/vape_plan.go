@@ -0,0 +1,120 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+	"os"
+	"strings"
+)
+
+// runPlan prints or exports the units a migration would execute. It only reads from the database,
+// a missing migration table is treated as a database without executed units.
+func runPlan(cmd *cobra.Command, log *zap.Logger, migDB mig.Dialect, migGraph *mig.Graph) {
+	log.Info("Loading already executed Units")
+	hasTable, err := migDB.HasMigrationTable()
+	if err != nil {
+		log.Fatal("Error while checking migration tables", zap.Error(err))
+		return
+	}
+	if hasTable {
+		executedUnits, err := migDB.GetExecutedUnits()
+		if err != nil {
+			log.Fatal("Error loading executed units", zap.Error(err))
+			return
+		}
+		executedInfo, err := migDB.GetExecutedUnitInfo()
+		if err != nil {
+			log.Fatal("Error loading executed units", zap.Error(err))
+			return
+		}
+		// Seed units whose rows have changed are executed again
+		var reseed = map[string]bool{}
+		for _, name := range migGraph.ChangedSeeds(migDB.Name(), executedInfo) {
+			reseed[name] = true
+		}
+		for _, name := range executedUnits {
+			if !reseed[name] {
+				migGraph.MarkNodesRun(name)
+			}
+		}
+		// Units whose squashed units have been executed are only recorded, like the migration does
+		_, err = migGraph.SatisfyBaselines(executedUnits)
+		if err != nil {
+			log.Fatal("Could not determine execution plan", zap.Error(err))
+			return
+		}
+	}
+
+	plan, err := migGraph.GetPlan()
+	if err != nil {
+		log.Fatal("Could not determine execution plan", zap.Error(err))
+		return
+	}
+
+	if file, _ := cmd.Flags().GetString("emit-sql"); file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			log.Fatal("Could not create SQL file", zap.Error(err))
+			return
+		}
+		err = migDB.WriteScript(f, plan)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatal("Could not write SQL file", zap.Error(err))
+			return
+		}
+		log.Info("SQL script written", zap.String("file", file), zap.Int("round_num", len(plan)))
+		return
+	}
+
+	if len(plan) == 0 {
+		fmt.Println("Nothing to migrate")
+		return
+	}
+	for i, round := range plan {
+		fmt.Printf("Round %d:\n", i+1)
+		for _, unit := range round {
+			if unit.IsSatisfied() {
+				fmt.Printf("  %s (%s, squashed units have been executed, only recorded)\n", unit.Name, unit.Type)
+				continue
+			}
+			if unit.Type == mig.UnitTypeBatch {
+				fmt.Printf("  %s (%s over %s.%s in batches of %d, outside of transaction)\n", unit.Name, unit.Type,
+					unit.Batch.Table, unit.Batch.KeyColumn(), unit.Batch.BatchSize())
+			} else if unit.IsNonTransactional() {
+				fmt.Printf("  %s (%s, outside of transaction)\n", unit.Name, unit.Type)
+			} else {
+				fmt.Printf("  %s (%s)\n", unit.Name, unit.Type)
+			}
+			if limits := unitLimits(unit); len(limits) > 0 {
+				fmt.Printf("    %s\n", strings.Join(limits, ", "))
+			}
+			sql := unit.SQL.Get(migDB.Name())
+			if sql == "" {
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimSpace(sql), "\n") {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+	}
+}
+
+// unitLimits describes the timeout, lock timeout and retries of a unit
+func unitLimits(unit mig.Unit) []string {
+	var limits = []string{}
+	if unit.Timeout > 0 {
+		limits = append(limits, fmt.Sprintf("timeout %s", unit.Timeout))
+	}
+	if unit.LockTimeout > 0 {
+		limits = append(limits, fmt.Sprintf("lock timeout %s", unit.LockTimeout))
+	}
+	if unit.Retries > 0 {
+		limits = append(limits, fmt.Sprintf("%d retries", unit.Retries))
+	}
+	return limits
+}
@@ -0,0 +1,64 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"context"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+)
+
+var vapeRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Revert executed migration units",
+	Long: "Reverts all executed migration units that are not a direct or indirect dependency of the unit or target " +
+		"given with --to. Units are reverted in reverse dependency order inside a single transaction while holding " +
+		"the migration lock.",
+	Run: runRollback,
+}
+
+func init() {
+	vapeRollbackCmd.Flags().String("to", "", "Unit or target to roll back to, use \"nothing\" to revert every unit")
+	vapeCmd.AddCommand(vapeRollbackCmd)
+}
+
+func runRollback(cmd *cobra.Command, args []string) {
+	to, err := cmd.Flags().GetString("to")
+	if err != nil || to == "" {
+		log.Fatal("Rollback destination not specified, use --to")
+		return
+	}
+
+	log.Info("Opening Database")
+	db, migDB, err := openDatabase()
+	if err != nil {
+		log.Fatal("Error while connecting to database", zap.Error(err))
+		return
+	}
+	defer db.Close()
+
+	log.Info("Verifying and Loading Migration Data from Database")
+	err = migDB.CheckAndLoadTables()
+	if err != nil {
+		log.Fatal("Error while loading migration tables", zap.Error(err))
+		return
+	}
+
+	log.Info("Loading Migration Units")
+	rootGraph, err := loadGraph()
+	if err != nil {
+		log.Fatal("Could not load migration data", zap.Error(err))
+		return
+	}
+
+	log.Info("Rolling back Units", zap.String("to", to))
+	names, err := mig.NewRunner(migDB, log).Rollback(context.Background(), rootGraph, to)
+	if err != nil {
+		log.Fatal("Rollback failed", zap.Error(err))
+		return
+	}
+	if len(names) == 0 {
+		log.Info("Nothing to roll back", zap.String("to", to))
+		return
+	}
+	log.Info("Rollback finished", zap.Strings("units", names), zap.Int("unit_num", len(names)))
+}
@@ -0,0 +1,127 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+)
+
+var vapeSquashCmd = &cobra.Command{
+	Use:   "squash",
+	Short: "Squash the units of a migration target into a single baseline unit",
+	Long: "Migrates the target into a scratch schema, dumps the tables, sequences, constraints and indexes it " +
+		"contains and writes them as the SQL of a new unit for the configured dialect. The new unit lists the " +
+		"squashed units, once they have been removed from the graph new databases only execute the new unit. " +
+		"On databases that have executed all squashed units the new unit is recorded without executing it. " +
+		"Seed units, code units and units that are always executed are not squashed.",
+	Run: runSquash,
+}
+
+func init() {
+	vapeSquashCmd.Flags().String("into", "", "Name of the new unit, e.g. baseline/v1")
+	vapeSquashCmd.Flags().String("dir", "db/mig/arke", "Directory to write the unit file to")
+	vapeCmd.AddCommand(vapeSquashCmd)
+}
+
+func runSquash(cmd *cobra.Command, args []string) {
+	into, _ := cmd.Flags().GetString("into")
+	if into == "" {
+		log.Fatal("Name of the new unit not specified, use --into")
+		return
+	}
+	dir, err := cmd.Flags().GetString("dir")
+	if err != nil {
+		log.Fatal("Unit directory not specified", zap.Error(err))
+		return
+	}
+
+	rootGraph, err := loadGraph()
+	if err != nil {
+		log.Fatal("Could not load migration data", zap.Error(err))
+		return
+	}
+	target, err := cmd.Flags().GetString("migtarget")
+	if err != nil {
+		log.Fatal("Migration Target not specified", zap.Error(err))
+		return
+	}
+	migGraph, err := rootGraph.GetTargetSubgraph(target)
+	if err != nil {
+		log.Fatal("Could not load Subgraph", zap.Error(err))
+		return
+	}
+	order, err := migGraph.GetExecutionOrder()
+	if err != nil {
+		log.Fatal("Could not determine execution order", zap.Error(err))
+		return
+	}
+	var units = map[string]mig.Unit{}
+	for _, name := range order {
+		unit, err := migGraph.GetUnit(name)
+		if err != nil {
+			log.Fatal("Could not load unit", zap.String("unit", name), zap.Error(err))
+			return
+		}
+		if len(unit.Environments) > 0 || unit.RunIf != (mig.SQLSection{}) {
+			log.Fatal("Target contains units that run conditionally, their effect depends on the database",
+				zap.String("unit", name))
+			return
+		}
+		units[name] = unit
+	}
+
+	dialect := viper.GetString("db.dialect")
+	var squashed = []string{}
+	var ddl string
+	err = migrateScratch(dialect, target, func(migDB mig.Dialect, executed []string) error {
+		dumper, ok := migDB.(mig.SchemaDumper)
+		if !ok {
+			return fmt.Errorf("Dialect %s cannot dump the schema", migDB.Name())
+		}
+		for _, name := range executed {
+			if squashable(units[name]) {
+				squashed = append(squashed, name)
+			}
+		}
+		ddl, err = dumper.DumpSchema()
+		return err
+	})
+	if err != nil {
+		log.Fatal("Could not dump scratch schema", zap.Error(err))
+		return
+	}
+
+	err = mig.WriteSquashUnit(dir, into, mig.SquashOptions{
+		Description: fmt.Sprintf("Schema of target %s, squashed from %d units", target, len(squashed)),
+		Dialect:     dialect,
+		SQL:         ddl,
+		Squashes:    squashed,
+	})
+	if err != nil {
+		log.Fatal("Could not write squashed unit", zap.Error(err))
+		return
+	}
+	fmt.Printf("Squashed %d units of target %s into %s\n", len(squashed), target, into)
+	var kept = []string{}
+	for _, name := range order {
+		if unit := units[name]; unit.Type != mig.UnitTypeVirtualTarget && !squashable(unit) {
+			kept = append(kept, name)
+		}
+	}
+	if len(kept) > 0 {
+		fmt.Printf("Keep these units, they have not been squashed: %v\n", kept)
+	}
+	fmt.Printf("Remove the squashed units from the graph and let the targets depend on %s instead\n", into)
+}
+
+// squashable returns true if the effect of the unit is part of the schema dump. Seed, code and always executed units
+// are kept next to the squashed unit.
+func squashable(unit mig.Unit) bool {
+	switch unit.Type {
+	case mig.UnitTypeVirtualTarget, mig.UnitTypeSeed, mig.UnitTypeCode:
+		return false
+	}
+	return !unit.AlwaysExec
+}
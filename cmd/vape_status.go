@@ -0,0 +1,126 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var vapeStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of all migration units",
+	Long: "Compares the units of the migration target with the migration table and prints whether each unit " +
+		"is applied, pending, always executed or recorded in the database but not part of the target.",
+	Run: runStatus,
+}
+
+func init() {
+	vapeStatusCmd.Flags().String("format", "table", "Output format, either table or json")
+	vapeCmd.AddCommand(vapeStatusCmd)
+}
+
+func runStatus(cmd *cobra.Command, args []string) {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		log.Fatal("Output format not specified", zap.Error(err))
+		return
+	}
+	if format != "table" && format != "json" {
+		log.Fatal("Unknown output format", zap.String("format", format))
+		return
+	}
+
+	db, migDB, err := openDatabase()
+	if err != nil {
+		log.Fatal("Error while connecting to database", zap.Error(err))
+		return
+	}
+	defer db.Close()
+
+	// Status only reads from the database, it must not need DDL privileges or wait for a running migration
+	hasTable, err := migDB.HasMigrationTable()
+	if err != nil {
+		log.Fatal("Error while checking migration tables", zap.Error(err))
+		return
+	}
+
+	rootGraph, err := loadGraph()
+	if err != nil {
+		log.Fatal("Could not load migration data", zap.Error(err))
+		return
+	}
+
+	target, err := cmd.Flags().GetString("migtarget")
+	if err != nil {
+		log.Fatal("Migration Target not specified", zap.Error(err))
+		return
+	}
+	migGraph, err := rootGraph.GetTargetSubgraph(target)
+	if err != nil {
+		log.Fatal("Could not load Subgraph", zap.Error(err))
+		return
+	}
+
+	_, err = migGraph.EvaluateConditions(context.Background(), migDB)
+	if err != nil {
+		log.Fatal("Could not evaluate run_if queries", zap.Error(err))
+		return
+	}
+
+	var executedUnits = []mig.ExecutedUnit{}
+	if hasTable {
+		executedUnits, err = migDB.GetExecutedUnitInfo()
+		if err != nil {
+			log.Fatal("Error loading executed units", zap.Error(err))
+			return
+		}
+	}
+
+	status, err := migGraph.GetStatus(migDB.Name(), executedUnits)
+	if err != nil {
+		log.Fatal("Could not determine unit status", zap.Error(err))
+		return
+	}
+
+	if finder, ok := migDB.(mig.InvalidIndexFinder); ok {
+		invalid, err := finder.GetInvalidIndexes()
+		if err != nil {
+			log.Fatal("Could not check for invalid indexes", zap.Error(err))
+			return
+		}
+		if len(invalid) > 0 {
+			log.Warn("Invalid indexes left behind by failed units must be dropped before migrating",
+				zap.Strings("indexes", invalid))
+		}
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(status)
+	} else {
+		err = printStatusTable(status)
+	}
+	if err != nil {
+		log.Fatal("Could not print status", zap.Error(err))
+	}
+}
+
+func printStatusTable(status []mig.UnitStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "UNIT\tTYPE\tSTATE\tEXECUTED ON")
+	for _, v := range status {
+		executedOn := "-"
+		if v.ExecutedOn != nil {
+			executedOn = v.ExecutedOn.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.Name, v.Type, v.State, executedOn)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,164 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// tenantsConfigured returns true if the Postgres database hosts tenants in their own schemas, configured as a
+// list in db.postgres.tenants.schemas or as a pattern matching schema names in db.postgres.tenants.pattern
+func tenantsConfigured() bool {
+	return viper.GetString("db.dialect") == mig.DialectPostgres &&
+		(len(viper.GetStringSlice("db.postgres.tenants.schemas")) > 0 ||
+			viper.GetString("db.postgres.tenants.pattern") != "")
+}
+
+// runTenants migrates every tenant schema in its own transactions, at most db.postgres.tenants.parallel tenants
+// at a time, and prints a summary of the tenants
+func runTenants(cmd *cobra.Command, log *zap.Logger) {
+	if cmd.Flags().Changed("emit-sql") {
+		log.Fatal("Cannot write a SQL script for several tenants")
+		return
+	}
+	target, err := cmd.Flags().GetString("migtarget")
+	if err != nil {
+		log.Fatal("Migration Target not specified", zap.Error(err))
+		return
+	}
+
+	log.Info("Opening Database")
+	db, migDB, err := openDatabase()
+	if err != nil {
+		log.Fatal("Error while connecting to database", zap.Error(err))
+		return
+	}
+	tenants, err := tenantSchemas(migDB.(*mig.PostgresDialect))
+	db.Close()
+	if err != nil {
+		log.Fatal("Could not determine tenant schemas", zap.Error(err))
+		return
+	}
+	if len(tenants) == 0 {
+		log.Fatal("No tenant schemas found")
+		return
+	}
+
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		for _, tenant := range tenants {
+			fmt.Printf("Tenant %s:\n", tenant)
+			tenantDB, tenantMigDB, rootGraph, err := openTenant(tenant)
+			if err != nil {
+				log.Fatal("Could not open tenant", zap.String("tenant", tenant), zap.Error(err))
+				return
+			}
+			migGraph, err := rootGraph.GetTargetSubgraph(target)
+			if err != nil {
+				log.Fatal("Could not load Subgraph", zap.String("tenant", tenant), zap.Error(err))
+				return
+			}
+			runPlan(cmd, log, tenantMigDB, migGraph)
+			tenantDB.Close()
+		}
+		return
+	}
+
+	parallel := viper.GetInt("db.postgres.tenants.parallel")
+	log.Info("Migrating tenants", zap.Int("tenant_num", len(tenants)), zap.Int("parallel", parallel))
+	results := mig.RunTenants(context.Background(), tenants, parallel,
+		func(ctx context.Context, tenant string) ([]string, error) {
+			return migrateTenant(ctx, cmd, log.With(zap.String("tenant", tenant)), tenant, target)
+		})
+
+	var counts = map[mig.TenantStatus]int{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tSTATUS\tUNITS\tDURATION\tERROR")
+	for _, result := range results {
+		counts[result.Status]++
+		var errText string
+		if result.Err != nil {
+			errText = result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", result.Tenant, result.Status, len(result.Executed),
+			result.Duration.Round(time.Millisecond), errText)
+	}
+	w.Flush()
+	fmt.Printf("%d tenants: %d migrated, %d current, %d failed\n", len(results), counts[mig.TenantMigrated],
+		counts[mig.TenantCurrent], counts[mig.TenantFailed])
+	if counts[mig.TenantFailed] > 0 {
+		log.Fatal("Migration of tenants failed", zap.Int("failed_num", counts[mig.TenantFailed]))
+	}
+}
+
+// tenantSchemas returns the configured tenant schemas followed by the schemas matching the pattern. Configured
+// schemas that do not exist yet are created.
+func tenantSchemas(migDB *mig.PostgresDialect) ([]string, error) {
+	var tenants = []string{}
+	var seen = map[string]bool{}
+	for _, schema := range viper.GetStringSlice("db.postgres.tenants.schemas") {
+		if seen[schema] {
+			continue
+		}
+		err := migDB.CreateSchema(schema)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create schema %s: %s", schema, err)
+		}
+		seen[schema] = true
+		tenants = append(tenants, schema)
+	}
+	if pattern := viper.GetString("db.postgres.tenants.pattern"); pattern != "" {
+		schemas, err := migDB.Schemas(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, schema := range schemas {
+			if !seen[schema] {
+				seen[schema] = true
+				tenants = append(tenants, schema)
+			}
+		}
+	}
+	return tenants, nil
+}
+
+// openTenant connects to the schema of the tenant and loads the graph with the schema variable set to the schema
+// of the tenant
+func openTenant(tenant string) (*sql.DB, mig.Dialect, *mig.Graph, error) {
+	var vars = graphVars()
+	vars["schema"] = tenant
+	rootGraph, err := loadGraphVars(vars)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	db, migDB, err := openDialect(mig.DialectPostgres, tenant)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return db, migDB, rootGraph, nil
+}
+
+// migrateTenant migrates the target in the schema of the tenant and returns the executed units without targets
+func migrateTenant(ctx context.Context, cmd *cobra.Command, log *zap.Logger, tenant,
+	target string) ([]string, error) {
+	db, migDB, rootGraph, err := openTenant(tenant)
+	if err != nil {
+		log.Error("Could not open tenant", zap.Error(err))
+		return nil, err
+	}
+	defer db.Close()
+
+	report, err := migrate(ctx, cmd, log, migDB, rootGraph, target)
+	if err != nil {
+		logMigrationError(log.Error, err)
+	} else {
+		log.Info("Migration finished", zap.Int("unit_num", len(report.Executed)))
+	}
+	return report.Executed, err
+}
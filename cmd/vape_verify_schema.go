@@ -0,0 +1,137 @@
+package cmd // import "iris.arke.works/forum/cmd"
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"iris.arke.works/forum/db/mig"
+	"time"
+)
+
+var vapeVerifySchemaCmd = &cobra.Command{
+	Use:   "verify-schema",
+	Short: "Compare the schema created by the migration target with the models package",
+	Long: "Migrates the target into a scratch schema, reads its tables, columns, types, nullability and " +
+		"indexes and compares them with the structs and queries in the source of the models package. " +
+		"The scratch schema is dropped afterwards. On Postgres a scratch schema is created in the configured " +
+		"database, on MySQL a scratch database and on SQLite an in-memory database is used.",
+	Run: runVerifySchema,
+}
+
+func init() {
+	vapeVerifySchemaCmd.Flags().String("models", "db/models", "Directory of the models package source")
+	vapeCmd.AddCommand(vapeVerifySchemaCmd)
+}
+
+func runVerifySchema(cmd *cobra.Command, args []string) {
+	dir, err := cmd.Flags().GetString("models")
+	if err != nil {
+		log.Fatal("Models directory not specified", zap.Error(err))
+		return
+	}
+	models, err := mig.LoadModels(dir)
+	if err != nil {
+		log.Fatal("Could not load models", zap.Error(err))
+		return
+	}
+	if len(models) == 0 {
+		log.Fatal("No models found", zap.String("dir", dir))
+		return
+	}
+
+	target, err := cmd.Flags().GetString("migtarget")
+	if err != nil {
+		log.Fatal("Migration Target not specified", zap.Error(err))
+		return
+	}
+
+	dialect := viper.GetString("db.dialect")
+	var schema *mig.Schema
+	err = migrateScratch(dialect, target, func(migDB mig.Dialect, executed []string) error {
+		inspector, ok := migDB.(mig.SchemaInspector)
+		if !ok {
+			return fmt.Errorf("Dialect %s cannot inspect the schema", migDB.Name())
+		}
+		schema, err = inspector.InspectSchema()
+		return err
+	})
+	if err != nil {
+		log.Fatal("Could not migrate scratch schema", zap.Error(err))
+		return
+	}
+
+	problems := mig.VerifyModels(schema, models, dialect)
+	if len(problems) == 0 {
+		fmt.Printf("Models match the schema of target %s\n", target)
+		return
+	}
+	fmt.Printf("Models do not match the schema of target %s:\n", target)
+	for _, problem := range problems {
+		fmt.Printf("  %s\n", problem)
+	}
+	log.Fatal("Schema verification failed", zap.Int("problem_num", len(problems)))
+}
+
+// migrateScratch migrates the target into a scratch schema and calls inspect with the dialect of the scratch schema
+// and the executed units. The graph is loaded with the schema variable set to the scratch schema, like the graph of
+// a tenant. The scratch schema is dropped before returning.
+func migrateScratch(dialect, target string, inspect func(migDB mig.Dialect, executed []string) error) error {
+	var scratch = fmt.Sprintf("vape_scratch_%d", time.Now().UnixNano())
+	var create, drop string
+	switch dialect {
+	case mig.DialectPostgres:
+		create = "CREATE SCHEMA " + scratch + ";"
+		drop = "DROP SCHEMA " + scratch + " CASCADE;"
+	case mig.DialectMySQL:
+		create = "CREATE DATABASE " + scratch + ";"
+		drop = "DROP DATABASE " + scratch + ";"
+	}
+	var vars = graphVars()
+	if create != "" {
+		vars["schema"] = scratch
+	}
+	rootGraph, err := loadGraphVars(vars)
+	if err != nil {
+		return fmt.Errorf("Could not load migration data: %s", err)
+	}
+	migGraph, err := rootGraph.GetTargetSubgraph(target)
+	if err != nil {
+		return fmt.Errorf("Could not load Subgraph: %s", err)
+	}
+
+	if create != "" {
+		db, _, err := openDatabase()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		log.Info("Creating scratch schema", zap.String("schema", scratch))
+		_, err = db.Exec(create)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			log.Info("Dropping scratch schema", zap.String("schema", scratch))
+			if _, err := db.Exec(drop); err != nil {
+				log.Error("Could not drop scratch schema", zap.String("schema", scratch), zap.Error(err))
+			}
+		}()
+	}
+
+	scratchDB, migDB, err := openDialect(dialect, scratch)
+	if err != nil {
+		return err
+	}
+	defer scratchDB.Close()
+	err = migDB.CheckAndLoadTables()
+	if err != nil {
+		return err
+	}
+	executed, err := mig.NewRunner(migDB, log).Run(context.Background(), migGraph)
+	if err != nil {
+		return err
+	}
+	return inspect(migDB, executed)
+}
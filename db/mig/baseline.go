@@ -0,0 +1,290 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go.uber.org/zap"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	createTableRegexp = regexp.MustCompile(`(?is)^CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?([\w."` + "`" +
+		`]+)\s*\((.*)\)`)
+	createIndexRegexp = regexp.MustCompile(`(?is)^CREATE\s+(?:UNIQUE\s+)?INDEX\s+(?:CONCURRENTLY\s+)?` +
+		`(?:IF\s+NOT\s+EXISTS\s+)?([\w."` + "`" + `]+)\s+ON\s+([\w."` + "`" + `]+)`)
+	addColumnRegexp = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(?:ONLY\s+)?([\w."` + "`" +
+		`]+)\s+ADD\s+(?:COLUMN\s+)?(?:IF\s+NOT\s+EXISTS\s+)?([\w"` + "`" + `]+)`)
+)
+
+// constraintKeywords start the items of a table definition that are not columns
+var constraintKeywords = map[string]bool{
+	"CONSTRAINT": true, "PRIMARY": true, "UNIQUE": true, "FOREIGN": true, "CHECK": true, "EXCLUDE": true,
+	"INDEX": true, "KEY": true, "FULLTEXT": true, "SPATIAL": true,
+}
+
+// SchemaObject is a table, column or index created by the SQL of a unit
+type SchemaObject struct {
+	// Kind is either "table", "column" or "index"
+	Kind string
+	// Table is the table of the object, for tables it is the name of the table
+	Table string
+	// Name is the name of the column or index, it is empty for tables
+	Name string
+}
+
+func (o SchemaObject) String() string {
+	switch o.Kind {
+	case "table":
+		return "table " + o.Table
+	case "column":
+		return "column " + o.Table + "." + o.Name
+	}
+	return "index " + o.Name + " on " + o.Table
+}
+
+// CreatedObjects returns the tables, columns and indexes created by the SQL of the unit for the dialect. Statements
+// other than CREATE TABLE, CREATE INDEX and ALTER TABLE ... ADD COLUMN are ignored.
+func (u Unit) CreatedObjects(dialect string) []SchemaObject {
+	var objects = []SchemaObject{}
+	for _, statement := range splitStatements(stripComments(u.SQL.Get(dialect)), dialect) {
+		if match := createTableRegexp.FindStringSubmatch(statement); match != nil {
+			table := normalizeName(match[1])
+			objects = append(objects, SchemaObject{Kind: "table", Table: table})
+			for _, item := range splitTopLevel(match[2]) {
+				fields := strings.FieldsFunc(item, func(c rune) bool { return c == '(' || unicode.IsSpace(c) })
+				if len(fields) == 0 || constraintKeywords[strings.ToUpper(fields[0])] {
+					continue
+				}
+				objects = append(objects, SchemaObject{Kind: "column", Table: table, Name: normalizeName(fields[0])})
+			}
+		} else if match := createIndexRegexp.FindStringSubmatch(statement); match != nil {
+			objects = append(objects, SchemaObject{Kind: "index", Table: normalizeName(match[2]),
+				Name: normalizeName(match[1])})
+		} else if match := addColumnRegexp.FindStringSubmatch(statement); match != nil {
+			if !constraintKeywords[strings.ToUpper(match[2])] {
+				objects = append(objects, SchemaObject{Kind: "column", Table: normalizeName(match[1]),
+					Name: normalizeName(match[2])})
+			}
+		}
+	}
+	return objects
+}
+
+// BaselineReport is the result of comparing the units of a target with the schema of an existing database
+type BaselineReport struct {
+	Units []BaselineUnit
+}
+
+// BaselineUnit is the result of comparing the objects created by a unit with the schema of the database
+type BaselineUnit struct {
+	Name string
+	// Objects lists the objects the unit creates
+	Objects []SchemaObject
+	// Mismatches describes the objects that do not exist in the database as expected
+	Mismatches []string
+}
+
+// Verified returns true if the unit creates objects and all of them exist in the database
+func (u BaselineUnit) Verified() bool {
+	return len(u.Objects) > 0 && len(u.Mismatches) == 0
+}
+
+// HasMismatches returns true if any unit creates objects that do not exist in the database
+func (r *BaselineReport) HasMismatches() bool {
+	for _, unit := range r.Units {
+		if len(unit.Mismatches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Unverified returns the units that create no objects the check understands, like code units and units only
+// changing data
+func (r *BaselineReport) Unverified() []string {
+	var names = []string{}
+	for _, unit := range r.Units {
+		if !unit.Verified() && len(unit.Mismatches) == 0 {
+			names = append(names, unit.Name)
+		}
+	}
+	return names
+}
+
+// CheckBaseline compares the objects created by the units with the schema of the database. Units that create no
+// objects the check understands, like code units and units only changing data, are neither verified nor
+// mismatched. Targets, always executed units and skipped units are left out, so are seed units, which the next
+// migration executes.
+func CheckBaseline(schema *Schema, dialect string, units []Unit) *BaselineReport {
+	var report = &BaselineReport{Units: []BaselineUnit{}}
+	for _, unit := range units {
+		if unit.Type == UnitTypeVirtualTarget || unit.Type == UnitTypeSeed || unit.AlwaysExec || unit.skipped {
+			continue
+		}
+		var result = BaselineUnit{Name: unit.Name, Objects: []SchemaObject{}, Mismatches: []string{}}
+		if unit.Type != UnitTypeCode {
+			result.Objects = unit.CreatedObjects(dialect)
+		}
+		// Objects of a missing table created by the same unit are not reported on their own
+		var missingTables = map[string]bool{}
+		for _, object := range result.Objects {
+			if missingTables[object.Table] {
+				continue
+			}
+			if mismatch := schema.check(object); mismatch != "" {
+				result.Mismatches = append(result.Mismatches, mismatch)
+				if object.Kind == "table" {
+					missingTables[object.Table] = true
+				}
+			}
+		}
+		report.Units = append(report.Units, result)
+	}
+	return report
+}
+
+// check returns a description of the mismatch if the object does not exist in the schema
+func (s *Schema) check(object SchemaObject) string {
+	table, ok := s.Tables[object.Table]
+	if !ok {
+		if object.Kind == "table" {
+			return fmt.Sprintf("%s does not exist", object)
+		}
+		return fmt.Sprintf("%s does not exist, table %s is missing", object, object.Table)
+	}
+	switch object.Kind {
+	case "column":
+		if !table.HasColumn(object.Name) {
+			return fmt.Sprintf("%s does not exist", object)
+		}
+	case "index":
+		if other := s.IndexTable(object.Name); other == "" {
+			return fmt.Sprintf("%s does not exist", object)
+		} else if other != object.Table {
+			return fmt.Sprintf("%s exists on table %s", object, other)
+		}
+	}
+	return ""
+}
+
+// normalizeName removes quotes and the schema from a name and converts it to lower case
+func normalizeName(name string) string {
+	name = strings.NewReplacer(`"`, "", "`", "").Replace(name)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(name)
+}
+
+// stripComments removes line comments from SQL so they do not hide the start of statements
+func stripComments(query string) string {
+	var lines = strings.Split(query, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// splitTopLevel splits the items of a table definition at commas outside of parentheses
+func splitTopLevel(definition string) []string {
+	var items = []string{}
+	var depth, start = 0, 0
+	for i, c := range definition {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(definition[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(items, strings.TrimSpace(definition[start:]))
+}
+
+// RecordUnits records the units as executed without running them. All units are recorded in a single transaction
+// that holds the migration lock, units recorded by another migration in the meantime and seed units are left
+// out. It returns the names of the recorded units, targets and always executed units are never recorded.
+func (r *Runner) RecordUnits(ctx context.Context, units []Unit) ([]string, error) {
+	if r.dialect.TransactionalDDL() {
+		tx, err := r.dialect.begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = r.acquireLock(ctx, tx, r.dialect.lock, false)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		return r.recordUnits(ctx, tx, units)
+	}
+
+	session, ok := r.dialect.(sessionDialect)
+	if !ok {
+		return nil, fmt.Errorf("Dialect %s supports neither transactional DDL nor sessions", r.dialect.Name())
+	}
+	conn, err := session.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = r.acquireLock(ctx, conn, session.lockSession, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := session.unlock(ctx, conn); err != nil {
+			r.log.Warn("Could not release migration lock", zap.Error(err))
+		}
+	}()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.recordUnits(ctx, tx, units)
+}
+
+// recordUnits records the units on tx and commits it, tx is rolled back if a unit cannot be recorded
+func (r *Runner) recordUnits(ctx context.Context, tx *sql.Tx, units []Unit) ([]string, error) {
+	executedUnits, err := r.dialect.getExecutedUnits(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var executed = map[string]bool{}
+	for _, name := range executedUnits {
+		executed[name] = true
+	}
+
+	var recorded = []string{}
+	for _, unit := range units {
+		if executed[unit.Name] || unit.Type == UnitTypeSeed {
+			continue
+		}
+		// Satisfied units are recorded without being run
+		unit.satisfied = true
+		err = r.dialect.executeUnit(ctx, tx, unit)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("Could not record unit %s: %s", unit.Name, err)
+		}
+		if unit.Type != UnitTypeVirtualTarget && !unit.AlwaysExec {
+			recorded = append(recorded, unit.Name)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Could not commit recorded units: %s", err)
+	}
+	return recorded, nil
+}
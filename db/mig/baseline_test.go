@@ -0,0 +1,78 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestUnit_CreatedObjects(t *testing.T) {
+	assert := require.New(t)
+
+	unit := Unit{SQL: SQLSection{Postgres: `-- Test table
+CREATE TABLE IF NOT EXISTS public."Users" (
+	snowflake	bigint		NOT NULL,
+	name	varchar(1024)	NOT NULL,
+	color	numeric(10, 2),
+
+	PRIMARY KEY(snowflake),
+	UNIQUE(name, color),
+	CONSTRAINT positive CHECK (color > 0)
+);
+CREATE UNIQUE INDEX CONCURRENTLY users_name_index ON users(name);
+ALTER TABLE users ADD COLUMN email text;
+ALTER TABLE users ADD CONSTRAINT email_unique UNIQUE (email);
+INSERT INTO users (snowflake, name) VALUES (1, 'admin');`}}
+
+	assert.EqualValues([]SchemaObject{
+		{Kind: "table", Table: "users"},
+		{Kind: "column", Table: "users", Name: "snowflake"},
+		{Kind: "column", Table: "users", Name: "name"},
+		{Kind: "column", Table: "users", Name: "color"},
+		{Kind: "index", Table: "users", Name: "users_name_index"},
+		{Kind: "column", Table: "users", Name: "email"},
+	}, unit.CreatedObjects(DialectPostgres))
+	assert.Empty(unit.CreatedObjects(DialectMySQL))
+
+	assert.Equal("table users", SchemaObject{Kind: "table", Table: "users"}.String())
+	assert.Equal("column users.name", SchemaObject{Kind: "column", Table: "users", Name: "name"}.String())
+	assert.Equal("index users_name_index on users",
+		SchemaObject{Kind: "index", Table: "users", Name: "users_name_index"}.String())
+}
+
+func TestCheckBaseline(t *testing.T) {
+	assert := require.New(t)
+
+	schema := &Schema{Tables: map[string]*SchemaTable{
+		"users":  {Name: "users", Columns: []SchemaColumn{{Name: "snowflake"}, {Name: "name"}}, Indexes: []string{"users_pkey"}},
+		"topics": {Name: "topics", Columns: []SchemaColumn{{Name: "snowflake"}}, Indexes: []string{"users_name_index"}},
+	}}
+	units := []Unit{
+		{Name: "create_users", Type: UnitTypeMigration,
+			SQL: SQLSection{Postgres: "CREATE TABLE users (snowflake bigint, name text, email text);"}},
+		{Name: "index_users", Type: UnitTypeMigration,
+			SQL: SQLSection{Postgres: "CREATE INDEX users_name_index ON users(name);"}},
+		{Name: "create_replies", Type: UnitTypeMigration,
+			SQL: SQLSection{Postgres: "CREATE TABLE replies (snowflake bigint); CREATE INDEX replies_index ON replies(snowflake);"}},
+		{Name: "create_topics", Type: UnitTypeMigration, SQL: SQLSection{Postgres: "CREATE TABLE topics (snowflake bigint);"}},
+		{Name: "index_replies", Type: UnitTypeMigration,
+			SQL: SQLSection{Postgres: "CREATE INDEX replies_time_index ON replies(created_at);"}},
+		{Name: "backfill", Type: UnitTypeCode},
+		{Name: "always", Type: UnitTypeMigration, AlwaysExec: true, SQL: SQLSection{Postgres: "CREATE TABLE always ();"}},
+		{Name: "target", Type: UnitTypeVirtualTarget},
+	}
+
+	report := CheckBaseline(schema, DialectPostgres, units)
+	assert.True(report.HasMismatches())
+	assert.Len(report.Units, 6)
+	assert.EqualValues([]string{"column users.email does not exist"}, report.Units[0].Mismatches)
+	assert.EqualValues([]string{"index users_name_index on users exists on table topics"}, report.Units[1].Mismatches)
+	assert.EqualValues([]string{"table replies does not exist"}, report.Units[2].Mismatches)
+	assert.True(report.Units[3].Verified())
+	assert.EqualValues([]string{"index replies_time_index on replies does not exist, table replies is missing"},
+		report.Units[4].Mismatches)
+	assert.False(report.Units[5].Verified())
+	assert.Empty(report.Units[5].Mismatches)
+
+	report = CheckBaseline(schema, DialectPostgres, append(units[3:4], units[5:]...))
+	assert.False(report.HasMismatches())
+}
@@ -0,0 +1,134 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go.uber.org/zap"
+	"math"
+	"time"
+)
+
+// batchQueries are the queries a dialect uses to execute batch units
+type batchQueries struct {
+	// nextKey selects the last key of the batch after the key given as first parameter, the second parameter is
+	// the batch size. It is formatted with the table and the key column and returns NULL if no rows are left.
+	nextKey string
+	// getCheckpoint selects the last key of the last committed batch of the unit
+	getCheckpoint string
+	// setCheckpoint stores the name of the unit and the last key of the committed batch
+	setCheckpoint string
+	// deleteCheckpoint removes the checkpoint of the unit once it is recorded as executed
+	deleteCheckpoint string
+	// markExecuted records the unit, it receives the name, type and checksum of the unit
+	markExecuted string
+}
+
+// batchDialect is implemented by dialects that can execute batch units. Batch units are executed on a connection
+// of a sessionDialect.
+type batchDialect interface {
+	batchQueries() batchQueries
+}
+
+// txBeginner is implemented by connections that can start a transaction for every batch
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// runBatch executes a batch unit on the connection. Every batch is committed along with the checkpoint of the
+// unit, a unit that was interrupted resumes after the last committed batch. The unit is recorded once no rows
+// are left.
+func (r *Runner) runBatch(ctx context.Context, conn Tx, unit Unit) error {
+	dialect, ok := r.dialect.(batchDialect)
+	if !ok {
+		return fmt.Errorf("Dialect %s cannot execute batch units", r.dialect.Name())
+	}
+	queries := dialect.batchQueries()
+	query := unit.SQL.Get(r.dialect.Name())
+	nextKey := fmt.Sprintf(queries.nextKey, unit.Batch.Table, unit.Batch.KeyColumn())
+	log := r.log.With(zap.String("unit", unit.Name))
+
+	var lastKey int64 = math.MinInt64
+	var checkpoint sql.NullInt64
+	err := conn.QueryRowContext(ctx, queries.getCheckpoint, unit.Name).Scan(&checkpoint)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("Could not read checkpoint: %s", err)
+	}
+	if checkpoint.Valid {
+		lastKey = checkpoint.Int64
+		log.Info("Resuming batch unit from checkpoint", zap.Int64("last_key", lastKey))
+	}
+
+	var batches, rows int64
+	var start = time.Now()
+	for {
+		var next sql.NullInt64
+		err = conn.QueryRowContext(ctx, nextKey, lastKey, unit.Batch.BatchSize()).Scan(&next)
+		if err != nil {
+			return fmt.Errorf("Could not select next batch after key %d: %s", lastKey, err)
+		}
+		if !next.Valid {
+			break
+		}
+		var affected int64
+		err = inBatchTx(ctx, conn, func(ex Tx) error {
+			result, err := ex.ExecContext(ctx, query, lastKey, next.Int64)
+			if err != nil {
+				return err
+			}
+			if result != nil {
+				affected, _ = result.RowsAffected()
+			}
+			_, err = ex.ExecContext(ctx, queries.setCheckpoint, unit.Name, next.Int64)
+			if err != nil {
+				return fmt.Errorf("Could not store checkpoint: %s", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Batch after key %d failed: %w", lastKey, err)
+		}
+		batches++
+		rows += affected
+		lastKey = next.Int64
+		log.Info("Committed batch", zap.Int64("last_key", lastKey), zap.Int64("rows", affected),
+			zap.Int64("batch_num", batches), zap.Int64("rows_total", rows), zap.Duration("elapsed", time.Since(start)))
+	}
+
+	err = inBatchTx(ctx, conn, func(ex Tx) error {
+		if !unit.AlwaysExec {
+			_, err := ex.ExecContext(ctx, queries.markExecuted, unit.Name, string(unit.Type),
+				unit.Checksum(r.dialect.Name()))
+			if err != nil {
+				return fmt.Errorf("Could not mark unit as executed: %s", err)
+			}
+		}
+		_, err := ex.ExecContext(ctx, queries.deleteCheckpoint, unit.Name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("Batch unit completed", zap.Int64("batch_num", batches), zap.Int64("rows_total", rows),
+		zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
+
+// inBatchTx runs f in a transaction on the connection. If the connection cannot start a transaction, f is
+// executed on the connection directly.
+func inBatchTx(ctx context.Context, conn Tx, f func(ex Tx) error) error {
+	beginner, ok := conn.(txBeginner)
+	if !ok {
+		return f(conn)
+	}
+	tx, err := beginner.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,41 @@
+package mig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBatchQueries(t *testing.T) {
+	assert := require.New(t)
+
+	unit := Unit{Batch: BatchSection{Table: "replies"}}
+	for _, dialect := range []batchDialect{OpenFromPGConn(nil), OpenFromSQLiteConn(nil), OpenFromMySQLConn(nil)} {
+		query := fmt.Sprintf(dialect.batchQueries().nextKey, unit.Batch.Table, unit.Batch.KeyColumn())
+		assert.Contains(query, "SELECT max(snowflake) FROM (SELECT snowflake FROM replies WHERE snowflake > ")
+	}
+	assert.Equal("SELECT max(snowflake) FROM (SELECT snowflake FROM replies WHERE snowflake > $1 ORDER BY "+
+		"snowflake LIMIT $2) AS batch;", fmt.Sprintf(nextBatchKeyQuery, "replies", "snowflake"))
+}
+
+func TestInBatchTx(t *testing.T) {
+	assert := require.New(t)
+
+	// Connections that cannot start transactions execute the batch directly
+	conn := &txRecorder{fail: "SELECT 2;"}
+	assert.NoError(inBatchTx(context.Background(), conn, func(ex Tx) error {
+		_, err := ex.ExecContext(context.Background(), "SELECT 1;")
+		return err
+	}))
+	assert.EqualError(inBatchTx(context.Background(), conn, func(ex Tx) error {
+		_, err := ex.ExecContext(context.Background(), "SELECT 2;")
+		return err
+	}), "Test error")
+	assert.EqualValues([]string{"SELECT 1;", "SELECT 2;"}, conn.queries)
+
+	assert.EqualError(inBatchTx(context.Background(), conn, func(ex Tx) error {
+		return errors.New("Batch error")
+	}), "Batch error")
+}
@@ -0,0 +1,110 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// Tx is the transaction a code unit is executed in. On dialects without transactional DDL it is the single
+// connection of the migration instead, see MySQLDialect.
+type Tx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// CodeFunc is the Go code of a code unit. It must only use the given transaction to access the database.
+type CodeFunc func(ctx context.Context, tx Tx) error
+
+type codeFuncs struct {
+	up   CodeFunc
+	down CodeFunc
+}
+
+var (
+	codeUnitsMutex sync.RWMutex
+	codeUnits      = map[string]codeFuncs{}
+)
+
+// RegisterCode registers the functions of the code unit with the given name, which is the name of its unit file.
+// Up is executed when migrating, down when rolling back. Down may be nil if the unit cannot be rolled back.
+//
+// The unit file declares the type and the dependencies of the unit, it has no SQL sections:
+//
+//	description: Re-encode user avatars
+//	type: code
+//	depends_on:
+//	- db_setup/create_users
+//
+// RegisterCode is meant to be called from init functions, it panics if up is nil or the name is registered twice.
+func RegisterCode(name string, up, down CodeFunc) {
+	codeUnitsMutex.Lock()
+	defer codeUnitsMutex.Unlock()
+	if up == nil {
+		panic("mig: RegisterCode up function is nil for unit " + name)
+	}
+	if _, dup := codeUnits[name]; dup {
+		panic("mig: RegisterCode called twice for unit " + name)
+	}
+	codeUnits[name] = codeFuncs{up: up, down: down}
+}
+
+// lookupCode returns the registered functions of a code unit
+func lookupCode(name string) (codeFuncs, bool) {
+	codeUnitsMutex.RLock()
+	defer codeUnitsMutex.RUnlock()
+	funcs, ok := codeUnits[name]
+	return funcs, ok
+}
+
+// runUnit executes the SQL, Go code or seed rows of a unit for the dialect without recording it. Units whose
+// squashed units have been executed are not executed.
+func runUnit(ctx context.Context, ex Tx, dialect string, unit Unit) error {
+	if unit.satisfied {
+		return nil
+	}
+	if unit.Type == UnitTypeCode {
+		funcs, ok := lookupCode(unit.Name)
+		if !ok {
+			return fmt.Errorf("No code registered for unit %s", unit.Name)
+		}
+		return funcs.up(ctx, ex)
+	}
+	if unit.Type == UnitTypeSeed {
+		return runSeed(ctx, ex, unit)
+	}
+	return execUnitSQL(ctx, ex, dialect, unit, unit.SQL.Get(dialect))
+}
+
+// revertUnit executes the down section or the down function of a unit for the dialect without recording it
+func revertUnit(ctx context.Context, ex Tx, dialect string, unit Unit) error {
+	if unit.Type == UnitTypeCode {
+		funcs, ok := lookupCode(unit.Name)
+		if !ok || funcs.down == nil {
+			return fmt.Errorf("No down code registered for unit %s", unit.Name)
+		}
+		return funcs.down(ctx, ex)
+	}
+	return execUnitSQL(ctx, ex, dialect, unit, unit.Down.Get(dialect))
+}
+
+// execUnitSQL executes SQL of the unit for the dialect. The statements of non-transactional units are executed one at a time,
+// since several statements in a single query run in an implicit transaction on some databases.
+func execUnitSQL(ctx context.Context, ex Tx, dialect string, unit Unit, query string) error {
+	if query == "" {
+		return nil
+	}
+	if !unit.IsNonTransactional() {
+		_, err := ex.ExecContext(ctx, query)
+		return err
+	}
+	for _, statement := range splitStatements(query, dialect) {
+		_, err := ex.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
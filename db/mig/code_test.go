@@ -0,0 +1,86 @@
+package mig
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRegisterCode(t *testing.T) {
+	assert := require.New(t)
+
+	up := func(ctx context.Context, tx Tx) error { return nil }
+
+	assert.Panics(func() { RegisterCode("test/register_nil", nil, nil) })
+
+	RegisterCode("test/register", up, nil)
+	defer delete(codeUnits, "test/register")
+	assert.Panics(func() { RegisterCode("test/register", up, nil) })
+
+	_, ok := lookupCode("test/register")
+	assert.True(ok)
+	_, ok = lookupCode("test/unregistered")
+	assert.False(ok)
+}
+
+func TestCodeUnit(t *testing.T) {
+	assert := require.New(t)
+
+	var called = []string{}
+	RegisterCode("test/code", func(ctx context.Context, tx Tx) error {
+		called = append(called, "up")
+		return nil
+	}, func(ctx context.Context, tx Tx) error {
+		called = append(called, "down")
+		return errors.New("Test error")
+	})
+	defer delete(codeUnits, "test/code")
+	RegisterCode("test/irreversible", func(ctx context.Context, tx Tx) error { return nil }, nil)
+	defer delete(codeUnits, "test/irreversible")
+
+	unit := Unit{Name: "test/code", Type: UnitTypeCode}
+	assert.True(unit.SupportsDialect(DialectPostgres))
+	assert.True(unit.IsReversible(DialectPostgres))
+	assert.False(Unit{Name: "test/irreversible", Type: UnitTypeCode}.IsReversible(DialectPostgres))
+	assert.False(Unit{Name: "test/unregistered", Type: UnitTypeCode}.IsReversible(DialectPostgres))
+
+	assert.NoError(runUnit(context.Background(), nil, DialectPostgres, unit))
+	assert.EqualError(revertUnit(context.Background(), nil, DialectPostgres, unit), "Test error")
+	assert.EqualValues([]string{"up", "down"}, called)
+
+	unregistered := Unit{Name: "test/unregistered", Type: UnitTypeCode}
+	assert.EqualError(runUnit(context.Background(), nil, DialectPostgres, unregistered),
+		"No code registered for unit test/unregistered")
+	assert.EqualError(revertUnit(context.Background(), nil, DialectPostgres, unregistered),
+		"No down code registered for unit test/unregistered")
+
+	var buf bytes.Buffer
+	assert.EqualError(OpenFromPGConn(nil).WriteScript(&buf, [][]Unit{{unit}}),
+		"Unit test/code runs Go code and cannot be written to a SQL script")
+}
+
+func TestGraph_ValidateNodes_Code(t *testing.T) {
+	assert := require.New(t)
+
+	RegisterCode("test/registered", func(ctx context.Context, tx Tx) error { return nil }, nil)
+	defer delete(codeUnits, "test/registered")
+
+	graph := NewGraph()
+	graph.nodes["test/registered"] = &Unit{Name: "test/registered", Type: UnitTypeCode, DependsOn: []string{"nothing"}}
+	assert.NoError(graph.ValidateNodes())
+
+	graph.nodes["test/unregistered"] = &Unit{
+		Name:      "test/unregistered",
+		Type:      UnitTypeCode,
+		DependsOn: []string{"nothing"},
+		SQL:       SQLSection{Postgres: "SELECT 1;"},
+	}
+	err := graph.ValidateNodes()
+	assert.Error(err)
+	assert.EqualValues([]string{
+		"Node test/unregistered is a code unit but no code is registered for it",
+		"Node test/unregistered is a code unit but has SQL sections",
+	}, err.(*ValidationError).Problems)
+}
@@ -0,0 +1,69 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// conditionMet evaluates the run_if query of the unit for the dialect on ex. Units without a query for the dialect
+// always run, a query returning NULL or no row counts as false.
+func conditionMet(ctx context.Context, ex Tx, dialect string, unit Unit) (bool, error) {
+	query := unit.RunIf.Get(dialect)
+	if query == "" {
+		return true, nil
+	}
+	var met sql.NullBool
+	err := ex.QueryRowContext(ctx, query).Scan(&met)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Could not evaluate run_if: %s", err)
+	}
+	return met.Valid && met.Bool, nil
+}
+
+// EvaluateConditions evaluates the run_if queries of the units that have not been executed against the database
+// and marks the units whose query returns false as skipped, as the runner would if it migrated now.
+// It returns the names of the skipped units.
+//
+// The queries are evaluated outside of a transaction, every query on a connection of its own. A query that fails,
+// e.g. because it depends on objects created by pending units, leaves the unit pending.
+func (g *Graph) EvaluateConditions(ctx context.Context, dialect Dialect) ([]string, error) {
+	var skipped = []string{}
+	for _, name := range g.sortedNames() {
+		node := g.nodes[name]
+		if node.executed || node.skipped {
+			continue
+		}
+		if node.RunIf.Get(dialect.Name()) == "" {
+			continue
+		}
+		met, err := evaluateCondition(ctx, dialect, *node)
+		if err != nil {
+			return nil, err
+		}
+		if !met {
+			node.skipped = true
+			skipped = append(skipped, name)
+		}
+	}
+	return skipped, nil
+}
+
+// evaluateCondition evaluates the run_if query of the unit on a connection of its own. Only errors of the
+// connection are returned, a failing query counts as true.
+func evaluateCondition(ctx context.Context, dialect Dialect, unit Unit) (bool, error) {
+	session, ok := dialect.(sessionDialect)
+	if !ok {
+		return false, fmt.Errorf("Dialect %s cannot evaluate run_if queries", dialect.Name())
+	}
+	conn, err := session.conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	met, err := conditionMet(ctx, conn, dialect.Name(), unit)
+	return met || err != nil, nil
+}
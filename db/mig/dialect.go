@@ -1,9 +1,15 @@
 package mig // import "iris.arke.works/forum/db/mig"
 
 import (
+	"context"
 	"database/sql"
-	// Import lib/pg for postgres support
-	_ "github.com/lib/pq"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"path"
+	"strings"
+	"time"
 )
 
 const pgMigTable = `CREATE TABLE IF NOT EXISTS vape_migrations (
@@ -14,27 +20,200 @@ const pgMigTable = `CREATE TABLE IF NOT EXISTS vape_migrations (
 	PRIMARY KEY(name)
 );
 
+DO $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'vape_migrations' AND column_name = 'hash'
+	) THEN
+		ALTER TABLE vape_migrations ADD COLUMN hash varchar(64);
+	END IF;
+END
+$$;
+
 DROP INDEX IF EXISTS vape_type_index;
 DROP INDEX IF EXISTS vape_name_type_index;
 CREATE INDEX vape_type_index ON vape_migrations(type);
 CREATE INDEX vape_name_type_index ON vape_migrations(name, type);
 
+CREATE TABLE IF NOT EXISTS vape_checkpoints (
+	name    varchar(1024)   NOT NULL,
+	last_key    bigint      NOT NULL,
+	updated_on timestamptz  NOT NULL    DEFAULT (now() AT TIME ZONE 'utc'),
+
+	PRIMARY KEY(name)
+);
+
 --`
 
-const markExecutedQuery = `INSERT INTO vape_migrations (name, type) VALUES
-($1, $2)
+// pgHistoryTable creates the history table, which keeps one row per attempt to execute a unit
+const pgHistoryTable = `CREATE TABLE IF NOT EXISTS vape_history (
+	id      bigserial       NOT NULL,
+	name    varchar(1024)   NOT NULL,
+	target  varchar(1024)   NOT NULL,
+	attempt integer         NOT NULL,
+	result  varchar(32)     NOT NULL,
+	error   text            NOT NULL,
+	started_on timestamptz  NOT NULL,
+	duration_ms bigint      NOT NULL,
+	hostname varchar(255)   NOT NULL,
+	operator varchar(255)   NOT NULL,
+	version varchar(255)    NOT NULL,
+
+	PRIMARY KEY(id)
+);
+
+CREATE INDEX IF NOT EXISTS vape_history_name_index ON vape_history(name);
+`
+
+// migLockKey is the key of the advisory lock held while migrating, it spells "vape"
+const migLockKey = 0x76617065
+
+const lockQuery = `SELECT pg_advisory_xact_lock($1);`
+
+const lockSessionQuery = `SELECT pg_advisory_lock($1);`
+
+const unlockSessionQuery = `SELECT pg_advisory_unlock($1);`
+
+const tryLockQuery = `SELECT pg_try_advisory_xact_lock($1);`
+
+const tryLockSessionQuery = `SELECT pg_try_advisory_lock($1);`
+
+// The tenant locks use the two key form of the advisory locks, which does not collide with migLockKey
+const tenantLockQuery = `SELECT pg_advisory_xact_lock($1, hashtext(current_schema()));`
+
+const tenantLockSessionQuery = `SELECT pg_advisory_lock($1, hashtext(current_schema()));`
+
+const tenantUnlockSessionQuery = `SELECT pg_advisory_unlock($1, hashtext(current_schema()));`
+
+const tenantTryLockQuery = `SELECT pg_try_advisory_xact_lock($1, hashtext(current_schema()));`
+
+const tenantTryLockSessionQuery = `SELECT pg_try_advisory_lock($1, hashtext(current_schema()));`
+
+const listSchemasQuery = `SELECT nspname FROM pg_namespace
+WHERE nspname NOT LIKE 'pg\_%' AND nspname <> 'information_schema' ORDER BY nspname;`
+
+const getInvalidIndexesQuery = `SELECT c.relname FROM pg_index i
+JOIN pg_class c ON c.oid = i.indexrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE NOT i.indisvalid AND n.nspname = current_schema()
+ORDER BY c.relname;`
+
+const markExecutedQuery = `INSERT INTO vape_migrations (name, type, hash) VALUES
+($1, $2, $3)
 ;`
 
-const getExecutedQuery = `SELECT name FROM vape_migrations WHERE type=$1;`
+const setChecksumQuery = `UPDATE vape_migrations SET hash=$2 WHERE name=$1 AND hash IS NULL;`
+
+const unmarkExecutedQuery = `DELETE FROM vape_migrations WHERE name=$1;`
+
+const getExecutedQuery = `SELECT name FROM vape_migrations WHERE type<>$1;`
+
+const hasMigrationTableQuery = `SELECT count(*) FROM information_schema.tables
+WHERE table_schema = current_schema() AND table_name = 'vape_migrations';`
+
+const hasHistoryTableQuery = `SELECT count(*) FROM information_schema.tables
+WHERE table_schema = current_schema() AND table_name = 'vape_history';`
+
+const getExecutedInfoQuery = `SELECT name, type, executed_on, hash FROM vape_migrations ORDER BY executed_on, name;`
+
+const recordAttemptQuery = `INSERT INTO vape_history
+(name, target, attempt, result, error, started_on, duration_ms, hostname, operator, version)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id;`
+
+const setAttemptResultQuery = `UPDATE vape_history SET result=$1 WHERE id=$2;`
+
+const nextBatchKeyQuery = `SELECT max(%[2]s) FROM (SELECT %[2]s FROM %[1]s WHERE %[2]s > $1 ORDER BY %[2]s LIMIT $2) AS batch;`
+
+const getCheckpointQuery = `SELECT last_key FROM vape_checkpoints WHERE name=$1;`
+
+const setCheckpointQuery = `INSERT INTO vape_checkpoints (name, last_key) VALUES ($1, $2)
+ON CONFLICT (name) DO UPDATE SET last_key=$2, updated_on=(now() AT TIME ZONE 'utc');`
+
+const deleteCheckpointQuery = `DELETE FROM vape_checkpoints WHERE name=$1;`
+
+const (
+	// DialectPostgres is the name of the Postgres dialect and its key in the sql section of unit files
+	DialectPostgres = "postgres"
+	// DialectSQLite is the name of the SQLite dialect and its key in the sql section of unit files
+	DialectSQLite = "sqlite"
+	// DialectMySQL is the name of the MySQL dialect and its key in the sql section of unit files
+	DialectMySQL = "mysql"
+)
+
+// Dialect is implemented by all databases the mig toolkit can migrate
+type Dialect interface {
+	// Name returns the key of the dialect in the sql section of unit files
+	Name() string
+	// CheckAndLoadTables will determine if the database is reachable and create the migration table
+	CheckAndLoadTables() error
+	// HasMigrationTable checks if the migration table exists without creating it
+	HasMigrationTable() (bool, error)
+	// HasHistoryTable checks if the history table exists without creating it
+	HasHistoryTable() (bool, error)
+	// MarkExecuted puts a unit into the migration table unless it's always executed or a target
+	MarkExecuted(unit Unit) error
+	// SetChecksum records the checksum of an executed unit that has no checksum yet
+	SetChecksum(unit Unit) error
+	// GetExecutedUnits returns a list of executed units present in the migration table
+	GetExecutedUnits() ([]string, error)
+	// GetExecutedUnitInfo returns all units present in the migration table, ordered by execution time
+	GetExecutedUnitInfo() ([]ExecutedUnit, error)
+	// RollbackUnits reverts the given units in the given order without taking the migration lock, Runner.Rollback
+	// holds it while it determines and reverts the units
+	RollbackUnits(units ...Unit) error
+	// RecordAttempts puts the attempts into the history table and sets their IDs
+	RecordAttempts(attempts []Attempt) error
+	// MarkAttemptsRolledBack sets the result of the attempts with the given IDs to AttemptRolledBack
+	MarkAttemptsRolledBack(ids []int64) error
+	// GetHistory returns the attempts of the history table selected by the filter, newest first
+	GetHistory(filter HistoryFilter) ([]Attempt, error)
+	// WriteScript writes a SQL script that performs the given plan
+	WriteScript(w io.Writer, plan [][]Unit) error
+	// SupportsParallel indicates if units committed one at a time may be executed concurrently on connections of
+	// their own
+	SupportsParallel() bool
+	// TransactionalDDL indicates if schema changes can be rolled back. If not, units are committed one at a time.
+	TransactionalDDL() bool
+
+	begin(ctx context.Context) (*sql.Tx, error)
+	lock(ctx context.Context, ex Tx) error
+	executeUnit(ctx context.Context, ex Tx, unit Unit) error
+	getExecutedUnits(ctx context.Context, ex Tx) ([]string, error)
+	createTables(ctx context.Context, ex Tx) error
+	getExecutedUnitInfo(ctx context.Context, ex Tx) ([]ExecutedUnit, error)
+	setChecksum(ctx context.Context, ex Tx, unit Unit) error
+	rollbackUnit(ctx context.Context, ex Tx, unit Unit) error
+}
+
+// InvalidIndexFinder is implemented by dialects whose non-transactional units can leave invalid indexes behind
+type InvalidIndexFinder interface {
+	// GetInvalidIndexes returns the names of all invalid indexes
+	GetInvalidIndexes() ([]string, error)
+}
+
+// ExecutedUnit is a unit as recorded in the migration table
+type ExecutedUnit struct {
+	Name       string
+	Type       UnitType
+	ExecutedOn time.Time
+	// Checksum is the checksum of the unit SQL when it was executed, it is empty for units recorded before
+	// checksums were introduced
+	Checksum string
+}
 
 // PostgresDialect implements a Postgres compatible interface to perform database migration using the mig toolkit
 type PostgresDialect struct {
 	db minimalDB
+	// tenant is set if the migration lock is held per schema instead of per database
+	tenant bool
 }
 
 type minimalDB interface {
 	Ping() error
 	Begin() (*sql.Tx, error)
+	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	Conn(context.Context) (*sql.Conn, error)
 	Exec(string, ...interface{}) (sql.Result, error)
 	Query(string, ...interface{}) (*sql.Rows, error)
 }
@@ -46,49 +225,553 @@ func OpenFromPGConn(db *sql.DB) *PostgresDialect {
 	}
 }
 
+// OpenTenantFromPGConn wraps a database connection whose search_path selects the schema of a tenant. The
+// migration table is created in that schema and the migration lock only covers it, so several tenants of a
+// database can be migrated at the same time.
+func OpenTenantFromPGConn(db *sql.DB) *PostgresDialect {
+	return &PostgresDialect{
+		db:     minimalDB(db),
+		tenant: true,
+	}
+}
+
+// Name returns "postgres"
+func (d *PostgresDialect) Name() string {
+	return DialectPostgres
+}
+
 // CheckAndLoadTables will determine if the database is reachable and create the migration table
 func (d *PostgresDialect) CheckAndLoadTables() error {
-	err := d.db.Ping()
+	return createMigrationTable(d.db, pgMigTable, pgHistoryTable)
+}
+
+// HasMigrationTable checks if the migration table exists without creating it
+func (d *PostgresDialect) HasMigrationTable() (bool, error) {
+	return queryExists(d.db, hasMigrationTableQuery)
+}
+
+// HasHistoryTable checks if the history table exists without creating it
+func (d *PostgresDialect) HasHistoryTable() (bool, error) {
+	return queryExists(d.db, hasHistoryTableQuery)
+}
+
+// MarkExecuted will put a unit into the migration table unless it's marked as "always_exec: true" or a target unit
+func (d *PostgresDialect) MarkExecuted(unit Unit) error {
+	if unit.Type == UnitTypeVirtualTarget {
+		return nil
+	}
+	if unit.AlwaysExec {
+		return nil
+	}
+	_, err := d.db.Exec(markExecutedQuery, unit.Name, string(unit.Type), unit.Checksum(DialectPostgres))
+	return err
+}
+
+// SupportsParallel returns true, non-transactional units may be executed concurrently
+func (d *PostgresDialect) SupportsParallel() bool {
+	return true
+}
+
+// TransactionalDDL returns true, all units of a migration are executed in a single transaction
+func (d *PostgresDialect) TransactionalDDL() bool {
+	return true
+}
+
+func (d *PostgresDialect) begin(ctx context.Context) (*sql.Tx, error) {
+	return d.db.BeginTx(ctx, nil)
+}
+
+// lock acquires the migration lock, it is released when the transaction ends
+func (d *PostgresDialect) lock(ctx context.Context, tx Tx) error {
+	query := lockQuery
+	if d.tenant {
+		query = tenantLockQuery
+	}
+	_, err := tx.ExecContext(ctx, query, migLockKey)
+	return err
+}
+
+// conn reserves a connection for non-transactional units
+func (d *PostgresDialect) conn(ctx context.Context) (*sql.Conn, error) {
+	return d.db.Conn(ctx)
+}
+
+// lockSession acquires the migration lock for the session of the connection, it is held until unlock is called
+func (d *PostgresDialect) lockSession(ctx context.Context, conn Tx) error {
+	query := lockSessionQuery
+	if d.tenant {
+		query = tenantLockSessionQuery
+	}
+	_, err := conn.ExecContext(ctx, query, migLockKey)
+	return err
+}
+
+// tryLock acquires the migration lock of the transaction or session if it is free
+func (d *PostgresDialect) tryLock(ctx context.Context, ex Tx, session bool) (bool, error) {
+	var query string
+	switch {
+	case d.tenant && session:
+		query = tenantTryLockSessionQuery
+	case d.tenant:
+		query = tenantTryLockQuery
+	case session:
+		query = tryLockSessionQuery
+	default:
+		query = tryLockQuery
+	}
+	var locked bool
+	err := ex.QueryRowContext(ctx, query, migLockKey).Scan(&locked)
+	return locked, err
+}
+
+// unlock releases the migration lock of the session
+func (d *PostgresDialect) unlock(ctx context.Context, conn Tx) error {
+	query := unlockSessionQuery
+	if d.tenant {
+		query = tenantUnlockSessionQuery
+	}
+	_, err := conn.ExecContext(ctx, query, migLockKey)
+	return err
+}
+
+// executeUnit runs the unit SQL and records the unit in the migration table as part of the transaction
+func (d *PostgresDialect) executeUnit(ctx context.Context, tx Tx, unit Unit) error {
+	if unit.Type == UnitTypeSeed {
+		// A seed unit executed again replaces its record
+		_, err := tx.ExecContext(ctx, unmarkExecutedQuery, unit.Name)
+		if err != nil {
+			return fmt.Errorf("Could not remove previous record of seed unit: %s", err)
+		}
+	}
+	return executeUnit(ctx, tx, DialectPostgres, markExecutedQuery, unit)
+}
+
+// batchQueries returns the queries executing batch units
+func (d *PostgresDialect) batchQueries() batchQueries {
+	return batchQueries{
+		nextKey:          nextBatchKeyQuery,
+		getCheckpoint:    getCheckpointQuery,
+		setCheckpoint:    setCheckpointQuery,
+		deleteCheckpoint: deleteCheckpointQuery,
+		markExecuted:     markExecutedQuery,
+	}
+}
+
+// getExecutedUnits returns the executed units as seen by the transaction
+func (d *PostgresDialect) getExecutedUnits(ctx context.Context, tx Tx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, getExecutedQuery, string(UnitTypeVirtualTarget))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	tx, err := d.db.Begin()
+	defer rows.Close()
+	return scanUnitNames(rows)
+}
+
+// createTables creates the migration tables as part of the transaction
+func (d *PostgresDialect) createTables(ctx context.Context, tx Tx) error {
+	return createTables(ctx, tx, pgMigTable, pgHistoryTable)
+}
+
+// getExecutedUnitInfo returns the units of the migration table as seen by the transaction
+func (d *PostgresDialect) getExecutedUnitInfo(ctx context.Context, tx Tx) ([]ExecutedUnit, error) {
+	return getExecutedUnitInfo(ctx, tx, getExecutedInfoQuery)
+}
+
+// setChecksum records the checksum of an executed unit without one as part of the transaction
+func (d *PostgresDialect) setChecksum(ctx context.Context, tx Tx, unit Unit) error {
+	_, err := tx.ExecContext(ctx, setChecksumQuery, unit.Name, unit.Checksum(DialectPostgres))
+	return err
+}
+
+// rollbackUnit reverts the unit and removes it from the migration table as part of the transaction
+func (d *PostgresDialect) rollbackUnit(ctx context.Context, tx Tx, unit Unit) error {
+	return rollbackUnit(ctx, tx, DialectPostgres, unmarkExecutedQuery, unit)
+}
+
+// SetChecksum records the current checksum of an executed unit if the migration table has no checksum for it yet.
+// Existing checksums are never overwritten.
+func (d *PostgresDialect) SetChecksum(unit Unit) error {
+	_, err := d.db.Exec(setChecksumQuery, unit.Name, unit.Checksum(DialectPostgres))
+	return err
+}
+
+// RollbackUnits executes the down section of the given units in the given order and removes them from the
+// migration table. All units are reverted in a single transaction, if any unit fails nothing is reverted.
+// Non-transactional units are reverted on their own, units reverted before them stay reverted.
+func (d *PostgresDialect) RollbackUnits(units ...Unit) error {
+	return rollbackUnits(d.db, DialectPostgres, unmarkExecutedQuery, units)
+}
+
+// GetExecutedUnits returns a list of executed units present in the migration table
+func (d *PostgresDialect) GetExecutedUnits() ([]string, error) {
+	rows, err := d.db.Query(getExecutedQuery, string(UnitTypeVirtualTarget))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUnitNames(rows)
+}
+
+// GetExecutedUnitInfo returns all units present in the migration table, ordered by the time they were executed
+func (d *PostgresDialect) GetExecutedUnitInfo() ([]ExecutedUnit, error) {
+	rows, err := d.db.Query(getExecutedInfoQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanExecutedUnits(rows)
+}
+
+// RecordAttempts puts the attempts into the history table in a single transaction and sets their IDs
+func (d *PostgresDialect) RecordAttempts(attempts []Attempt) error {
+	return recordAttempts(d.db, recordAttemptQuery, true, attempts)
+}
+
+// MarkAttemptsRolledBack sets the result of the attempts with the given IDs to AttemptRolledBack
+func (d *PostgresDialect) MarkAttemptsRolledBack(ids []int64) error {
+	return setAttemptResult(d.db, setAttemptResultQuery, ids, AttemptRolledBack)
+}
+
+// GetHistory returns the attempts of the history table selected by the filter, newest first
+func (d *PostgresDialect) GetHistory(filter HistoryFilter) ([]Attempt, error) {
+	return getHistory(d.db, filter, pgPlaceholder)
+}
+
+// WriteScript writes a SQL script that performs the given plan in a single transaction, including the creation
+// of the migration table and the bookkeeping of every unit. The script is meant to be reviewed and applied by hand.
+func (d *PostgresDialect) WriteScript(w io.Writer, plan [][]Unit) error {
+	return writeScript(w, DialectPostgres, strings.TrimSuffix(pgMigTable, "--"), plan, true)
+}
+
+// GetInvalidIndexes returns the names of all invalid indexes in the current schema. A failed
+// CREATE INDEX CONCURRENTLY leaves an invalid index behind, which has to be dropped before the unit can be
+// executed again.
+func (d *PostgresDialect) GetInvalidIndexes() ([]string, error) {
+	rows, err := d.db.Query(getInvalidIndexesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUnitNames(rows)
+}
+
+// setLockTimeout sets lock_timeout with SET LOCAL inside a transaction and for the session otherwise
+func (d *PostgresDialect) setLockTimeout(ctx context.Context, ex Tx, timeout time.Duration, inTx bool) error {
+	var scope = ""
+	if inTx {
+		scope = "LOCAL "
+	}
+	var value = "DEFAULT"
+	if timeout > 0 {
+		value = fmt.Sprintf("%d", durationMillis(timeout))
+	}
+	_, err := ex.ExecContext(ctx, "SET "+scope+"lock_timeout TO "+value+";")
+	return err
+}
+
+// isRetryable returns true for serialization failures, deadlocks and lock timeouts
+func (d *PostgresDialect) isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", "40P01", "55P03":
+		return true
+	}
+	return false
+}
+
+// Schemas returns the schemas of the database whose names match the pattern, see path.Match. The schemas of the
+// system are never returned.
+func (d *PostgresDialect) Schemas(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid schema pattern %q: %s", pattern, err)
+	}
+	rows, err := queryStrings(d.db, listSchemasQuery)
+	if err != nil {
+		return nil, err
+	}
+	var schemas = []string{}
+	for _, row := range rows {
+		if ok, _ := path.Match(pattern, row[0]); ok {
+			schemas = append(schemas, row[0])
+		}
+	}
+	return schemas, nil
+}
+
+// CreateSchema creates the schema unless it exists
+func (d *PostgresDialect) CreateSchema(name string) error {
+	_, err := d.db.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(name) + ";")
+	return err
+}
+
+var _ Dialect = (*PostgresDialect)(nil)
+var _ sessionDialect = (*PostgresDialect)(nil)
+var _ lockTimeoutDialect = (*PostgresDialect)(nil)
+var _ tryLockDialect = (*PostgresDialect)(nil)
+var _ retryDialect = (*PostgresDialect)(nil)
+var _ batchDialect = (*PostgresDialect)(nil)
+var _ InvalidIndexFinder = (*PostgresDialect)(nil)
+
+// createMigrationTable pings the database and runs the queries creating the migration tables in a transaction
+func createMigrationTable(db minimalDB, queries ...string) error {
+	err := db.Ping()
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec(pgMigTable)
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	for _, query := range queries {
+		_, err = tx.Exec(query)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	return tx.Commit()
 }
 
-// MarkExecuted will put a unit into the migration table unless it's marked as "always_exec: true" or a target unit
-func (d *PostgresDialect) MarkExecuted(unit Unit) error {
+// createTables runs the queries creating the migration tables on ex
+func createTables(ctx context.Context, ex Tx, queries ...string) error {
+	for _, query := range queries {
+		_, err := ex.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getExecutedUnitInfo runs the query loading the migration table on ex
+func getExecutedUnitInfo(ctx context.Context, ex Tx, query string) ([]ExecutedUnit, error) {
+	rows, err := ex.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanExecutedUnits(rows)
+}
+
+// queryExists runs a query that returns a single count and checks if the count is larger than zero
+func queryExists(db minimalDB, query string) (bool, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var count int
+	for rows.Next() {
+		err = rows.Scan(&count)
+		if err != nil {
+			return false, err
+		}
+	}
+	return count > 0, rows.Err()
+}
+
+// executeUnit runs the SQL of the unit for the dialect and records it with the given query, which receives
+// the name, type and checksum of the unit.
+func executeUnit(ctx context.Context, ex Tx, dialect, markQuery string, unit Unit) error {
 	if unit.Type == UnitTypeVirtualTarget {
 		return nil
 	}
+	err := runUnit(ctx, ex, dialect, unit)
+	if err != nil {
+		return err
+	}
 	if unit.AlwaysExec {
 		return nil
 	}
-	_, err := d.db.Exec(markExecutedQuery, unit.Name, string(unit.Type))
-	return err
+	_, err = ex.ExecContext(ctx, markQuery, unit.Name, string(unit.Type), unit.Checksum(dialect))
+	if err != nil {
+		return fmt.Errorf("Could not mark unit as executed: %s", err)
+	}
+	return nil
 }
 
-// GetExecutedUnits returns a list of executed units present in the migration table
-func (d *PostgresDialect) GetExecutedUnits() ([]string, error) {
-	rows, err := d.db.Query(getExecutedQuery, string(UnitTypeMigration))
+// rollbackUnits runs the down section of the units for the dialect and removes them with the given query,
+// which receives the name of the unit. The units are reverted in a single transaction, non-transactional units
+// are reverted on their own after the transaction of the units before them has been committed.
+func rollbackUnits(db minimalDB, dialect, unmarkQuery string, units []Unit) error {
+	for _, unit := range units {
+		if !unit.IsReversible(dialect) {
+			return fmt.Errorf("Unit %s has no down section and cannot be rolled back", unit.Name)
+		}
+	}
+	ctx := context.Background()
+	var batch = []Unit{}
+	for _, unit := range units {
+		if !unit.IsNonTransactional() {
+			batch = append(batch, unit)
+			continue
+		}
+		err := rollbackBatch(ctx, db, dialect, unmarkQuery, batch)
+		if err != nil {
+			return err
+		}
+		batch = []Unit{}
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		err = rollbackUnit(ctx, conn, dialect, unmarkQuery, unit)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return rollbackBatch(ctx, db, dialect, unmarkQuery, batch)
+}
+
+// rollbackBatch reverts the units in a single transaction
+func rollbackBatch(ctx context.Context, db minimalDB, dialect, unmarkQuery string, units []Unit) error {
+	if len(units) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, unit := range units {
+		err = rollbackUnit(ctx, tx, dialect, unmarkQuery, unit)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rollbackUnit reverts a single unit and removes it from the migration table along with the units it squashes
+func rollbackUnit(ctx context.Context, ex Tx, dialect, unmarkQuery string, unit Unit) error {
+	if unit.Type == UnitTypeVirtualTarget {
+		return nil
 	}
+	err := revertUnit(ctx, ex, dialect, unit)
+	if err != nil {
+		return fmt.Errorf("Unit %s could not be rolled back: %s", unit.Name, err)
+	}
+	for _, name := range append([]string{unit.Name}, unit.Squashes...) {
+		_, err = ex.ExecContext(ctx, unmarkQuery, name)
+		if err != nil {
+			return fmt.Errorf("Unit %s could not be removed from the migration table: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func scanUnitNames(rows *sql.Rows) ([]string, error) {
 	var units = []string{}
 	for rows.Next() {
 		var unit string
-		err = rows.Scan(&unit)
+		err := rows.Scan(&unit)
+		if err != nil {
+			return nil, err
+		}
+		units = append(units, unit)
+	}
+	return units, rows.Err()
+}
+
+func scanExecutedUnits(rows *sql.Rows) ([]ExecutedUnit, error) {
+	var units = []ExecutedUnit{}
+	for rows.Next() {
+		var unit ExecutedUnit
+		var checksum sql.NullString
+		err := rows.Scan(&unit.Name, &unit.Type, &unit.ExecutedOn, &checksum)
 		if err != nil {
 			return nil, err
 		}
+		unit.Checksum = checksum.String
 		units = append(units, unit)
 	}
-	return units, nil
+	return units, rows.Err()
+}
+
+// writeScript writes the plan as a script for the dialect, migTable is the query creating the migration table.
+// If transactional is true, the script is wrapped in a transaction which is interrupted by non-transactional units.
+// Units whose squashed units have been executed are only recorded. Units with a run_if query are refused, a script
+// applied by hand would execute them regardless of the query.
+func writeScript(w io.Writer, dialect, migTable string, plan [][]Unit, transactional bool) error {
+	var conditional = []string{}
+	for _, round := range plan {
+		for _, unit := range round {
+			if !unit.satisfied && unit.Type != UnitTypeSeed && unit.RunIf.Get(dialect) != "" {
+				conditional = append(conditional, unit.Name)
+			}
+		}
+	}
+	if len(conditional) > 0 {
+		return fmt.Errorf("Units %v have a run_if query and cannot be written to a SQL script", conditional)
+	}
+
+	var err error
+	write := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	record := func(unit Unit) {
+		write("INSERT INTO vape_migrations (name, type, hash) VALUES (%s, %s, %s);\n",
+			quoteLiteral(unit.Name), quoteLiteral(string(unit.Type)), quoteLiteral(unit.Checksum(dialect)))
+	}
+	if transactional {
+		write("BEGIN;\n\n")
+	}
+	write("%s\n", migTable)
+	for i, round := range plan {
+		write("\n-- Round %d\n", i+1)
+		for _, unit := range round {
+			if unit.Type == UnitTypeVirtualTarget {
+				continue
+			}
+			if unit.satisfied {
+				write("\n-- Unit: %s\n-- The units squashed into this unit have been executed, it is only recorded\n",
+					unit.Name)
+				record(unit)
+				continue
+			}
+			if unit.Type == UnitTypeCode {
+				return fmt.Errorf("Unit %s runs Go code and cannot be written to a SQL script", unit.Name)
+			}
+			if unit.Type == UnitTypeBatch {
+				return fmt.Errorf("Unit %s runs in batches and cannot be written to a SQL script", unit.Name)
+			}
+			if unit.Type == UnitTypeSeed {
+				write("\n-- Unit: %s\n-- Seed units are left out of scripts, vape seeds their rows on the next migration\n",
+					unit.Name)
+				continue
+			}
+			nonTransactional := transactional && unit.IsNonTransactional()
+			write("\n-- Unit: %s\n", unit.Name)
+			if unit.Description != "" {
+				write("-- %s\n", unit.Description)
+			}
+			if nonTransactional {
+				write("COMMIT;\n")
+			}
+			if query := unit.SQL.Get(dialect); query != "" {
+				write("%s\n", strings.TrimSpace(query))
+			}
+			if !unit.AlwaysExec {
+				record(unit)
+			}
+			if nonTransactional {
+				write("BEGIN;\n")
+			}
+		}
+	}
+	if transactional {
+		write("\nCOMMIT;\n")
+	}
+	return err
+}
+
+// quoteLiteral quotes a string as a SQL string literal
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
 }
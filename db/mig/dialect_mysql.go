@@ -0,0 +1,379 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const mysqlMigTable = `CREATE TABLE IF NOT EXISTS vape_migrations (
+	name    varchar(255)    NOT NULL,
+	type    varchar(255)    NOT NULL,
+	executed_on datetime    NOT NULL    DEFAULT CURRENT_TIMESTAMP,
+	hash    varchar(64),
+
+	PRIMARY KEY(name),
+	INDEX vape_type_index (type)
+);
+
+CREATE TABLE IF NOT EXISTS vape_checkpoints (
+	name    varchar(255)    NOT NULL,
+	last_key    bigint      NOT NULL,
+	updated_on datetime     NOT NULL    DEFAULT CURRENT_TIMESTAMP,
+
+	PRIMARY KEY(name)
+);`
+
+// mysqlHistoryTable creates the history table, which keeps one row per attempt to execute a unit
+const mysqlHistoryTable = `CREATE TABLE IF NOT EXISTS vape_history (
+	id      bigint          NOT NULL    AUTO_INCREMENT,
+	name    varchar(255)    NOT NULL,
+	target  varchar(255)    NOT NULL,
+	attempt int             NOT NULL,
+	result  varchar(32)     NOT NULL,
+	error   text            NOT NULL,
+	started_on datetime(3)  NOT NULL,
+	duration_ms bigint      NOT NULL,
+	hostname varchar(255)   NOT NULL,
+	operator varchar(255)   NOT NULL,
+	version varchar(255)    NOT NULL,
+
+	PRIMARY KEY(id),
+	INDEX vape_history_name_index (name)
+);`
+
+// mysqlLockName is the name of the session lock held while migrating
+const mysqlLockName = "vape_migrations"
+
+// mysqlLockQuery waits for the named lock without a timeout, it returns 1 once the lock is held
+const mysqlLockQuery = `SELECT GET_LOCK(?, -1);`
+
+// mysqlTryLockQuery returns 1 if the lock is free and 0 if another session holds it
+const mysqlTryLockQuery = `SELECT GET_LOCK(?, 0);`
+
+const mysqlUnlockQuery = `DO RELEASE_LOCK(?);`
+
+const mysqlMarkExecutedQuery = `INSERT INTO vape_migrations (name, type, hash) VALUES (?, ?, ?);`
+
+const mysqlSetChecksumQuery = `UPDATE vape_migrations SET hash=? WHERE name=? AND hash IS NULL;`
+
+const mysqlUnmarkExecutedQuery = `DELETE FROM vape_migrations WHERE name=?;`
+
+const mysqlGetExecutedQuery = `SELECT name FROM vape_migrations WHERE type<>?;`
+
+const mysqlHasMigrationTableQuery = `SELECT count(*) FROM information_schema.tables
+WHERE table_schema = DATABASE() AND table_name = 'vape_migrations';`
+
+const mysqlHasHistoryTableQuery = `SELECT count(*) FROM information_schema.tables
+WHERE table_schema = DATABASE() AND table_name = 'vape_history';`
+
+const mysqlGetExecutedInfoQuery = `SELECT name, type, executed_on, hash FROM vape_migrations ORDER BY executed_on, name;`
+
+const mysqlRecordAttemptQuery = `INSERT INTO vape_history
+(name, target, attempt, result, error, started_on, duration_ms, hostname, operator, version)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+const mysqlSetAttemptResultQuery = `UPDATE vape_history SET result=? WHERE id=?;`
+
+const mysqlNextBatchKeyQuery = `SELECT max(%[2]s) FROM (SELECT %[2]s FROM %[1]s WHERE %[2]s > ? ORDER BY %[2]s LIMIT ?) AS batch;`
+
+const mysqlGetCheckpointQuery = `SELECT last_key FROM vape_checkpoints WHERE name=?;`
+
+// mysqlSetCheckpointQuery replaces the row of the unit, which also resets updated_on to its default
+const mysqlSetCheckpointQuery = `REPLACE INTO vape_checkpoints (name, last_key) VALUES (?, ?);`
+
+const mysqlDeleteCheckpointQuery = `DELETE FROM vape_checkpoints WHERE name=?;`
+
+// MySQLDialect implements the migration interface for MySQL and MariaDB databases. It uses the "mysql" key of the
+// sql section of unit files.
+//
+// MySQL commits every DDL statement implicitly, so a failed migration cannot be rolled back. Units are executed
+// one at a time on a single connection that holds a session lock, each unit is recorded in the migration table
+// as soon as it completes. If a unit fails, the units before it stay applied and a later migration resumes
+// with the failed unit, see PartialMigrationError.
+//
+// The database driver is not imported by this package. The connection must allow multiple statements per query
+// and parse time values, for github.com/go-sql-driver/mysql this means multiStatements=true and parseTime=true.
+type MySQLDialect struct {
+	db minimalDB
+}
+
+// OpenFromMySQLConn accepts an opened MySQL database connection and wraps it into the MySQLDialect
+func OpenFromMySQLConn(db *sql.DB) *MySQLDialect {
+	return &MySQLDialect{
+		db: minimalDB(db),
+	}
+}
+
+// Name returns "mysql"
+func (d *MySQLDialect) Name() string {
+	return DialectMySQL
+}
+
+// CheckAndLoadTables will determine if the database is reachable and create the migration table
+func (d *MySQLDialect) CheckAndLoadTables() error {
+	err := d.db.Ping()
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(mysqlMigTable)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(mysqlHistoryTable)
+	return err
+}
+
+// HasMigrationTable checks if the migration table exists without creating it
+func (d *MySQLDialect) HasMigrationTable() (bool, error) {
+	return queryExists(d.db, mysqlHasMigrationTableQuery)
+}
+
+// HasHistoryTable checks if the history table exists without creating it
+func (d *MySQLDialect) HasHistoryTable() (bool, error) {
+	return queryExists(d.db, mysqlHasHistoryTableQuery)
+}
+
+// MarkExecuted will put a unit into the migration table unless it's marked as "always_exec: true" or a target unit
+func (d *MySQLDialect) MarkExecuted(unit Unit) error {
+	if unit.Type == UnitTypeVirtualTarget || unit.AlwaysExec {
+		return nil
+	}
+	_, err := d.db.Exec(mysqlMarkExecutedQuery, unit.Name, string(unit.Type), unit.Checksum(DialectMySQL))
+	return err
+}
+
+// SetChecksum records the current checksum of an executed unit if the migration table has no checksum for it yet.
+func (d *MySQLDialect) SetChecksum(unit Unit) error {
+	_, err := d.db.Exec(mysqlSetChecksumQuery, unit.Checksum(DialectMySQL), unit.Name)
+	return err
+}
+
+// GetExecutedUnits returns a list of executed units present in the migration table
+func (d *MySQLDialect) GetExecutedUnits() ([]string, error) {
+	rows, err := d.db.Query(mysqlGetExecutedQuery, string(UnitTypeVirtualTarget))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUnitNames(rows)
+}
+
+// GetExecutedUnitInfo returns all units present in the migration table, ordered by the time they were executed
+func (d *MySQLDialect) GetExecutedUnitInfo() ([]ExecutedUnit, error) {
+	rows, err := d.db.Query(mysqlGetExecutedInfoQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanExecutedUnits(rows)
+}
+
+// RollbackUnits executes the down section of the given units in the given order and removes them from the
+// migration table. Every unit is committed on its own, if a unit fails the units before it stay rolled back and
+// the error names them.
+func (d *MySQLDialect) RollbackUnits(units ...Unit) error {
+	for _, unit := range units {
+		if !unit.IsReversible(DialectMySQL) {
+			return fmt.Errorf("Unit %s has no down section and cannot be rolled back", unit.Name)
+		}
+	}
+	ctx := context.Background()
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return rollbackUnitsOn(ctx, conn, units)
+}
+
+// rollbackUnitsOn reverts the units one at a time on the given connection
+func rollbackUnitsOn(ctx context.Context, conn Tx, units []Unit) error {
+	var done = []string{}
+	for _, unit := range units {
+		if unit.Type == UnitTypeVirtualTarget {
+			continue
+		}
+		err := revertUnit(ctx, conn, DialectMySQL, unit)
+		if err != nil {
+			return fmt.Errorf("Unit %s could not be rolled back, units %v have been rolled back before: %s",
+				unit.Name, done, err)
+		}
+		_, err = conn.ExecContext(ctx, mysqlUnmarkExecutedQuery, unit.Name)
+		if err != nil {
+			return fmt.Errorf("Unit %s was rolled back but could not be removed from the migration table: %s",
+				unit.Name, err)
+		}
+		done = append(done, unit.Name)
+	}
+	return nil
+}
+
+// RecordAttempts puts the attempts into the history table in a single transaction and sets their IDs
+func (d *MySQLDialect) RecordAttempts(attempts []Attempt) error {
+	return recordAttempts(d.db, mysqlRecordAttemptQuery, false, attempts)
+}
+
+// MarkAttemptsRolledBack sets the result of the attempts with the given IDs to AttemptRolledBack
+func (d *MySQLDialect) MarkAttemptsRolledBack(ids []int64) error {
+	return setAttemptResult(d.db, mysqlSetAttemptResultQuery, ids, AttemptRolledBack)
+}
+
+// GetHistory returns the attempts of the history table selected by the filter, newest first
+func (d *MySQLDialect) GetHistory(filter HistoryFilter) ([]Attempt, error) {
+	return getHistory(d.db, filter, questionPlaceholder)
+}
+
+// WriteScript writes a SQL script that performs the given plan, including the creation of the migration table
+// and the bookkeeping of every unit. Since MySQL cannot roll back DDL, the script is not wrapped in a transaction.
+func (d *MySQLDialect) WriteScript(w io.Writer, plan [][]Unit) error {
+	return writeScript(w, DialectMySQL, mysqlMigTable, plan, false)
+}
+
+// SupportsParallel returns true, every unit is committed on its own and may be executed concurrently
+func (d *MySQLDialect) SupportsParallel() bool {
+	return true
+}
+
+// TransactionalDDL returns false, MySQL commits every DDL statement implicitly
+func (d *MySQLDialect) TransactionalDDL() bool {
+	return false
+}
+
+// begin fails since migrations on MySQL do not run in a transaction, the runner uses conn instead
+func (d *MySQLDialect) begin(ctx context.Context) (*sql.Tx, error) {
+	return nil, errors.New("MySQL migrations cannot run in a transaction")
+}
+
+// conn reserves the connection that all units of a migration are executed on
+func (d *MySQLDialect) conn(ctx context.Context) (*sql.Conn, error) {
+	return d.db.Conn(ctx)
+}
+
+// lock acquires the migration lock for the session of the connection, it is held until unlock is called or the
+// connection is closed
+func (d *MySQLDialect) lock(ctx context.Context, conn Tx) error {
+	locked, err := getLock(ctx, conn, mysqlLockQuery)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errors.New("GET_LOCK did not return the lock")
+	}
+	return nil
+}
+
+// tryLock acquires the migration lock for the session of the connection if it is free, MySQL has no transaction
+// locks
+func (d *MySQLDialect) tryLock(ctx context.Context, conn Tx, session bool) (bool, error) {
+	return getLock(ctx, conn, mysqlTryLockQuery)
+}
+
+// getLock runs a GET_LOCK query for the migration lock and returns true if it returned the lock
+func getLock(ctx context.Context, conn Tx, query string) (bool, error) {
+	rows, err := conn.QueryContext(ctx, query, mysqlLockName)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var locked sql.NullInt64
+	for rows.Next() {
+		err = rows.Scan(&locked)
+		if err != nil {
+			return false, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	return locked.Int64 == 1, nil
+}
+
+// lockSession acquires the migration lock for the session of the connection, see lock
+func (d *MySQLDialect) lockSession(ctx context.Context, conn Tx) error {
+	return d.lock(ctx, conn)
+}
+
+// unlock releases the migration lock of the session
+func (d *MySQLDialect) unlock(ctx context.Context, conn Tx) error {
+	_, err := conn.ExecContext(ctx, mysqlUnlockQuery, mysqlLockName)
+	return err
+}
+
+// executeUnit runs the unit SQL and records the unit in the migration table. Both statements are committed
+// immediately.
+func (d *MySQLDialect) executeUnit(ctx context.Context, conn Tx, unit Unit) error {
+	return executeUnit(ctx, conn, DialectMySQL, mysqlMarkExecutedQuery, unit)
+}
+
+// batchQueries returns the queries executing batch units
+func (d *MySQLDialect) batchQueries() batchQueries {
+	return batchQueries{
+		nextKey:          mysqlNextBatchKeyQuery,
+		getCheckpoint:    mysqlGetCheckpointQuery,
+		setCheckpoint:    mysqlSetCheckpointQuery,
+		deleteCheckpoint: mysqlDeleteCheckpointQuery,
+		markExecuted:     mysqlMarkExecutedQuery,
+	}
+}
+
+// getExecutedUnits returns the executed units as seen by the connection
+func (d *MySQLDialect) getExecutedUnits(ctx context.Context, conn Tx) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, mysqlGetExecutedQuery, string(UnitTypeVirtualTarget))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUnitNames(rows)
+}
+
+// createTables creates the migration tables on the connection
+func (d *MySQLDialect) createTables(ctx context.Context, conn Tx) error {
+	return createTables(ctx, conn, mysqlMigTable, mysqlHistoryTable)
+}
+
+// getExecutedUnitInfo returns the units of the migration table as seen by the connection
+func (d *MySQLDialect) getExecutedUnitInfo(ctx context.Context, conn Tx) ([]ExecutedUnit, error) {
+	return getExecutedUnitInfo(ctx, conn, mysqlGetExecutedInfoQuery)
+}
+
+// setChecksum records the checksum of an executed unit without one on the connection
+func (d *MySQLDialect) setChecksum(ctx context.Context, conn Tx, unit Unit) error {
+	_, err := conn.ExecContext(ctx, mysqlSetChecksumQuery, unit.Checksum(DialectMySQL), unit.Name)
+	return err
+}
+
+// rollbackUnit reverts the unit and removes it from the migration table on the connection
+func (d *MySQLDialect) rollbackUnit(ctx context.Context, conn Tx, unit Unit) error {
+	return rollbackUnit(ctx, conn, DialectMySQL, mysqlUnmarkExecutedQuery, unit)
+}
+
+// setLockTimeout sets lock_wait_timeout and innodb_lock_wait_timeout for the session. MySQL counts them in whole
+// seconds, the timeout is rounded up.
+func (d *MySQLDialect) setLockTimeout(ctx context.Context, conn Tx, timeout time.Duration, inTx bool) error {
+	var value = "DEFAULT"
+	if timeout > 0 {
+		value = fmt.Sprintf("%d", (durationMillis(timeout)+999)/1000)
+	}
+	_, err := conn.ExecContext(ctx, "SET SESSION lock_wait_timeout = "+value+", innodb_lock_wait_timeout = "+
+		value+";")
+	return err
+}
+
+// isRetryable returns true for lock wait timeouts and deadlocks. The errors are recognised by their message
+// since the driver is only built with the mysql tag.
+func (d *MySQLDialect) isRetryable(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "Error 1205") || strings.Contains(message, "Error 1213")
+}
+
+var _ Dialect = (*MySQLDialect)(nil)
+var _ sessionDialect = (*MySQLDialect)(nil)
+var _ lockTimeoutDialect = (*MySQLDialect)(nil)
+var _ tryLockDialect = (*MySQLDialect)(nil)
+var _ retryDialect = (*MySQLDialect)(nil)
+var _ batchDialect = (*MySQLDialect)(nil)
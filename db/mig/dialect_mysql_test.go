@@ -0,0 +1,162 @@
+package mig
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestOpenFromMySQLConn(t *testing.T) {
+	dialect := OpenFromMySQLConn(nil)
+	require.NotNil(t, dialect)
+	require.Equal(t, DialectMySQL, dialect.Name())
+	require.True(t, dialect.SupportsParallel())
+	require.False(t, dialect.TransactionalDDL())
+
+	_, err := dialect.begin(context.Background())
+	require.Error(t, err)
+}
+
+func TestMySQLDialect_MarkExecuted(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &MySQLDialect{
+		db: mockDB,
+	}
+
+	unit := Unit{
+		Name: "test-unit",
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE pg ();", MySQL: "CREATE TABLE my ();"},
+	}
+
+	mockDB.On("Exec",
+		"INSERT INTO vape_migrations (name, type, hash) VALUES (?, ?, ?);",
+		[]interface{}{"test-unit", "migration", unit.Checksum(DialectMySQL)}).Return(nil, nil)
+	mockDB.On("Exec",
+		"UPDATE vape_migrations SET hash=? WHERE name=? AND hash IS NULL;",
+		[]interface{}{unit.Checksum(DialectMySQL), "test-unit"}).Return(nil, nil)
+
+	require.NoError(t, dialect.MarkExecuted(Unit{Name: "always", AlwaysExec: true}))
+	require.NoError(t, dialect.MarkExecuted(Unit{Name: "target", Type: UnitTypeVirtualTarget}))
+	require.NoError(t, dialect.MarkExecuted(unit))
+	require.NoError(t, dialect.SetChecksum(unit))
+
+	mockDB.AssertExpectations(t)
+	mockDB.AssertNumberOfCalls(t, "Exec", 2)
+}
+
+func TestMySQLDialect_CheckAndLoadTables(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &MySQLDialect{
+		db: mockDB,
+	}
+
+	mockDB.On("Ping").Return(nil)
+	mockDB.On("Exec", mysqlMigTable, []interface{}(nil)).Return(nil, nil)
+	mockDB.On("Exec", mysqlHistoryTable, []interface{}(nil)).Return(nil, nil)
+
+	require.NoError(t, dialect.CheckAndLoadTables())
+	mockDB.AssertExpectations(t)
+}
+
+func TestMySQLDialect_RollbackUnits(t *testing.T) {
+	assert := require.New(t)
+
+	mockDB := new(minimalDBMock)
+	dialect := &MySQLDialect{
+		db: mockDB,
+	}
+
+	unit1 := Unit{
+		Name: "unit1",
+		SQL:  SQLSection{MySQL: "CREATE TABLE unit1 ();"},
+		Down: SQLSection{MySQL: "DROP TABLE unit1;"},
+	}
+	unit2 := Unit{
+		Name: "unit2",
+		SQL:  SQLSection{MySQL: "CREATE TABLE unit2 ();"},
+		Down: SQLSection{MySQL: "DROP TABLE unit2;"},
+	}
+
+	assert.Error(dialect.RollbackUnits(Unit{Name: "irreversible", SQL: SQLSection{MySQL: "SELECT 1;"}}))
+
+	mockDB.On("Conn", mock.Anything).Return(nil, errors.New("Test error"))
+	assert.EqualError(dialect.RollbackUnits(unit2, unit1), "Test error")
+	mockDB.AssertExpectations(t)
+
+	conn := &txRecorder{fail: "DROP TABLE unit1;"}
+	err := rollbackUnitsOn(context.Background(), conn, []Unit{unit2, unit1})
+	assert.EqualError(err, "Unit unit1 could not be rolled back, units [unit2] have been rolled back before: Test error")
+	assert.EqualValues([]string{"DROP TABLE unit2;", "DELETE FROM vape_migrations WHERE name=?;", "DROP TABLE unit1;"},
+		conn.queries)
+}
+
+// txRecorder is a Tx that records the executed queries and fails on the given query
+type txRecorder struct {
+	fail    string
+	queries []string
+}
+
+func (tx *txRecorder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	tx.queries = append(tx.queries, query)
+	if query == tx.fail {
+		return nil, errors.New("Test error")
+	}
+	return nil, nil
+}
+
+func (tx *txRecorder) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (tx *txRecorder) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+func TestMySQLDialect_Queries(t *testing.T) {
+	assert := require.New(t)
+
+	mockDB := new(minimalDBMock)
+	dialect := &MySQLDialect{
+		db: mockDB,
+	}
+
+	mockDB.On("Query", mysqlHasMigrationTableQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+	mockDB.On("Query", mysqlHasHistoryTableQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+	mockDB.On("Query", mysqlGetExecutedQuery, []interface{}{"target"}).Return((*sql.Rows)(nil), errors.New("Test error"))
+	mockDB.On("Query", mysqlGetExecutedInfoQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+
+	_, err := dialect.HasMigrationTable()
+	assert.Error(err)
+	_, err = dialect.HasHistoryTable()
+	assert.Error(err)
+	_, err = dialect.GetExecutedUnits()
+	assert.Error(err)
+	_, err = dialect.GetExecutedUnitInfo()
+	assert.Error(err)
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestMySQLDialect_WriteScript(t *testing.T) {
+	assert := require.New(t)
+
+	unit := Unit{
+		Name: "test-unit",
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE pg ();", MySQL: "CREATE TABLE my ();"},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(OpenFromMySQLConn(nil).WriteScript(&buf, [][]Unit{{unit}}))
+	assert.Contains(buf.String(), "CREATE TABLE IF NOT EXISTS vape_migrations")
+	assert.Contains(buf.String(), "CREATE TABLE my ();")
+	assert.NotContains(buf.String(), "CREATE TABLE pg ();")
+	assert.NotContains(buf.String(), "BEGIN;")
+	assert.NotContains(buf.String(), "COMMIT;")
+	assert.Contains(buf.String(), unit.Checksum(DialectMySQL))
+}
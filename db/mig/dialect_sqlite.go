@@ -0,0 +1,283 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"strings"
+)
+
+const sqliteMigTable = `CREATE TABLE IF NOT EXISTS vape_migrations (
+	name    varchar(1024)   NOT NULL,
+	type    varchar(1024)   NOT NULL,
+	executed_on timestamp   NOT NULL    DEFAULT CURRENT_TIMESTAMP,
+	hash    varchar(64),
+
+	PRIMARY KEY(name)
+);
+
+CREATE INDEX IF NOT EXISTS vape_type_index ON vape_migrations(type);
+CREATE INDEX IF NOT EXISTS vape_name_type_index ON vape_migrations(name, type);
+
+CREATE TABLE IF NOT EXISTS vape_checkpoints (
+	name    varchar(1024)   NOT NULL,
+	last_key    integer     NOT NULL,
+	updated_on timestamp    NOT NULL    DEFAULT CURRENT_TIMESTAMP,
+
+	PRIMARY KEY(name)
+);
+`
+
+// sqliteHistoryTable creates the history table, which keeps one row per attempt to execute a unit
+const sqliteHistoryTable = `CREATE TABLE IF NOT EXISTS vape_history (
+	id      integer         NOT NULL,
+	name    varchar(1024)   NOT NULL,
+	target  varchar(1024)   NOT NULL,
+	attempt integer         NOT NULL,
+	result  varchar(32)     NOT NULL,
+	error   text            NOT NULL,
+	started_on timestamp    NOT NULL,
+	duration_ms integer     NOT NULL,
+	hostname varchar(255)   NOT NULL,
+	operator varchar(255)   NOT NULL,
+	version varchar(255)    NOT NULL,
+
+	PRIMARY KEY(id)
+);
+
+CREATE INDEX IF NOT EXISTS vape_history_name_index ON vape_history(name);
+`
+
+// sqliteLockQuery is a write that matches no rows. It upgrades the transaction to a write transaction,
+// which SQLite only allows for one connection at a time.
+const sqliteLockQuery = `UPDATE vape_migrations SET name=name WHERE 0;`
+
+const sqliteMarkExecutedQuery = `INSERT INTO vape_migrations (name, type, hash) VALUES (?, ?, ?);`
+
+const sqliteSetChecksumQuery = `UPDATE vape_migrations SET hash=? WHERE name=? AND hash IS NULL;`
+
+const sqliteUnmarkExecutedQuery = `DELETE FROM vape_migrations WHERE name=?;`
+
+const sqliteGetExecutedQuery = `SELECT name FROM vape_migrations WHERE type<>?;`
+
+const sqliteHasMigrationTableQuery = `SELECT count(*) FROM sqlite_master WHERE type='table' AND name='vape_migrations';`
+
+const sqliteHasHistoryTableQuery = `SELECT count(*) FROM sqlite_master WHERE type='table' AND name='vape_history';`
+
+const sqliteGetExecutedInfoQuery = `SELECT name, type, executed_on, hash FROM vape_migrations ORDER BY executed_on, name;`
+
+const sqliteRecordAttemptQuery = `INSERT INTO vape_history
+(name, target, attempt, result, error, started_on, duration_ms, hostname, operator, version)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+const sqliteSetAttemptResultQuery = `UPDATE vape_history SET result=? WHERE id=?;`
+
+const sqliteNextBatchKeyQuery = `SELECT max(%[2]s) FROM (SELECT %[2]s FROM %[1]s WHERE %[2]s > ? ORDER BY %[2]s LIMIT ?) AS batch;`
+
+const sqliteGetCheckpointQuery = `SELECT last_key FROM vape_checkpoints WHERE name=?;`
+
+// sqliteSetCheckpointQuery replaces the row of the unit, which also resets updated_on to its default
+const sqliteSetCheckpointQuery = `INSERT OR REPLACE INTO vape_checkpoints (name, last_key) VALUES (?, ?);`
+
+const sqliteDeleteCheckpointQuery = `DELETE FROM vape_checkpoints WHERE name=?;`
+
+// SQLiteDialect implements the migration interface for SQLite databases. It uses the "sqlite" key of the
+// sql section of unit files.
+//
+// The database driver is not imported by this package, the caller has to open the connection with a
+// SQLite driver of their choice.
+type SQLiteDialect struct {
+	db minimalDB
+}
+
+// OpenFromSQLiteConn accepts an opened SQLite database connection and wraps it into the SQLiteDialect
+func OpenFromSQLiteConn(db *sql.DB) *SQLiteDialect {
+	return &SQLiteDialect{
+		db: minimalDB(db),
+	}
+}
+
+// Name returns "sqlite"
+func (d *SQLiteDialect) Name() string {
+	return DialectSQLite
+}
+
+// CheckAndLoadTables will determine if the database is reachable and create the migration table
+func (d *SQLiteDialect) CheckAndLoadTables() error {
+	return createMigrationTable(d.db, sqliteMigTable, sqliteHistoryTable)
+}
+
+// HasMigrationTable checks if the migration table exists without creating it
+func (d *SQLiteDialect) HasMigrationTable() (bool, error) {
+	return queryExists(d.db, sqliteHasMigrationTableQuery)
+}
+
+// HasHistoryTable checks if the history table exists without creating it
+func (d *SQLiteDialect) HasHistoryTable() (bool, error) {
+	return queryExists(d.db, sqliteHasHistoryTableQuery)
+}
+
+// MarkExecuted will put a unit into the migration table unless it's marked as "always_exec: true" or a target unit
+func (d *SQLiteDialect) MarkExecuted(unit Unit) error {
+	if unit.Type == UnitTypeVirtualTarget || unit.AlwaysExec {
+		return nil
+	}
+	_, err := d.db.Exec(sqliteMarkExecutedQuery, unit.Name, string(unit.Type), unit.Checksum(DialectSQLite))
+	return err
+}
+
+// SetChecksum records the current checksum of an executed unit if the migration table has no checksum for it yet.
+func (d *SQLiteDialect) SetChecksum(unit Unit) error {
+	_, err := d.db.Exec(sqliteSetChecksumQuery, unit.Checksum(DialectSQLite), unit.Name)
+	return err
+}
+
+// GetExecutedUnits returns a list of executed units present in the migration table
+func (d *SQLiteDialect) GetExecutedUnits() ([]string, error) {
+	rows, err := d.db.Query(sqliteGetExecutedQuery, string(UnitTypeVirtualTarget))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUnitNames(rows)
+}
+
+// GetExecutedUnitInfo returns all units present in the migration table, ordered by the time they were executed
+func (d *SQLiteDialect) GetExecutedUnitInfo() ([]ExecutedUnit, error) {
+	rows, err := d.db.Query(sqliteGetExecutedInfoQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanExecutedUnits(rows)
+}
+
+// RollbackUnits executes the down section of the given units in the given order and removes them from the
+// migration table. All units are reverted in a single transaction, if any unit fails nothing is reverted.
+// Non-transactional units are reverted on their own, units reverted before them stay reverted.
+func (d *SQLiteDialect) RollbackUnits(units ...Unit) error {
+	return rollbackUnits(d.db, DialectSQLite, sqliteUnmarkExecutedQuery, units)
+}
+
+// RecordAttempts puts the attempts into the history table in a single transaction and sets their IDs
+func (d *SQLiteDialect) RecordAttempts(attempts []Attempt) error {
+	return recordAttempts(d.db, sqliteRecordAttemptQuery, false, attempts)
+}
+
+// MarkAttemptsRolledBack sets the result of the attempts with the given IDs to AttemptRolledBack
+func (d *SQLiteDialect) MarkAttemptsRolledBack(ids []int64) error {
+	return setAttemptResult(d.db, sqliteSetAttemptResultQuery, ids, AttemptRolledBack)
+}
+
+// GetHistory returns the attempts of the history table selected by the filter, newest first
+func (d *SQLiteDialect) GetHistory(filter HistoryFilter) ([]Attempt, error) {
+	return getHistory(d.db, filter, questionPlaceholder)
+}
+
+// WriteScript writes a SQL script that performs the given plan in a single transaction, including the creation
+// of the migration table and the bookkeeping of every unit.
+func (d *SQLiteDialect) WriteScript(w io.Writer, plan [][]Unit) error {
+	return writeScript(w, DialectSQLite, strings.TrimSpace(sqliteMigTable), plan, true)
+}
+
+// SupportsParallel returns false since SQLite only allows a single writer
+func (d *SQLiteDialect) SupportsParallel() bool {
+	return false
+}
+
+// TransactionalDDL returns true, all units of a migration are executed in a single transaction
+func (d *SQLiteDialect) TransactionalDDL() bool {
+	return true
+}
+
+// singleWriter marks SQLite as allowing a single writer, the history is recorded after the migration transaction
+func (d *SQLiteDialect) singleWriter() {}
+
+func (d *SQLiteDialect) begin(ctx context.Context) (*sql.Tx, error) {
+	return d.db.BeginTx(ctx, nil)
+}
+
+// lock acquires the write lock of the database, it is released when the transaction ends
+func (d *SQLiteDialect) lock(ctx context.Context, tx Tx) error {
+	// The lock query needs the migration table, creating it takes the write lock as well
+	_, err := tx.ExecContext(ctx, sqliteMigTable)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, sqliteLockQuery)
+	return err
+}
+
+// conn reserves a connection for non-transactional units
+func (d *SQLiteDialect) conn(ctx context.Context) (*sql.Conn, error) {
+	return d.db.Conn(ctx)
+}
+
+// lockSession does nothing, SQLite can only lock the database for the duration of a transaction
+func (d *SQLiteDialect) lockSession(ctx context.Context, conn Tx) error {
+	return nil
+}
+
+// unlock does nothing, see lockSession
+func (d *SQLiteDialect) unlock(ctx context.Context, conn Tx) error {
+	return nil
+}
+
+// executeUnit runs the unit SQL and records the unit in the migration table as part of the transaction
+func (d *SQLiteDialect) executeUnit(ctx context.Context, tx Tx, unit Unit) error {
+	return executeUnit(ctx, tx, DialectSQLite, sqliteMarkExecutedQuery, unit)
+}
+
+// batchQueries returns the queries executing batch units
+func (d *SQLiteDialect) batchQueries() batchQueries {
+	return batchQueries{
+		nextKey:          sqliteNextBatchKeyQuery,
+		getCheckpoint:    sqliteGetCheckpointQuery,
+		setCheckpoint:    sqliteSetCheckpointQuery,
+		deleteCheckpoint: sqliteDeleteCheckpointQuery,
+		markExecuted:     sqliteMarkExecutedQuery,
+	}
+}
+
+// getExecutedUnits returns the executed units as seen by the transaction
+func (d *SQLiteDialect) getExecutedUnits(ctx context.Context, tx Tx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, sqliteGetExecutedQuery, string(UnitTypeVirtualTarget))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUnitNames(rows)
+}
+
+// createTables creates the migration tables as part of the transaction
+func (d *SQLiteDialect) createTables(ctx context.Context, tx Tx) error {
+	return createTables(ctx, tx, sqliteMigTable, sqliteHistoryTable)
+}
+
+// getExecutedUnitInfo returns the units of the migration table as seen by the transaction
+func (d *SQLiteDialect) getExecutedUnitInfo(ctx context.Context, tx Tx) ([]ExecutedUnit, error) {
+	return getExecutedUnitInfo(ctx, tx, sqliteGetExecutedInfoQuery)
+}
+
+// setChecksum records the checksum of an executed unit without one as part of the transaction
+func (d *SQLiteDialect) setChecksum(ctx context.Context, tx Tx, unit Unit) error {
+	_, err := tx.ExecContext(ctx, sqliteSetChecksumQuery, unit.Checksum(DialectSQLite), unit.Name)
+	return err
+}
+
+// rollbackUnit reverts the unit and removes it from the migration table as part of the transaction
+func (d *SQLiteDialect) rollbackUnit(ctx context.Context, tx Tx, unit Unit) error {
+	return rollbackUnit(ctx, tx, DialectSQLite, sqliteUnmarkExecutedQuery, unit)
+}
+
+// isRetryable returns true if the database or a table is locked. The errors are recognised by their message
+// since the driver is only built with the sqlite tag.
+func (d *SQLiteDialect) isRetryable(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "database table is locked")
+}
+
+var _ Dialect = (*SQLiteDialect)(nil)
+var _ sessionDialect = (*SQLiteDialect)(nil)
+var _ retryDialect = (*SQLiteDialect)(nil)
+var _ batchDialect = (*SQLiteDialect)(nil)
@@ -0,0 +1,813 @@
+//go:build sqlite
+// +build sqlite
+
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"iris.arke.works/forum/snowflakes"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSQLiteDB(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	// Every connection to :memory: opens a new database
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	hasTable, err := migDB.HasHistoryTable()
+	assert.NoError(err)
+	assert.False(hasTable)
+	assert.NoError(migDB.CheckAndLoadTables())
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	hasTable, err = migDB.HasMigrationTable()
+	assert.NoError(err)
+	assert.True(hasTable)
+	hasTable, err = migDB.HasHistoryTable()
+	assert.NoError(err)
+	assert.True(hasTable)
+
+	graph := NewGraph()
+	assert.NoError(graph.Load("arke"))
+
+	subGraph, err := graph.GetTargetSubgraph("default")
+	assert.NoError(err)
+
+	executed, err := NewRunner(migDB, nil).Run(context.Background(), subGraph)
+	assert.NoError(err)
+	assert.NotEmpty(executed)
+
+	info, err := migDB.GetExecutedUnitInfo()
+	assert.NoError(err)
+	assert.Len(info, 18)
+	assert.Empty(graph.GetDriftedUnits(DialectSQLite, info))
+
+	order, err := NewRunner(migDB, nil).Rollback(context.Background(), graph, "nothing")
+	assert.NoError(err)
+	assert.NotEmpty(order)
+
+	names, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.Empty(names)
+}
+
+// sqliteSession runs SQLite migrations like a dialect without transactional DDL
+type sqliteSession struct {
+	*SQLiteDialect
+	db *sql.DB
+}
+
+func (d *sqliteSession) TransactionalDDL() bool {
+	return false
+}
+
+func (d *sqliteSession) lock(ctx context.Context, conn Tx) error {
+	return nil
+}
+
+func (d *sqliteSession) conn(ctx context.Context) (*sql.Conn, error) {
+	return d.db.Conn(ctx)
+}
+
+func (d *sqliteSession) unlock(ctx context.Context, conn Tx) error {
+	return nil
+}
+
+func TestSQLiteDB_RunSession(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := &sqliteSession{SQLiteDialect: OpenFromSQLiteConn(db), db: db}
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	graph := NewGraph()
+	graph.nodes = map[string]*Unit{
+		"nothing": &nothingUnit,
+		"unit1":   &Unit{Name: "unit1", Type: UnitTypeMigration, DependsOn: []string{"nothing"}, SQL: SQLSection{SQLite: "CREATE TABLE unit1 (id integer);"}},
+		"unit2":   &Unit{Name: "unit2", Type: UnitTypeMigration, DependsOn: []string{"unit1"}, SQL: SQLSection{SQLite: "CREATE TABLE unit2 (id integer); CREATE TABLE unit1 (id integer);"}},
+		"unit3":   &Unit{Name: "unit3", Type: UnitTypeMigration, DependsOn: []string{"unit2"}, SQL: SQLSection{SQLite: "CREATE TABLE unit3 (id integer);"}},
+	}
+
+	executed, err := NewRunner(migDB, nil).Run(context.Background(), graph)
+	assert.EqualValues([]string{"unit1"}, executed)
+	partial, ok := err.(*PartialMigrationError)
+	assert.True(ok, "Expected a partial migration error, got %v", err)
+	assert.EqualValues([]string{"unit1"}, partial.Executed)
+	assert.Equal("unit2", partial.Failed)
+	assert.EqualValues([]string{"unit3"}, partial.Pending)
+
+	// unit1 stays recorded, the first statement of unit2 stays applied
+	names, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.EqualValues([]string{"unit1"}, names)
+	_, err = db.Exec("SELECT * FROM unit2;")
+	assert.NoError(err)
+}
+
+func TestSQLiteDB_CodeUnit(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	RegisterCode("test/backfill", func(ctx context.Context, tx Tx) error {
+		var count int
+		err := tx.QueryRowContext(ctx, "SELECT count(*) FROM backfill;").Scan(&count)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO backfill (id) VALUES (?);", count+1)
+		return err
+	}, func(ctx context.Context, tx Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM backfill;")
+		return err
+	})
+	defer delete(codeUnits, "test/backfill")
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	newGraph := func() *Graph {
+		graph := NewGraph()
+		graph.nodes["test/create"] = &Unit{Name: "test/create", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+			SQL: SQLSection{SQLite: "CREATE TABLE backfill (id integer);"}, Down: SQLSection{SQLite: "DROP TABLE backfill;"}}
+		graph.nodes["test/backfill"] = &Unit{Name: "test/backfill", Type: UnitTypeCode, DependsOn: []string{"test/create"}}
+		graph.nodes["test"] = &Unit{Name: "test", Type: UnitTypeVirtualTarget, DependsOn: []string{"test/backfill"}}
+		assert.NoError(graph.ValidateNodes())
+		return graph
+	}
+
+	executed, err := NewRunner(migDB, nil).Run(context.Background(), newGraph())
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/create", "test/backfill", "test"}, executed)
+
+	// The code unit is recorded and not executed again
+	executed, err = NewRunner(migDB, nil).Run(context.Background(), newGraph())
+	assert.NoError(err)
+	assert.EqualValues([]string{"test"}, executed)
+
+	info, err := migDB.GetExecutedUnitInfo()
+	assert.NoError(err)
+	assert.Len(info, 2)
+	for _, v := range info {
+		if v.Name == "test/backfill" {
+			assert.Equal(UnitTypeCode, v.Type)
+		}
+	}
+
+	var count int
+	assert.NoError(db.QueryRow("SELECT count(*) FROM backfill;").Scan(&count))
+	assert.Equal(1, count)
+
+	graph := newGraph()
+	names, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	order, err := graph.GetRollbackOrder("test/create", names)
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/backfill"}, order)
+	unit, err := graph.GetUnit("test/backfill")
+	assert.NoError(err)
+	assert.NoError(migDB.RollbackUnits(unit))
+	assert.NoError(db.QueryRow("SELECT count(*) FROM backfill;").Scan(&count))
+	assert.Equal(0, count)
+}
+
+func TestSQLiteDB_NonTransactional(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	newGraph := func(vacuum string) *Graph {
+		graph := NewGraph()
+		graph.nodes["test/create"] = &Unit{Name: "test/create", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+			SQL: SQLSection{SQLite: "CREATE TABLE test (id integer);"}}
+		// VACUUM fails inside of a transaction
+		graph.nodes["test/vacuum"] = &Unit{Name: "test/vacuum", Type: UnitTypeMigration, DependsOn: []string{"test/create"},
+			SQL: SQLSection{SQLite: vacuum}, Transaction: TransactionNone}
+		graph.nodes["test/index"] = &Unit{Name: "test/index", Type: UnitTypeMigration, DependsOn: []string{"test/vacuum"},
+			SQL: SQLSection{SQLite: "CREATE INDEX test_index ON test(id);"}}
+		return graph
+	}
+
+	executed, err := NewRunner(migDB, nil).Run(context.Background(), newGraph("SELECT 1; VACUUM does_not_exist;"))
+	assert.EqualValues([]string{"test/create"}, executed)
+	partial, ok := err.(*PartialMigrationError)
+	assert.True(ok, "Expected a partial migration error, got %v", err)
+	assert.Equal("test/vacuum", partial.Failed)
+	assert.EqualValues([]string{"test/index"}, partial.Pending)
+
+	executed, err = NewRunner(migDB, nil).Run(context.Background(), newGraph("VACUUM; SELECT 1;"))
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/vacuum", "test/index"}, executed)
+
+	names, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.Len(names, 3)
+}
+
+func TestSQLiteDB_Batch(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	_, err = db.Exec("CREATE TABLE replies (snowflake integer PRIMARY KEY, visits integer NOT NULL DEFAULT 0);")
+	assert.NoError(err)
+	for i := 1; i <= 25; i++ {
+		_, err = db.Exec("INSERT INTO replies (snowflake) VALUES (?);", i*10)
+		assert.NoError(err)
+	}
+	// The trigger interrupts the batch containing the reply 150
+	_, err = db.Exec(`CREATE TRIGGER interrupt BEFORE UPDATE ON replies WHEN NEW.snowflake = 150
+BEGIN SELECT RAISE(FAIL, 'interrupted'); END;`)
+	assert.NoError(err)
+
+	newGraph := func() *Graph {
+		graph := NewGraph()
+		graph.nodes["test/backfill"] = &Unit{Name: "test/backfill", Type: UnitTypeBatch, DependsOn: []string{"nothing"},
+			Batch: BatchSection{Table: "replies", Size: 10},
+			SQL:   SQLSection{SQLite: "UPDATE replies SET visits = visits + 1 WHERE snowflake > ? AND snowflake <= ?;"}}
+		assert.NoError(graph.ValidateNodes())
+		return graph
+	}
+
+	_, err = NewRunner(migDB, nil).Run(context.Background(), newGraph())
+	assert.Error(err)
+	var checkpoint int64
+	assert.NoError(db.QueryRow("SELECT last_key FROM vape_checkpoints WHERE name='test/backfill';").Scan(&checkpoint))
+	assert.EqualValues(100, checkpoint)
+
+	_, err = db.Exec("DROP TRIGGER interrupt;")
+	assert.NoError(err)
+	executed, err := NewRunner(migDB, nil).Run(context.Background(), newGraph())
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/backfill"}, executed)
+
+	// Every reply is updated exactly once, the first batch is not executed again
+	var count int
+	assert.NoError(db.QueryRow("SELECT count(*) FROM replies WHERE visits = 1;").Scan(&count))
+	assert.Equal(25, count)
+	assert.NoError(db.QueryRow("SELECT count(*) FROM vape_checkpoints;").Scan(&count))
+	assert.Equal(0, count)
+
+	names, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/backfill"}, names)
+}
+
+func TestSQLiteDB_Baseline(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	graph := NewGraph()
+	assert.NoError(graph.Load("arke"))
+	subGraph, err := graph.GetTargetSubgraph("default")
+	assert.NoError(err)
+	plan, err := subGraph.GetPlan()
+	assert.NoError(err)
+	var units = []Unit{}
+	for _, round := range plan {
+		units = append(units, round...)
+	}
+
+	// The schema is created without the migration table bookkeeping, like by a script
+	for _, unit := range units {
+		if query := unit.SQL.Get(DialectSQLite); query != "" {
+			_, err = db.Exec(query)
+			assert.NoError(err)
+		}
+	}
+	_, err = db.Exec("DROP INDEX users_email_index;")
+	assert.NoError(err)
+
+	schema, err := migDB.InspectSchema()
+	assert.NoError(err)
+	assert.True(schema.Tables["users"].HasColumn("email"))
+	assert.NotContains(schema.Tables, "vape_migration")
+
+	report := CheckBaseline(schema, DialectSQLite, units)
+	assert.Len(report.Units, 18)
+	for _, unit := range report.Units {
+		if unit.Name == "db_setup/index_users" {
+			assert.EqualValues([]string{"index users_email_index on users does not exist"}, unit.Mismatches)
+		} else {
+			assert.True(unit.Verified(), "Unit %s is not verified: %v", unit.Name, unit.Mismatches)
+		}
+	}
+	assert.Empty(report.Unverified())
+
+	// The units are recorded once, without being run again
+	runner := NewRunner(migDB, nil)
+	recorded, err := runner.RecordUnits(context.Background(), units)
+	assert.NoError(err)
+	assert.Len(recorded, len(report.Units))
+	executed, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	sort.Strings(recorded)
+	sort.Strings(executed)
+	assert.EqualValues(recorded, executed)
+	recorded, err = runner.RecordUnits(context.Background(), units)
+	assert.NoError(err)
+	assert.Empty(recorded)
+}
+
+func TestSQLiteDB_VerifyModels(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	graph := NewGraph()
+	assert.NoError(graph.Load("arke"))
+	subGraph, err := graph.GetTargetSubgraph("default")
+	assert.NoError(err)
+	_, err = NewRunner(migDB, nil).Run(context.Background(), subGraph)
+	assert.NoError(err)
+
+	schema, err := migDB.InspectSchema()
+	assert.NoError(err)
+	models, err := LoadModels("../models")
+	assert.NoError(err)
+
+	// The generated Topic model selects and inserts the snowflake twice
+	problems := VerifyModels(schema, models, DialectSQLite)
+	assert.NotEmpty(problems)
+	for _, problem := range problems {
+		assert.Contains(problem, "Topic (topics): Query of ")
+		assert.Contains(problem, "lists column snowflake more than once")
+	}
+}
+
+func TestSQLiteDB_Retries(t *testing.T) {
+	assert := require.New(t)
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 0
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	var attempts = 0
+	RegisterCode("test/retried", func(ctx context.Context, tx Tx) error {
+		attempts++
+		_, err := tx.ExecContext(ctx, "INSERT INTO retried (attempt) VALUES (?);", attempts)
+		if err == nil && attempts == 1 {
+			err = errors.New("database is locked")
+		}
+		return err
+	}, nil)
+	graph := NewGraph()
+	graph.nodes["test/create"] = &Unit{Name: "test/create", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		SQL: SQLSection{SQLite: "CREATE TABLE retried (attempt integer);"}}
+	graph.nodes["test/retried"] = &Unit{Name: "test/retried", Type: UnitTypeCode, DependsOn: []string{"test/create"},
+		Retries: 1}
+
+	executed, err := NewRunner(migDB, nil).Run(context.Background(), graph)
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/create", "test/retried"}, executed)
+	assert.Equal(2, attempts)
+
+	// The first attempt has been rolled back to the savepoint
+	var rows string
+	assert.NoError(db.QueryRow("SELECT group_concat(attempt) FROM retried;").Scan(&rows))
+	assert.Equal("2", rows)
+}
+
+func TestSQLiteDB_History(t *testing.T) {
+	assert := require.New(t)
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 0
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	var locked = true
+	RegisterCode("test/history", func(ctx context.Context, tx Tx) error {
+		if locked {
+			return errors.New("database is locked")
+		}
+		return nil
+	}, nil)
+	graph := NewGraph()
+	graph.nodes["test/create"] = &Unit{Name: "test/create", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		SQL: SQLSection{SQLite: "CREATE TABLE history (id integer);"}}
+	graph.nodes["test/history"] = &Unit{Name: "test/history", Type: UnitTypeCode, DependsOn: []string{"test/create"},
+		Retries: 1}
+
+	runner := NewRunner(migDB, nil)
+	runner.Target = "default"
+	runner.Version = "1.2.3"
+	_, err = runner.Run(context.Background(), graph)
+	assert.Error(err)
+
+	// The failed attempts are kept although the transaction has been rolled back
+	history, err := migDB.GetHistory(HistoryFilter{})
+	assert.NoError(err)
+	assert.Len(history, 3)
+	assert.Equal("test/history", history[0].Unit)
+	assert.Equal(2, history[0].Number)
+	assert.Equal(AttemptFailed, history[0].Result)
+	assert.Equal("database is locked", history[0].Error)
+	assert.Equal("default", history[0].Target)
+	assert.Equal("1.2.3", history[0].Version)
+	assert.NotEmpty(history[0].Hostname)
+	assert.WithinDuration(time.Now(), history[0].StartedOn, time.Minute)
+	assert.Equal(AttemptFailed, history[1].Result)
+	assert.Equal(1, history[1].Number)
+	assert.Equal("test/create", history[2].Unit)
+	assert.Equal(AttemptRolledBack, history[2].Result)
+	assert.Empty(history[2].Error)
+
+	locked = false
+	graph.unmarkNodes("test/create", "test/history")
+	_, err = runner.Run(context.Background(), graph)
+	assert.NoError(err)
+
+	history, err = migDB.GetHistory(HistoryFilter{Limit: 2})
+	assert.NoError(err)
+	assert.Len(history, 2)
+	assert.Equal(AttemptSucceeded, history[0].Result)
+	assert.Equal(AttemptSucceeded, history[1].Result)
+	assert.True(history[0].ID > history[1].ID)
+
+	history, err = migDB.GetHistory(HistoryFilter{Unit: "test/history", Failed: true})
+	assert.NoError(err)
+	assert.Len(history, 2)
+	history, err = migDB.GetHistory(HistoryFilter{Unit: "test/create"})
+	assert.NoError(err)
+	assert.Len(history, 2)
+}
+
+func TestSQLiteDB_Conditions(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+
+	newGraph := func() *Graph {
+		graph := NewGraph()
+		graph.nodes["default"] = &Unit{Name: "default", Type: UnitTypeVirtualTarget,
+			DependsOn: []string{"test/guarded", "test/after"}}
+		graph.nodes["test/create"] = &Unit{Name: "test/create", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+			SQL: SQLSection{SQLite: "CREATE TABLE flags (name varchar(255));"}}
+		graph.nodes["test/guarded"] = &Unit{Name: "test/guarded", Type: UnitTypeMigration,
+			DependsOn: []string{"test/create"}, SQL: SQLSection{SQLite: "CREATE TABLE guarded (id integer);"},
+			RunIf: SQLSection{SQLite: "SELECT count(*) > 0 FROM flags WHERE name = 'guarded';"}}
+		graph.nodes["test/after"] = &Unit{Name: "test/after", Type: UnitTypeMigration,
+			DependsOn: []string{"test/guarded"}, SQL: SQLSection{SQLite: "CREATE TABLE after (id integer);"}}
+		return graph
+	}
+
+	// The condition depends on a pending unit, so it cannot be evaluated yet
+	graph := newGraph()
+	skipped, err := graph.EvaluateConditions(context.Background(), migDB)
+	assert.NoError(err)
+	assert.Empty(skipped)
+
+	executed, err := NewRunner(migDB, nil).Run(context.Background(), graph)
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/create", "test/after", "default"}, executed)
+	names, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.Len(names, 2)
+	assert.Contains(names, "test/create")
+	assert.Contains(names, "test/after")
+
+	graph = newGraph()
+	skipped, err = graph.EvaluateConditions(context.Background(), migDB)
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/guarded"}, skipped)
+	info, err := migDB.GetExecutedUnitInfo()
+	assert.NoError(err)
+	status, err := graph.GetStatus(DialectSQLite, info)
+	assert.NoError(err)
+	for _, v := range status {
+		if v.Name == "test/guarded" {
+			assert.Equal(UnitStateSkipped, v.State)
+		}
+	}
+
+	// Once the condition is met, the unit runs on the next migration
+	_, err = db.Exec("INSERT INTO flags (name) VALUES ('guarded');")
+	assert.NoError(err)
+	graph = newGraph()
+	graph.MarkNodesRun(names...)
+	skipped, err = graph.EvaluateConditions(context.Background(), migDB)
+	assert.NoError(err)
+	assert.Empty(skipped)
+	executed, err = NewRunner(migDB, nil).Run(context.Background(), graph)
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/guarded", "default"}, executed)
+
+	// A failing condition fails the unit
+	graph = newGraph()
+	graph.nodes["test/failing"] = &Unit{Name: "test/failing", Type: UnitTypeMigration,
+		DependsOn: []string{"test/create"}, SQL: SQLSection{SQLite: "CREATE TABLE failing (id integer);"},
+		RunIf: SQLSection{SQLite: "SELECT missing FROM flags;"}}
+	_, err = NewRunner(migDB, nil).Run(context.Background(), graph)
+	assert.Error(err)
+	assert.Contains(err.Error(), "Could not evaluate run_if")
+
+	// Units of other environments are passed over in the order of the graph
+	graph = newGraph()
+	graph.nodes["test/seed"] = &Unit{Name: "test/seed", Type: UnitTypeMigration, DependsOn: []string{"test/create"},
+		SQL: SQLSection{SQLite: "INSERT INTO flags (name) VALUES ('seed');"}, Environments: []string{"dev"}}
+	graph.nodes["test/seeded"] = &Unit{Name: "test/seeded", Type: UnitTypeVirtualTarget,
+		DependsOn: []string{"test/seed"}}
+	graph.SetEnvironment("production")
+	subGraph, err := graph.GetTargetSubgraph("test/seeded")
+	assert.NoError(err)
+	executed, err = NewRunner(migDB, nil).Run(context.Background(), subGraph)
+	assert.NoError(err)
+	assert.EqualValues([]string{"test/seeded"}, executed)
+	var seeded int
+	assert.NoError(db.QueryRow("SELECT count(*) FROM flags WHERE name = 'seed';").Scan(&seeded))
+	assert.Equal(0, seeded)
+}
+
+func TestSQLiteDB_Seed(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	assert.NoError(migDB.CheckAndLoadTables())
+	graph := NewGraph()
+	assert.NoError(graph.Load("arke"))
+	subGraph, err := graph.GetTargetSubgraph("default")
+	assert.NoError(err)
+	assert.NotContains(subGraph.sortedNames(), "seed/defaults")
+
+	// SQLite cannot run the queries of the models package, the seed target is refused before anything is executed
+	subGraph, err = graph.GetTargetSubgraph("seed")
+	assert.NoError(err)
+	_, err = NewRunner(migDB, nil).Run(context.Background(), subGraph)
+	assert.EqualError(err,
+		"Seed units can only be executed on the public schema of Postgres: [seed/defaults]")
+	names, err := migDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.Empty(names)
+
+	// The models address the tables of the public schema, which an attached database provides
+	_, err = db.Exec(`ATTACH DATABASE ':memory:' AS public;
+CREATE TABLE public.categories (snowflake bigint PRIMARY KEY, created_at timestamp NOT NULL, deleted_at timestamp,
+	title varchar(1024) NOT NULL UNIQUE, description text, color integer);
+CREATE TABLE public.groups (snowflake bigint PRIMARY KEY, created_at timestamp NOT NULL, deleted_at timestamp,
+	name varchar(1024) NOT NULL UNIQUE, permission blob, parent_id bigint);`)
+	assert.NoError(err)
+	color := int64(0x3d85c6)
+	unit := Unit{Name: "seed/test", Type: UnitTypeSeed, Seed: SeedSection{
+		Categories: []SeedCategory{{Title: "General", Description: "Anything goes", Color: &color}},
+		Groups:     []SeedGroup{{Name: "admin"}, {Name: "moderator", Parent: "admin", Permission: "moderate"}},
+	}}
+	seed := func() {
+		tx, err := db.Begin()
+		assert.NoError(err)
+		assert.NoError(runSeed(context.Background(), tx, unit))
+		assert.NoError(tx.Commit())
+	}
+	seed()
+	var categoryID, adminID, parentID int64
+	var description string
+	assert.NoError(db.QueryRow("SELECT snowflake, description FROM public.categories WHERE title = 'General';").
+		Scan(&categoryID, &description))
+	assert.True(categoryID > 0)
+	assert.Equal(int64(snowflakes.MigrationInstanceID), categoryID&0x7f)
+	assert.Equal("Anything goes", description)
+	assert.NoError(db.QueryRow("SELECT snowflake FROM public.groups WHERE name = 'admin';").Scan(&adminID))
+	assert.NoError(db.QueryRow("SELECT parent_id FROM public.groups WHERE name = 'moderator';").Scan(&parentID))
+	assert.Equal(adminID, parentID)
+
+	// Seeding again updates the rows in place
+	unit.Seed.Categories[0].Description = "Everything else"
+	seed()
+	var count int
+	var seededID int64
+	assert.NoError(db.QueryRow("SELECT count(*) FROM public.categories;").Scan(&count))
+	assert.Equal(1, count)
+	assert.NoError(db.QueryRow("SELECT snowflake, description FROM public.categories WHERE title = 'General';").
+		Scan(&seededID, &description))
+	assert.Equal(categoryID, seededID)
+	assert.Equal("Everything else", description)
+	assert.NoError(db.QueryRow("SELECT count(*) FROM public.groups;").Scan(&count))
+	assert.Equal(2, count)
+
+	// Columns the unit does not declare keep the values of the existing rows
+	unit.Seed.Categories[0].Color = nil
+	unit.Seed.Groups[1] = SeedGroup{Name: "moderator"}
+	seed()
+	var seededColor int64
+	var permission string
+	assert.NoError(db.QueryRow("SELECT color FROM public.categories WHERE title = 'General';").Scan(&seededColor))
+	assert.Equal(color, seededColor)
+	assert.NoError(db.QueryRow("SELECT permission, parent_id FROM public.groups WHERE name = 'moderator';").
+		Scan(&permission, &parentID))
+	assert.Equal("moderate", permission)
+	assert.Equal(adminID, parentID)
+
+	unit.Seed.Groups = []SeedGroup{{Name: "orphan", Parent: "missing"}}
+	tx, err := db.Begin()
+	assert.NoError(err)
+	defer tx.Rollback()
+	assert.Contains(runSeed(context.Background(), tx, unit).Error(), "Could not find parent missing of group orphan")
+}
+
+func TestSQLiteDB_Squash(t *testing.T) {
+	assert := require.New(t)
+
+	open := func() (*sql.DB, Dialect) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		assert.NoError(err)
+		db.SetMaxOpenConns(1)
+		migDB := OpenFromSQLiteConn(db)
+		assert.NoError(migDB.CheckAndLoadTables())
+		return db, migDB
+	}
+	create := Unit{Name: "setup/create_test", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		SQL: SQLSection{SQLite: "CREATE TABLE test (id integer PRIMARY KEY, name text NOT NULL);"}}
+	index := Unit{Name: "setup/index_test", Type: UnitTypeMigration, DependsOn: []string{"setup/create_test"},
+		SQL: SQLSection{SQLite: "CREATE INDEX test_name ON test (name);"}}
+	graph := func(units ...Unit) *Graph {
+		g := NewGraph()
+		var names []string
+		for k := range units {
+			g.nodes[units[k].Name] = &units[k]
+			names = append(names, units[k].Name)
+		}
+		g.nodes["target"] = &Unit{Name: "target", Type: UnitTypeVirtualTarget, DependsOn: names}
+		assert.NoError(g.ValidateNodes())
+		return g
+	}
+
+	scratch, scratchDB := open()
+	defer scratch.Close()
+	_, err := NewRunner(scratchDB, nil).Run(context.Background(), graph(create, index))
+	assert.NoError(err)
+	ddl, err := scratchDB.(SchemaDumper).DumpSchema()
+	assert.NoError(err)
+	assert.Contains(ddl, "CREATE INDEX test_name ON test (name)")
+	assert.NotContains(ddl, "vape_")
+
+	baseline := Unit{Name: "baseline/v1", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		Squashes: []string{create.Name, index.Name}, SQL: SQLSection{SQLite: ddl}}
+
+	// Databases that executed the squashed units record the baseline without executing it
+	migrated, migratedDB := open()
+	defer migrated.Close()
+	_, err = NewRunner(migratedDB, nil).Run(context.Background(), graph(create, index))
+	assert.NoError(err)
+	executed, err := NewRunner(migratedDB, nil).Run(context.Background(), graph(baseline))
+	assert.NoError(err)
+	assert.Contains(executed, "baseline/v1")
+	names, err := migratedDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.Contains(names, "baseline/v1")
+
+	// Rolling the baseline back removes the squashed units from the migration table, too
+	order, err := graph(baseline).GetRollbackOrder("nothing", names)
+	assert.NoError(err)
+	assert.EqualValues([]string{"baseline/v1"}, order)
+	baseline.Down = SQLSection{SQLite: "DROP TABLE test;"}
+	assert.NoError(migratedDB.RollbackUnits(baseline))
+	names, err = migratedDB.GetExecutedUnits()
+	assert.NoError(err)
+	assert.Empty(names)
+	baseline.Down = SQLSection{}
+
+	// New databases execute the baseline
+	fresh, freshDB := open()
+	defer fresh.Close()
+	_, err = NewRunner(freshDB, nil).Run(context.Background(), graph(baseline))
+	assert.NoError(err)
+	_, err = fresh.Exec("INSERT INTO test (name) VALUES ('test');")
+	assert.NoError(err)
+	var count int
+	assert.NoError(fresh.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'test_name';").Scan(&count))
+	assert.Equal(1, count)
+
+	// Databases that executed only some of the squashed units cannot use the baseline
+	partial, partialDB := open()
+	defer partial.Close()
+	_, err = NewRunner(partialDB, nil).Run(context.Background(), graph(create))
+	assert.NoError(err)
+	_, err = NewRunner(partialDB, nil).Run(context.Background(), graph(baseline))
+	assert.Error(err)
+	assert.Contains(err.Error(), "only some have been executed")
+}
+
+// sqliteLocked is a SQLite dialect whose migration lock is held by another migration
+type sqliteLocked struct {
+	*SQLiteDialect
+}
+
+func (d *sqliteLocked) tryLock(ctx context.Context, ex Tx, session bool) (bool, error) {
+	return false, nil
+}
+
+func TestSQLiteDB_Migrator(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migDB := OpenFromSQLiteConn(db)
+	graph := NewGraph()
+	assert.NoError(graph.Load("arke"))
+	ctx := context.Background()
+
+	// A migration held by another instance fails fast with NoWait and is waited for otherwise
+	migrator := NewMigrator(&sqliteLocked{migDB}, nil)
+	migrator.NoWait = true
+	report, err := migrator.Migrate(ctx, graph, "default")
+	assert.Equal(ErrLocked, err)
+	assert.Empty(report.Executed)
+	migrator.NoWait = false
+	report, err = migrator.Migrate(ctx, graph, "default")
+	assert.NoError(err)
+	assert.Equal("default", report.Target)
+	assert.NotEmpty(report.Executed)
+	assert.NotContains(report.Executed, "default")
+	assert.Empty(report.Drifted)
+	unit := graph.nodes[report.Executed[0]]
+
+	report, err = NewMigrator(migDB, nil).Migrate(ctx, graph, "default")
+	assert.NoError(err)
+	assert.Empty(report.Executed)
+
+	// Modified units stop the migration unless drift is allowed
+	unit.SQL.SQLite += "\n"
+	migrator = NewMigrator(migDB, nil)
+	_, err = migrator.Migrate(ctx, graph, "default")
+	assert.EqualError(err, "Executed units have been modified: ["+unit.Name+"]")
+	migrator.AllowDrift = true
+	report, err = migrator.Migrate(ctx, graph, "default")
+	assert.NoError(err)
+	assert.EqualValues([]string{unit.Name}, report.Drifted)
+
+	// Missing checksums are recorded
+	_, err = db.Exec("UPDATE vape_migrations SET hash = NULL WHERE name = ?;", unit.Name)
+	assert.NoError(err)
+	report, err = migrator.Migrate(ctx, graph, "default")
+	assert.NoError(err)
+	assert.EqualValues([]string{unit.Name}, report.Checksummed)
+	assert.Empty(report.Drifted)
+}
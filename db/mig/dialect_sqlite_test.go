@@ -0,0 +1,88 @@
+package mig
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestOpenFromSQLiteConn(t *testing.T) {
+	dialect := OpenFromSQLiteConn(nil)
+	require.NotNil(t, dialect)
+	require.Equal(t, DialectSQLite, dialect.Name())
+	require.False(t, dialect.SupportsParallel())
+}
+
+func TestSQLiteDialect_MarkExecuted(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &SQLiteDialect{
+		db: mockDB,
+	}
+
+	unit := Unit{
+		Name: "test-unit",
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE pg ();", SQLite: "CREATE TABLE lite ();"},
+	}
+
+	mockDB.On("Exec",
+		"INSERT INTO vape_migrations (name, type, hash) VALUES (?, ?, ?);",
+		[]interface{}{"test-unit", "migration", unit.Checksum(DialectSQLite)}).Return(nil, nil)
+	mockDB.On("Exec",
+		"UPDATE vape_migrations SET hash=? WHERE name=? AND hash IS NULL;",
+		[]interface{}{unit.Checksum(DialectSQLite), "test-unit"}).Return(nil, nil)
+
+	require.NoError(t, dialect.MarkExecuted(Unit{Name: "always", AlwaysExec: true}))
+	require.NoError(t, dialect.MarkExecuted(Unit{Name: "target", Type: UnitTypeVirtualTarget}))
+	require.NoError(t, dialect.MarkExecuted(unit))
+	require.NoError(t, dialect.SetChecksum(unit))
+
+	mockDB.AssertExpectations(t)
+	mockDB.AssertNumberOfCalls(t, "Exec", 2)
+}
+
+func TestSQLiteDialect_Queries(t *testing.T) {
+	assert := require.New(t)
+
+	mockDB := new(minimalDBMock)
+	dialect := &SQLiteDialect{
+		db: mockDB,
+	}
+
+	mockDB.On("Ping").Return(errors.New("Test error"))
+	mockDB.On("Query", sqliteHasMigrationTableQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+	mockDB.On("Query", sqliteHasHistoryTableQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+	mockDB.On("Query", sqliteGetExecutedQuery, []interface{}{"target"}).Return((*sql.Rows)(nil), errors.New("Test error"))
+	mockDB.On("Query", sqliteGetExecutedInfoQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+
+	assert.Error(dialect.CheckAndLoadTables())
+	_, err := dialect.HasMigrationTable()
+	assert.Error(err)
+	_, err = dialect.HasHistoryTable()
+	assert.Error(err)
+	_, err = dialect.GetExecutedUnits()
+	assert.Error(err)
+	_, err = dialect.GetExecutedUnitInfo()
+	assert.Error(err)
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestSQLiteDialect_WriteScript(t *testing.T) {
+	assert := require.New(t)
+
+	unit := Unit{
+		Name: "test-unit",
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE pg ();", SQLite: "CREATE TABLE lite ();"},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(OpenFromSQLiteConn(nil).WriteScript(&buf, [][]Unit{{unit}}))
+	assert.Contains(buf.String(), "CREATE TABLE IF NOT EXISTS vape_migrations")
+	assert.Contains(buf.String(), "CREATE TABLE lite ();")
+	assert.NotContains(buf.String(), "CREATE TABLE pg ();")
+	assert.Contains(buf.String(), unit.Checksum(DialectSQLite))
+}
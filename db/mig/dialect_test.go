@@ -1,12 +1,15 @@
 package mig
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -24,9 +27,11 @@ func TestPostgresDialect_MarkExecuted(t *testing.T) {
 		db: mockDB,
 	}
 
+	checksum := Unit{}.Checksum(DialectPostgres)
+
 	mockDB.On("Exec",
-		"INSERT INTO vape_migrations (name, type) VALUES\n($1, $2)\n;",
-		[]interface{}{"test-unit", "migration"}).Return(nil, nil)
+		"INSERT INTO vape_migrations (name, type, hash) VALUES\n($1, $2, $3)\n;",
+		[]interface{}{"test-unit", "migration", checksum}).Return(nil, nil)
 
 	dialect.MarkExecuted(Unit{
 		Type:       UnitTypeMigration,
@@ -42,11 +47,215 @@ func TestPostgresDialect_MarkExecuted(t *testing.T) {
 		return
 	}
 	mockDB.AssertCalled(t, "Exec",
-		"INSERT INTO vape_migrations (name, type) VALUES\n($1, $2)\n;",
-		[]interface{}{"test-unit", "migration"})
+		"INSERT INTO vape_migrations (name, type, hash) VALUES\n($1, $2, $3)\n;",
+		[]interface{}{"test-unit", "migration", checksum})
 	mockDB.AssertNumberOfCalls(t, "Exec", 1)
 }
 
+func TestPostgresDialect_HasMigrationTable(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+
+	mockDB.On("Query", hasMigrationTableQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+
+	_, err := dialect.HasMigrationTable()
+
+	mockDB.AssertExpectations(t)
+	require.Error(t, err)
+}
+
+func TestPostgresDialect_HasHistoryTable(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+
+	mockDB.On("Query", hasHistoryTableQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+
+	_, err := dialect.HasHistoryTable()
+
+	mockDB.AssertExpectations(t)
+	require.Error(t, err)
+}
+
+func TestPostgresDialect_SetChecksum(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+
+	unit := Unit{
+		Name: "test-unit",
+		SQL:  SQLSection{Postgres: "CREATE TABLE test ();"},
+	}
+
+	mockDB.On("Exec",
+		"UPDATE vape_migrations SET hash=$2 WHERE name=$1 AND hash IS NULL;",
+		[]interface{}{"test-unit", unit.Checksum(DialectPostgres)}).Return(nil, nil)
+
+	require.NoError(t, dialect.SetChecksum(unit))
+	mockDB.AssertExpectations(t)
+}
+
+func TestPostgresDialect_RollbackUnits(t *testing.T) {
+	assert := require.New(t)
+
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+
+	assert.Error(dialect.RollbackUnits(Unit{
+		Name: "test-unit",
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE test ();"},
+	}))
+	mockDB.AssertNotCalled(t, "Begin")
+
+	mockDB.On("Begin").Return(nil, errors.New("Test error"))
+
+	assert.Error(dialect.RollbackUnits(Unit{
+		Name: "test-unit",
+		Type: UnitTypeMigration,
+		Down: SQLSection{Postgres: "DROP TABLE test;"},
+	}))
+	mockDB.AssertExpectations(t)
+}
+
+func TestPostgresDialect_GetExecutedUnitInfo(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+
+	mockDB.On("Query", "SELECT name, type, executed_on, hash FROM vape_migrations ORDER BY executed_on, name;", []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+
+	_, err := dialect.GetExecutedUnitInfo()
+
+	mockDB.AssertExpectations(t)
+	require.Error(t, err)
+}
+
+func TestPostgresDialect_WriteScript(t *testing.T) {
+	assert := require.New(t)
+
+	unit := Unit{
+		Name:        "test/o'unit",
+		Description: "Test Unit",
+		Type:        UnitTypeMigration,
+		SQL:         SQLSection{Postgres: "CREATE TABLE test ();\n"},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(OpenFromPGConn(nil).WriteScript(&buf, [][]Unit{
+		{unit, {Name: "always", Type: UnitTypeMigration, AlwaysExec: true, SQL: SQLSection{Postgres: "SELECT 1;"}}},
+		{{Name: "target", Type: UnitTypeVirtualTarget}},
+	}))
+
+	script := buf.String()
+	assert.True(strings.HasPrefix(script, "BEGIN;\n"))
+	assert.True(strings.HasSuffix(script, "COMMIT;\n"))
+	assert.Contains(script, "CREATE TABLE IF NOT EXISTS vape_migrations")
+	assert.Contains(script, "-- Round 2")
+	assert.Contains(script, "-- Unit: test/o'unit\n-- Test Unit\nCREATE TABLE test ();\n")
+	assert.Contains(script, "INSERT INTO vape_migrations (name, type, hash) VALUES ('test/o''unit', 'migration', '"+unit.Checksum(DialectPostgres)+"');")
+	assert.Contains(script, "SELECT 1;")
+	assert.NotContains(script, "'always'")
+	assert.NotContains(script, "target")
+
+	buf.Reset()
+	assert.NoError(OpenFromPGConn(nil).WriteScript(&buf, [][]Unit{{{
+		Name:        "index",
+		Type:        UnitTypeMigration,
+		Transaction: TransactionNone,
+		SQL:         SQLSection{Postgres: "CREATE INDEX CONCURRENTLY test_index ON test(id);"},
+	}}}))
+	assert.Contains(buf.String(), "-- Unit: index\nCOMMIT;\nCREATE INDEX CONCURRENTLY test_index ON test(id);\n"+
+		"INSERT INTO vape_migrations (name, type, hash) VALUES ('index', 'migration', ")
+	assert.True(strings.HasSuffix(buf.String(), "');\nBEGIN;\n\nCOMMIT;\n"))
+
+	buf.Reset()
+	assert.NoError(OpenFromPGConn(nil).WriteScript(&buf, [][]Unit{{{
+		Name: "seed/defaults",
+		Type: UnitTypeSeed,
+		Seed: SeedSection{Groups: []SeedGroup{{Name: "admin"}}},
+	}}}))
+	assert.Contains(buf.String(), "-- Unit: seed/defaults\n-- Seed units are left out of scripts")
+	assert.NotContains(buf.String(), "'seed/defaults'")
+
+	buf.Reset()
+	assert.EqualError(OpenFromPGConn(nil).WriteScript(&buf, [][]Unit{{{
+		Name:  "trgm",
+		Type:  UnitTypeMigration,
+		RunIf: SQLSection{Postgres: "SELECT EXISTS (\n\tSELECT 1 FROM pg_available_extensions WHERE name = 'pg_trgm'\n);"},
+		SQL:   SQLSection{Postgres: "CREATE EXTENSION pg_trgm;"},
+	}, {
+		Name: "test",
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE test ();"},
+	}}}), "Units [trgm] have a run_if query and cannot be written to a SQL script")
+	assert.Empty(buf.String())
+
+	buf.Reset()
+	assert.EqualError(OpenFromPGConn(nil).WriteScript(&buf, [][]Unit{{{
+		Name:  "backfill",
+		Type:  UnitTypeBatch,
+		Batch: BatchSection{Table: "replies"},
+		SQL:   SQLSection{Postgres: "UPDATE replies SET visits = 0 WHERE snowflake > $1 AND snowflake <= $2;"},
+	}}}), "Unit backfill runs in batches and cannot be written to a SQL script")
+}
+
+func TestPostgresDialect_GetInvalidIndexes(t *testing.T) {
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+
+	mockDB.On("Query", getInvalidIndexesQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+
+	_, err := dialect.GetInvalidIndexes()
+	require.Error(t, err)
+	mockDB.AssertExpectations(t)
+}
+
+func TestPostgresDialect_Tenant(t *testing.T) {
+	assert := require.New(t)
+
+	tx := &txRecorder{}
+	ctx := context.Background()
+	for _, dialect := range []*PostgresDialect{OpenFromPGConn(nil), OpenTenantFromPGConn(nil)} {
+		assert.NoError(dialect.lock(ctx, tx))
+		assert.NoError(dialect.lockSession(ctx, tx))
+		assert.NoError(dialect.unlock(ctx, tx))
+	}
+	assert.EqualValues([]string{
+		lockQuery, lockSessionQuery, unlockSessionQuery,
+		tenantLockQuery, tenantLockSessionQuery, tenantUnlockSessionQuery,
+	}, tx.queries)
+}
+
+func TestPostgresDialect_Schemas(t *testing.T) {
+	assert := require.New(t)
+
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+
+	_, err := dialect.Schemas("forum_[")
+	assert.EqualError(err, `Invalid schema pattern "forum_[": syntax error in pattern`)
+
+	mockDB.On("Query", listSchemasQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+	_, err = dialect.Schemas("forum_*")
+	assert.EqualError(err, "Test error")
+
+	mockDB.On("Exec", `CREATE SCHEMA IF NOT EXISTS "Forum A";`, []interface{}(nil)).Return(nil, nil)
+	assert.NoError(dialect.CreateSchema("Forum A"))
+	mockDB.AssertExpectations(t)
+}
+
 func TestPostgresDialect(t *testing.T) {
 
 	assert := require.New(t)
@@ -130,7 +339,7 @@ func TestPostgresDialect(t *testing.T) {
 		db: mockDB,
 	}
 
-	mockDB.On("Query", "SELECT name FROM vape_migrations WHERE type=$1;", []interface{}{"migration"}).Return((*sql.Rows)(nil), errors.New("Test error"))
+	mockDB.On("Query", "SELECT name FROM vape_migrations WHERE type<>$1;", []interface{}{"target"}).Return((*sql.Rows)(nil), errors.New("Test error"))
 
 	_, err = dialect.GetExecutedUnits()
 
@@ -147,7 +356,7 @@ func TestPostgresDialect(t *testing.T) {
 	res, err := db.Query("SELECT 1,1;")
 	assert.NoError(err)
 
-	mockDB.On("Query", "SELECT name FROM vape_migrations WHERE type=$1;", []interface{}{"migration"}).Return(res, nil)
+	mockDB.On("Query", "SELECT name FROM vape_migrations WHERE type<>$1;", []interface{}{"target"}).Return(res, nil)
 
 	_, err = dialect.GetExecutedUnits()
 
@@ -155,6 +364,7 @@ func TestPostgresDialect(t *testing.T) {
 		return
 	}
 	assert.Error(err)
+
 }
 
 /* -- Mockery Autogenerated Stub -- */
@@ -187,6 +397,52 @@ func (_m *minimalDBMock) Begin() (*sql.Tx, error) {
 	return r0, r1
 }
 
+// BeginTx provides a mock function with given fields: _a0, _a1
+func (_m *minimalDBMock) BeginTx(_a0 context.Context, _a1 *sql.TxOptions) (*sql.Tx, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 *sql.Tx
+	if rf, ok := ret.Get(0).(func(context.Context, *sql.TxOptions) *sql.Tx); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*sql.Tx)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *sql.TxOptions) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Conn provides a mock function with given fields: _a0
+func (_m *minimalDBMock) Conn(_a0 context.Context) (*sql.Conn, error) {
+	ret := _m.Called(_a0)
+
+	var r0 *sql.Conn
+	if rf, ok := ret.Get(0).(func(context.Context) *sql.Conn); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*sql.Conn)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Exec provides a mock function with given fields: _a0, _a1
 func (_m *minimalDBMock) Exec(_a0 string, _a1 ...interface{}) (sql.Result, error) {
 	ret := _m.Called(_a0, _a1)
@@ -0,0 +1,128 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// stateColors are the fill colors used for unit states when exporting a graph
+var stateColors = map[UnitState]string{
+	UnitStateApplied:    "#b7e1a1",
+	UnitStatePending:    "#ffd28a",
+	UnitStateDrifted:    "#f4a09c",
+	UnitStateAlwaysExec: "#a8c8f0",
+	UnitStateSkipped:    "#d9d9d9",
+	UnitStateSatisfied:  "#d8f0c8",
+}
+
+// ExportedUnit is the representation of a unit in the JSON export of a graph
+type ExportedUnit struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Type        UnitType  `json:"type"`
+	DependsOn   []string  `json:"depends_on"`
+	State       UnitState `json:"state,omitempty"`
+}
+
+// exportNames returns the sorted names of all nodes that are part of an export, the "nothing" unit is omitted
+func (g *Graph) exportNames() []string {
+	var names = []string{}
+	for _, name := range g.sortedNames() {
+		if name != nothingUnit.Name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format. Edges point from a unit to its dependencies,
+// targets are drawn as dashed boxes. If states is not nil, units are filled with the color of their state.
+func (g *Graph) WriteDOT(w io.Writer, states map[string]UnitState) error {
+	var err error
+	write := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	write("digraph vape {\n\trankdir=LR;\n\tnode [shape=box, style=filled, fillcolor=white];\n")
+	for _, name := range g.exportNames() {
+		node := g.nodes[name]
+		var attrs = ""
+		if node.Type == UnitTypeVirtualTarget {
+			attrs += ", shape=box3d, style=\"filled,dashed\""
+		}
+		if color, ok := stateColors[states[name]]; ok {
+			attrs += fmt.Sprintf(", fillcolor=%s", strconv.Quote(color))
+		}
+		write("\t%s [label=%s%s];\n", strconv.Quote(name), strconv.Quote(name), attrs)
+	}
+	for _, name := range g.exportNames() {
+		for _, dependency := range g.nodes[name].DependsOnWithoutNothing() {
+			write("\t%s -> %s;\n", strconv.Quote(name), strconv.Quote(dependency))
+		}
+	}
+	write("}\n")
+	return err
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart. Edges point from a unit to its dependencies,
+// targets are drawn as subroutine shapes. If states is not nil, units are styled with the color of their state.
+func (g *Graph) WriteMermaid(w io.Writer, states map[string]UnitState) error {
+	var err error
+	write := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	// Mermaid IDs cannot contain slashes, so every node gets a numeric ID
+	var ids = map[string]string{}
+	write("graph LR\n")
+	for i, name := range g.exportNames() {
+		ids[name] = fmt.Sprintf("n%d", i)
+		if g.nodes[name].Type == UnitTypeVirtualTarget {
+			write("\t%s[[\"%s\"]]\n", ids[name], name)
+		} else {
+			write("\t%s[\"%s\"]\n", ids[name], name)
+		}
+	}
+	for _, name := range g.exportNames() {
+		for _, dependency := range g.nodes[name].DependsOnWithoutNothing() {
+			if _, ok := ids[dependency]; ok {
+				write("\t%s --> %s\n", ids[name], ids[dependency])
+			}
+		}
+	}
+	if states != nil {
+		for _, state := range []UnitState{UnitStateApplied, UnitStatePending, UnitStateDrifted, UnitStateAlwaysExec,
+			UnitStateSkipped, UnitStateSatisfied} {
+			write("\tclassDef %s fill:%s\n", state, stateColors[state])
+		}
+		for _, name := range g.exportNames() {
+			if _, ok := stateColors[states[name]]; ok {
+				write("\tclass %s %s\n", ids[name], states[name])
+			}
+		}
+	}
+	return err
+}
+
+// WriteJSON writes the units of the graph as a JSON array. If states is not nil, the state of each unit
+// is included.
+func (g *Graph) WriteJSON(w io.Writer, states map[string]UnitState) error {
+	var units = []ExportedUnit{}
+	for _, name := range g.exportNames() {
+		node := g.nodes[name]
+		units = append(units, ExportedUnit{
+			Name:        node.Name,
+			Description: node.Description,
+			Type:        node.Type,
+			DependsOn:   node.DependsOnWithoutNothing(),
+			State:       states[name],
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(units)
+}
@@ -0,0 +1,73 @@
+package mig
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func exportTestGraph() *Graph {
+	graph := NewGraph()
+
+	graph.nodes["default"] = &Unit{
+		Name:      "default",
+		DependsOn: []string{"db/create"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["db/create"] = &Unit{
+		Name:        "db/create",
+		Description: "Create",
+		DependsOn:   []string{"nothing"},
+		Type:        UnitTypeMigration,
+	}
+
+	return graph
+}
+
+func TestGraph_WriteDOT(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	assert.NoError(exportTestGraph().WriteDOT(&buf, nil))
+	assert.Contains(buf.String(), "digraph vape {")
+	assert.Contains(buf.String(), "\"default\" [label=\"default\", shape=box3d, style=\"filled,dashed\"];")
+	assert.Contains(buf.String(), "\"db/create\" [label=\"db/create\"];")
+	assert.Contains(buf.String(), "\"default\" -> \"db/create\";")
+	assert.NotContains(buf.String(), "nothing")
+
+	buf.Reset()
+	assert.NoError(exportTestGraph().WriteDOT(&buf, map[string]UnitState{"db/create": UnitStateApplied}))
+	assert.Contains(buf.String(), "\"db/create\" [label=\"db/create\", fillcolor=\"#b7e1a1\"];")
+}
+
+func TestGraph_WriteMermaid(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	assert.NoError(exportTestGraph().WriteMermaid(&buf, nil))
+	assert.Equal("graph LR\n\tn0[\"db/create\"]\n\tn1[[\"default\"]]\n\tn1 --> n0\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(exportTestGraph().WriteMermaid(&buf, map[string]UnitState{
+		"db/create": UnitStatePending,
+		"default":   UnitStatePending,
+	}))
+	assert.Contains(buf.String(), "\tclassDef pending fill:#ffd28a\n")
+	assert.Contains(buf.String(), "\tclass n0 pending\n\tclass n1 pending\n")
+}
+
+func TestGraph_WriteJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	assert.NoError(exportTestGraph().WriteJSON(&buf, map[string]UnitState{"db/create": UnitStateApplied}))
+
+	var units []ExportedUnit
+	assert.NoError(json.Unmarshal(buf.Bytes(), &units))
+	assert.EqualValues([]ExportedUnit{
+		{Name: "db/create", Description: "Create", Type: UnitTypeMigration, DependsOn: []string{}, State: UnitStateApplied},
+		{Name: "default", Type: UnitTypeVirtualTarget, DependsOn: []string{"db/create"}},
+	}, units)
+}
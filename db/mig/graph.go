@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"github.com/GeertJohan/go.rice"
 	"github.com/restic/restic/src/restic/errors"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 var boxConf = rice.Config{
@@ -19,6 +23,11 @@ var boxConf = rice.Config{
 // Graph represents a set of unit files with dependencies that form a Direct Acyclic Graph.
 type Graph struct {
 	nodes map[string]*Unit
+	vars  map[string]string
+	// environment is the environment units are limited to with their environments field
+	environment string
+	// sources maps unit names to the file or directory they were loaded from to report name collisions
+	sources map[string]string
 }
 
 // NewGraph creates a graph that only contains the "nothing" unit which is used to bootstrap
@@ -45,15 +54,70 @@ func (g *Graph) Load(basepath string) error {
 		if info.IsDir() {
 			return nil
 		}
-		unit, err := loadUnitFile(basepath, path)
+		unit, err := loadUnitFile(basepath, path, g.vars)
 		if err != nil {
 			return err
 		}
-		g.nodes[unit.Name] = unit
-		return nil
+		return g.addUnit(unit, basepath+"/"+filepath.ToSlash(path))
+	})
+}
+
+// LoadFS loads the unit files of a file system into the graph, e.g. an embed.FS, a directory opened with os.DirFS
+// or a fstest.MapFS. Like with Load the paths of the files relative to the root of the file system are the unit
+// names, use fs.Sub to load a subdirectory. A unit with the name of a unit that is already in the graph is an error.
+func (g *Graph) LoadFS(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		unit, err := loadUnitFS(fsys, path, g.vars)
+		if err != nil {
+			return fmt.Errorf("Could not load unit file %s: %s", path, err)
+		}
+		return g.addUnit(unit, path)
 	})
 }
 
+// conflict returns an error if a unit with the given name is already in the graph
+func (g *Graph) conflict(name, source string) error {
+	if _, exists := g.nodes[name]; !exists {
+		return nil
+	}
+	var existing = g.sources[name]
+	if existing == "" {
+		existing = "the built-in units"
+	}
+	return fmt.Errorf("Unit %s from %s conflicts with the unit of the same name from %s", name, source, existing)
+}
+
+// addUnit adds the unit to the graph unless a unit with the same name already exists, source is the file or
+// directory the unit was loaded from
+func (g *Graph) addUnit(unit *Unit, source string) error {
+	err := g.conflict(unit.Name, source)
+	if err != nil {
+		return err
+	}
+	if g.sources == nil {
+		g.sources = map[string]string{}
+	}
+	g.nodes[unit.Name] = unit
+	g.sources[unit.Name] = source
+	return nil
+}
+
+// SetVars sets the variables the SQL of units loaded afterwards is rendered with, e.g. the schema or the owner
+// role of the tables. The schema defaults to public and the size of the varchar columns of the built-in units,
+// varchar_size, to 1024.
+func (g *Graph) SetVars(vars map[string]string) {
+	g.vars = vars
+}
+
+// SetEnvironment sets the environment the graph is migrated in, e.g. "dev" or "production". GetTargetSubgraph skips
+// the units whose environments do not include it.
+func (g *Graph) SetEnvironment(env string) {
+	g.environment = env
+}
+
 // GetUnit returns the specified Unit as a struct
 func (g *Graph) GetUnit(name string) (Unit, error) {
 	if node, ok := g.nodes[name]; ok {
@@ -62,33 +126,221 @@ func (g *Graph) GetUnit(name string) (Unit, error) {
 	return Unit{}, errors.New("Node not found")
 }
 
-// ValidateNodes will check that the graph is properly formed but will not check for cycles.
+// ValidationError contains all problems found while validating a graph
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("Graph has %d problems:\n\t%s", len(e.Problems), strings.Join(e.Problems, "\n\t"))
+}
+
+// ValidateNodes will check that the graph is properly formed and acyclic. All problems are collected
+// and returned as a *ValidationError.
 //
 // A properly formed graph contains nodes where their key in the internal map and their name match,
 // that nodes always have a dependency if they have not been executed and that the dependencies of
-// all nodes exist.
+// all nodes exist. A node may not depend on itself, list a dependency twice or depend on "nothing"
+// alongside other dependencies. If the graph contains targets, every migration must be reachable from
+// at least one of them. Code units need registered code and may not have SQL sections. The transaction
+// mode of a unit must be empty or "none".
 //
-// If this function returns no error then it is guaranteed that the graph is directed and may be acyclic.
+// Cycles are reported with their full path, e.g. "a -> b -> a" if a depends on b and b depends on a.
 func (g *Graph) ValidateNodes() error {
-	for name, node := range g.nodes {
+	var problems = []string{}
+	var names = g.sortedNames()
+	var hasTargets = false
+	for _, name := range names {
+		node := g.nodes[name]
+		if node.Type == UnitTypeVirtualTarget {
+			hasTargets = true
+		}
 		if name != node.Name {
-			return fmt.Errorf("Node Name and Node Key are mismatched")
+			problems = append(problems, fmt.Sprintf("Node Key %s and Node Name %s are mismatched", name, node.Name))
 		}
-		if !node.executed && (node.DependsOn == nil || len(node.DependsOn) == 0) {
-			return fmt.Errorf("Node %s is unexecuted and has no dependencies", node.Name)
+		if node.templateErr != nil {
+			problems = append(problems, fmt.Sprintf("Node %s has an invalid template: %s", name, node.templateErr))
 		}
 		if node.executed {
 			continue
 		}
+		if len(node.DependsOn) == 0 {
+			problems = append(problems, fmt.Sprintf("Node %s is unexecuted and has no dependencies", name))
+		}
+		var seen = map[string]bool{}
 		for _, dependency := range node.DependsOn {
+			if seen[dependency] {
+				problems = append(problems, fmt.Sprintf("Node %s depends on Node %s more than once", name, dependency))
+				continue
+			}
+			seen[dependency] = true
+			if dependency == name {
+				problems = append(problems, fmt.Sprintf("Node %s depends on itself", name))
+				continue
+			}
 			if _, ok := g.nodes[dependency]; !ok {
-				return fmt.Errorf("Node %s depends on Node %s which does not exist", node.Name, dependency)
+				problems = append(problems, fmt.Sprintf("Node %s depends on Node %s which does not exist", name, dependency))
+			}
+		}
+		if seen[nothingUnit.Name] && len(seen) > 1 {
+			problems = append(problems, fmt.Sprintf("Node %s depends on nothing alongside other dependencies", name))
+		}
+		if node.Transaction != TransactionDefault && node.Transaction != TransactionNone {
+			problems = append(problems, fmt.Sprintf("Node %s has unknown transaction mode %s", name, node.Transaction))
+		}
+		if node.Timeout < 0 || node.LockTimeout < 0 {
+			problems = append(problems, fmt.Sprintf("Node %s has a negative timeout", name))
+		}
+		if node.Retries < 0 {
+			problems = append(problems, fmt.Sprintf("Node %s has negative retries %d", name, node.Retries))
+		}
+		if node.Retries > 0 && node.Transaction == TransactionNone {
+			problems = append(problems, fmt.Sprintf("Node %s runs outside of a transaction and cannot be retried, "+
+				"a failed attempt may leave an invalid index behind", name))
+		}
+		if node.Type == UnitTypeCode {
+			if _, ok := lookupCode(name); !ok {
+				problems = append(problems, fmt.Sprintf("Node %s is a code unit but no code is registered for it", name))
+			}
+			if node.SQL != (SQLSection{}) || node.Down != (SQLSection{}) {
+				problems = append(problems, fmt.Sprintf("Node %s is a code unit but has SQL sections", name))
+			}
+		}
+		if node.Type == UnitTypeBatch {
+			if node.Batch.Table == "" {
+				problems = append(problems, fmt.Sprintf("Node %s is a batch unit but has no batch table", name))
+			}
+			if node.Batch.Size < 0 {
+				problems = append(problems, fmt.Sprintf("Node %s has negative batch size %d", name, node.Batch.Size))
 			}
+		} else if node.Batch != (BatchSection{}) {
+			problems = append(problems, fmt.Sprintf("Node %s has a batch section but is no batch unit", name))
+		}
+		for _, squashed := range node.Squashes {
+			if _, ok := g.nodes[squashed]; ok {
+				problems = append(problems,
+					fmt.Sprintf("Node %s squashes %s, which is still on the graph", name, squashed))
+			}
+		}
+		if node.Type == UnitTypeSeed {
+			if node.SQL != (SQLSection{}) || node.Down != (SQLSection{}) {
+				problems = append(problems, fmt.Sprintf("Node %s is a seed unit but has SQL sections", name))
+			}
+		} else if len(node.Seed.Categories) > 0 || len(node.Seed.Groups) > 0 {
+			problems = append(problems, fmt.Sprintf("Node %s has a seed section but is no seed unit", name))
+		}
+	}
+	for _, cycle := range g.findCycles() {
+		problems = append(problems, fmt.Sprintf("Cycle detected: %s", strings.Join(cycle, " -> ")))
+	}
+	if hasTargets {
+		for _, name := range g.findUnreachable() {
+			problems = append(problems, fmt.Sprintf("Node %s is not reachable from any target", name))
 		}
 	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
 	return nil
 }
 
+func (g *Graph) sortedNames() []string {
+	var names = make([]string, 0, len(g.nodes))
+	for name := range g.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pendingNames returns the sorted names of all units that have not been executed except targets and the given unit
+func (g *Graph) pendingNames(except string) []string {
+	var names = []string{}
+	for _, name := range g.sortedNames() {
+		node := g.nodes[name]
+		if !node.executed && node.Type != UnitTypeVirtualTarget && name != except {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// findCycles returns the path of every cycle found by a depth-first search over the dependencies.
+// Each path starts and ends with the same node and every node depends on the next one.
+// Self dependencies and missing nodes are ignored.
+func (g *Graph) findCycles() [][]string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	var state = map[string]int{}
+	var stack = []string{}
+	var cycles = [][]string{}
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = inProgress
+		stack = append(stack, name)
+		for _, dependency := range g.nodes[name].DependsOn {
+			if _, ok := g.nodes[dependency]; !ok || dependency == name {
+				continue
+			}
+			switch state[dependency] {
+			case unvisited:
+				visit(dependency)
+			case inProgress:
+				var start = len(stack) - 1
+				for stack[start] != dependency {
+					start--
+				}
+				var cycle = append([]string{}, stack[start:]...)
+				cycles = append(cycles, append(cycle, dependency))
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+	}
+	for _, name := range g.sortedNames() {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+	return cycles
+}
+
+// findUnreachable returns the sorted names of all unexecuted migrations that are no direct or indirect
+// dependency of any target.
+func (g *Graph) findUnreachable() []string {
+	var reachable = map[string]bool{}
+	var searchSet = []string{}
+	for _, node := range g.nodes {
+		if node.Type == UnitTypeVirtualTarget {
+			searchSet = append(searchSet, node.Name)
+		}
+	}
+	for len(searchSet) > 0 {
+		current := searchSet[0]
+		searchSet = searchSet[1:]
+		node, ok := g.nodes[current]
+		if !ok || reachable[current] {
+			continue
+		}
+		reachable[current] = true
+		searchSet = append(searchSet, node.DependsOn...)
+	}
+	var unreachable = []string{}
+	for _, name := range g.sortedNames() {
+		node := g.nodes[name]
+		if !reachable[name] && !node.executed && node.Type != UnitTypeVirtualTarget {
+			unreachable = append(unreachable, name)
+		}
+	}
+	return unreachable
+}
+
 // CanExecuteNode returns true if the specified node is executeable, if the key is not present or the node cannot
 // be executed, it return false
 func (g *Graph) CanExecuteNode(name string) bool {
@@ -157,6 +409,10 @@ func (g *Graph) GetAllRunnableNodes() []string {
 // GetTargetSubgraph will take a target and create a graph that only contains nodes
 // that are direct or indirect dependencies of that target. If a unit is not reachable from
 // the current target, it will not be included in the subgraph.
+//
+// Units that are not part of the environment of the graph are marked as skipped. The runner passes over them in
+// the order of the graph without executing them, units depending on them are executed as usual. The subgraph holds
+// copies of the units, marking units as executed or skipped on it leaves the units of g untouched.
 func (g *Graph) GetTargetSubgraph(targetName string) (*Graph, error) {
 	target, ok := g.nodes[targetName]
 	if !ok {
@@ -165,9 +421,10 @@ func (g *Graph) GetTargetSubgraph(targetName string) (*Graph, error) {
 	if target.Type != UnitTypeVirtualTarget {
 		return nil, fmt.Errorf("Node %s is a Migration not a target", targetName)
 	}
+	var nothing, targetCopy = nothingUnit, *target
 	var newGraph = &Graph{nodes: map[string]*Unit{
-		target.Name:      target,
-		nothingUnit.Name: &nothingUnit,
+		target.Name:      &targetCopy,
+		nothingUnit.Name: &nothing,
 	}}
 	var searchSet = target.DependsOn
 	for len(searchSet) > 0 {
@@ -180,9 +437,13 @@ func (g *Graph) GetTargetSubgraph(targetName string) (*Graph, error) {
 		} else {
 			searchSet = []string{}
 		}
-		newGraph.nodes[node.Name] = node
+		unit := *node
+		newGraph.nodes[node.Name] = &unit
 		searchSet = append(searchSet, node.DependsOnWithoutNothing()...)
 	}
+	for _, node := range newGraph.nodes {
+		node.skipped = !node.InEnvironment(g.environment)
+	}
 	return newGraph, newGraph.ValidateNodes()
 }
 
@@ -197,3 +458,112 @@ func (g *Graph) MarkNodesRun(names ...string) error {
 	}
 	return nil
 }
+
+// unmarkNodes marks the given nodes as not executed, e.g. after the transaction they were executed in failed
+func (g *Graph) unmarkNodes(names ...string) {
+	for _, name := range names {
+		if node, ok := g.nodes[name]; ok {
+			node.executed = false
+		}
+	}
+}
+
+// GetDependencies returns the names of all direct and indirect dependencies of a node, including the node itself.
+func (g *Graph) GetDependencies(name string) (map[string]bool, error) {
+	if _, ok := g.nodes[name]; !ok {
+		return nil, fmt.Errorf("Node %s not found on graph", name)
+	}
+	var found = map[string]bool{}
+	var searchSet = []string{name}
+	for len(searchSet) > 0 {
+		current := searchSet[0]
+		searchSet = searchSet[1:]
+		if found[current] {
+			continue
+		}
+		node, ok := g.nodes[current]
+		if !ok {
+			return nil, fmt.Errorf("Node %s depends on Node %s which does not exist", name, current)
+		}
+		found[current] = true
+		searchSet = append(searchSet, node.DependsOn...)
+	}
+	return found, nil
+}
+
+// GetExecutionOrder returns all nodes of the graph in an order in which they can be executed, ignoring
+// whether they have been executed already. Nodes that could run in the same round are sorted by name so
+// the order is stable.
+func (g *Graph) GetExecutionOrder() ([]string, error) {
+	var done = map[string]bool{}
+	var order = []string{}
+	for len(order) < len(g.nodes) {
+		var round = []string{}
+		for name, node := range g.nodes {
+			if done[name] {
+				continue
+			}
+			runnable := true
+			for _, dep := range node.DependsOn {
+				if !done[dep] {
+					runnable = false
+					break
+				}
+			}
+			if runnable {
+				round = append(round, name)
+			}
+		}
+		if len(round) == 0 {
+			return nil, fmt.Errorf("Graph contains a cycle or missing dependency, %d nodes cannot be ordered", len(g.nodes)-len(order))
+		}
+		sort.Strings(round)
+		for _, name := range round {
+			done[name] = true
+		}
+		order = append(order, round...)
+	}
+	return order, nil
+}
+
+// GetRollbackOrder returns the executed units that have to be reverted to bring the database back to the
+// state right after the specified node was executed. Everything that is not a direct or indirect dependency of
+// the node is reverted, dependents always come before their dependencies.
+//
+// Executed units that have been squashed into a unit of the graph are covered by that unit, it is reverted in
+// their place and removes them from the migration table. Other units that have been executed but are not present
+// on the graph cause an error since their down section is unknown.
+func (g *Graph) GetRollbackOrder(name string, executed []string) ([]string, error) {
+	keep, err := g.GetDependencies(name)
+	if err != nil {
+		return nil, err
+	}
+	var squashedBy = map[string]string{}
+	for _, node := range g.nodes {
+		for _, squashed := range node.Squashes {
+			squashedBy[squashed] = node.Name
+		}
+	}
+	var revert = map[string]bool{}
+	for _, v := range executed {
+		if _, ok := g.nodes[v]; !ok && squashedBy[v] != "" {
+			v = squashedBy[v]
+		} else if !ok {
+			return nil, fmt.Errorf("Node %s has been executed but is not on the graph", v)
+		}
+		if !keep[v] {
+			revert[v] = true
+		}
+	}
+	order, err := g.GetExecutionOrder()
+	if err != nil {
+		return nil, err
+	}
+	var rollback = []string{}
+	for i := len(order) - 1; i >= 0; i-- {
+		if revert[order[i]] {
+			rollback = append(rollback, order[i])
+		}
+	}
+	return rollback, nil
+}
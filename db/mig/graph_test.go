@@ -4,6 +4,8 @@ import (
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestMigrations(t *testing.T) {
@@ -17,8 +19,15 @@ func TestMigrations(t *testing.T) {
 
 	assert.NoError(graph.ValidateNodes())
 
+	for name, node := range graph.nodes {
+		for _, dialect := range []string{DialectPostgres, DialectSQLite, DialectMySQL} {
+			assert.True(node.SupportsDialect(dialect), "Unit %s has no %s section", name, dialect)
+			assert.True(node.IsReversible(dialect), "Unit %s has no %s down section", name, dialect)
+		}
+	}
+
 	oldLoad := loadUnitFile
-	loadUnitFile = func(string, string) (*Unit, error) {
+	loadUnitFile = func(string, string, map[string]string) (*Unit, error) {
 		return nil, errors.New("Test")
 	}
 
@@ -27,6 +36,35 @@ func TestMigrations(t *testing.T) {
 	loadUnitFile = oldLoad
 }
 
+func TestGraph_LoadFS(t *testing.T) {
+	assert := assert.New(t)
+
+	plugin := fstest.MapFS{
+		"plugin/tables.yaml": {Data: []byte("depends_on: [db_setup]\nsql:\n  postgres: CREATE TABLE {{.schema}}.plugin ();\n")},
+		"plugin.yaml":        {Data: []byte("type: target\ndepends_on: [plugin/tables]\n")},
+	}
+
+	graph := NewGraph()
+	graph.SetVars(map[string]string{"schema": "forum"})
+	assert.NoError(graph.Load("arke"))
+	assert.NoError(graph.LoadFS(plugin))
+	assert.NoError(graph.ValidateNodes())
+	unit, err := graph.GetUnit("plugin/tables")
+	assert.NoError(err)
+	assert.Equal("CREATE TABLE forum.plugin ();", unit.SQL.Postgres)
+	assert.EqualValues([]string{"db_setup"}, unit.DependsOn)
+
+	assert.EqualError(graph.LoadFS(plugin),
+		"Unit plugin/tables from plugin/tables.yaml conflicts with the unit of the same name from plugin/tables.yaml")
+	assert.EqualError(graph.LoadFS(fstest.MapFS{"default.yaml": {Data: []byte("type: target\n")}}),
+		"Unit default from default.yaml conflicts with the unit of the same name from arke/default.yaml")
+	assert.EqualError(graph.LoadFS(fstest.MapFS{"nothing.yaml": {Data: []byte("type: target\n")}}),
+		"Unit nothing from nothing.yaml conflicts with the unit of the same name from the built-in units")
+	assert.EqualError(graph.LoadFS(fstest.MapFS{"README.md": {Data: []byte("Plugin units")}}),
+		"Could not load unit file README.md: Unit file must have file extension .yaml")
+	assert.Contains(graph.Load("arke").Error(), "conflicts with the unit of the same name from arke/")
+}
+
 func TestGraph_GetUnit(t *testing.T) {
 	assert := assert.New(t)
 
@@ -86,6 +124,62 @@ func TestGraph_ValidateNodes(t *testing.T) {
 
 }
 
+func TestGraph_ValidateNodes_Problems(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+
+	graph.nodes["default"] = &Unit{
+		Name:      "default",
+		DependsOn: []string{"a", "d"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["a"] = &Unit{
+		Name:      "a",
+		DependsOn: []string{"b"},
+	}
+
+	graph.nodes["b"] = &Unit{
+		Name:      "b",
+		DependsOn: []string{"c"},
+	}
+
+	graph.nodes["c"] = &Unit{
+		Name:      "c",
+		DependsOn: []string{"a"},
+	}
+
+	graph.nodes["d"] = &Unit{
+		Name:      "d",
+		DependsOn: []string{"d", "nothing", "nothing"},
+	}
+
+	graph.nodes["unreachable"] = &Unit{
+		Name:      "unreachable",
+		DependsOn: []string{"nothing"},
+	}
+
+	err := graph.ValidateNodes()
+	assert.Error(err)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(ok)
+	assert.EqualValues([]string{
+		"Node d depends on itself",
+		"Node d depends on Node nothing more than once",
+		"Node d depends on nothing alongside other dependencies",
+		"Cycle detected: a -> b -> c -> a",
+		"Node unreachable is not reachable from any target",
+	}, validationErr.Problems)
+	assert.Contains(err.Error(), "Graph has 5 problems")
+
+	delete(graph.nodes, "unreachable")
+	graph.nodes["c"].DependsOn = []string{"nothing"}
+	graph.nodes["d"].DependsOn = []string{"nothing"}
+
+	assert.NoError(graph.ValidateNodes())
+}
+
 func TestGraph_CanExecuteNode(t *testing.T) {
 	assert := assert.New(t)
 
@@ -204,7 +298,7 @@ func TestGraph_GetTargetSubgraph(t *testing.T) {
 
 	graph.nodes["default2"] = &Unit{
 		Name:      "default2",
-		DependsOn: []string{"default3", "default4", "default3"},
+		DependsOn: []string{"default3", "default4"},
 		Type:      UnitTypeVirtualTarget,
 	}
 
@@ -247,6 +341,53 @@ func TestGraph_GetTargetSubgraph(t *testing.T) {
 	_, err = graph.GetTargetSubgraph("target-faulty-dep")
 
 	assert.Error(err)
+
+	graph.nodes["default2"].DependsOn = []string{"default3", "default4", "default3"}
+
+	_, err = graph.GetTargetSubgraph("default2")
+
+	assert.Error(err, "Duplicate dependencies must be reported")
+}
+
+func TestGraph_GetTargetSubgraph_Environment(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["default"] = &Unit{Name: "default", DependsOn: []string{"seed"}, Type: UnitTypeVirtualTarget}
+	graph.nodes["seed"] = &Unit{Name: "seed", DependsOn: []string{"create"}, Type: UnitTypeMigration,
+		Environments: []string{"dev"}}
+	graph.nodes["create"] = &Unit{Name: "create", DependsOn: []string{"nothing"}, Type: UnitTypeMigration}
+
+	graph.SetEnvironment("dev")
+	subGraph, err := graph.GetTargetSubgraph("default")
+	assert.NoError(err)
+	assert.Equal(3, subGraph.RemainingSize())
+
+	graph.SetEnvironment("production")
+	subGraph, err = graph.GetTargetSubgraph("default")
+	assert.NoError(err)
+	unit, err := subGraph.GetUnit("seed")
+	assert.NoError(err)
+	assert.True(unit.IsSkipped())
+	unit, err = subGraph.GetUnit("create")
+	assert.NoError(err)
+	assert.False(unit.IsSkipped())
+
+	plan, err := subGraph.GetPlan()
+	assert.NoError(err)
+	assert.Len(plan, 2)
+	assert.Equal("create", plan[0][0].Name)
+	assert.Equal("default", plan[1][0].Name)
+
+	// The units of the graph are left untouched, a subgraph for another environment does not see the skip
+	assert.False(graph.nodes["seed"].IsSkipped())
+	assert.NoError(subGraph.MarkNodesRun("create"))
+	assert.False(graph.nodes["create"].executed)
+	graph.SetEnvironment("dev")
+	devGraph, err := graph.GetTargetSubgraph("default")
+	assert.NoError(err)
+	assert.False(devGraph.nodes["seed"].IsSkipped())
+	assert.True(subGraph.nodes["seed"].IsSkipped())
 }
 
 func TestGraph_MarkNodesRun(t *testing.T) {
@@ -286,3 +427,202 @@ func TestGraph_MarkNodesRun(t *testing.T) {
 
 	assert.True(graph.nodes["default4"].executed)
 }
+
+func TestGraph_GetExecutionOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+
+	graph.nodes["default"] = &Unit{
+		Name:      "default",
+		DependsOn: []string{"default2", "default3"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["default2"] = &Unit{
+		Name:      "default2",
+		DependsOn: []string{"nothing"},
+	}
+
+	graph.nodes["default3"] = &Unit{
+		Name:      "default3",
+		DependsOn: []string{"nothing"},
+	}
+
+	order, err := graph.GetExecutionOrder()
+	assert.NoError(err)
+	assert.EqualValues([]string{"nothing", "default2", "default3", "default"}, order)
+
+	graph.nodes["default2"].DependsOn = []string{"default"}
+
+	_, err = graph.GetExecutionOrder()
+	assert.Error(err)
+}
+
+func TestGraph_GetRollbackOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+
+	graph.nodes["default"] = &Unit{
+		Name:      "default",
+		DependsOn: []string{"default2", "default4"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["default2"] = &Unit{
+		Name:      "default2",
+		DependsOn: []string{"default3"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["default3"] = &Unit{
+		Name:      "default3",
+		DependsOn: []string{"nothing"},
+	}
+
+	graph.nodes["default4"] = &Unit{
+		Name:      "default4",
+		DependsOn: []string{"default3"},
+	}
+
+	graph.nodes["default5"] = &Unit{
+		Name:      "default5",
+		DependsOn: []string{"default4"},
+	}
+
+	executed := []string{"default3", "default4", "default5"}
+
+	order, err := graph.GetRollbackOrder("default2", executed)
+	assert.NoError(err)
+	assert.EqualValues([]string{"default5", "default4"}, order)
+
+	order, err = graph.GetRollbackOrder("nothing", executed)
+	assert.NoError(err)
+	assert.EqualValues([]string{"default5", "default4", "default3"}, order)
+
+	order, err = graph.GetRollbackOrder("default5", executed)
+	assert.NoError(err)
+	assert.Empty(order)
+
+	_, err = graph.GetRollbackOrder("does-not-exist", executed)
+	assert.Error(err)
+
+	_, err = graph.GetRollbackOrder("default2", append(executed, "not-on-graph"))
+	assert.Error(err)
+
+	// Squashed units are covered by the unit squashing them, even if it has not been recorded yet
+	graph.nodes["default5"].Squashes = []string{"old1", "old2"}
+	order, err = graph.GetRollbackOrder("default2", []string{"default3", "default4", "old1", "old2"})
+	assert.NoError(err)
+	assert.EqualValues([]string{"default5", "default4"}, order)
+	order, err = graph.GetRollbackOrder("default5", []string{"default3", "default4", "old1", "old2"})
+	assert.NoError(err)
+	assert.Empty(order)
+}
+
+func TestGraph_pendingNames(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes = map[string]*Unit{
+		"nothing": &nothingUnit,
+		"unit1":   &Unit{Name: "unit1", Type: UnitTypeMigration, DependsOn: []string{"nothing"}, executed: true},
+		"unit2":   &Unit{Name: "unit2", Type: UnitTypeMigration, DependsOn: []string{"unit1"}},
+		"unit3":   &Unit{Name: "unit3", Type: UnitTypeMigration, DependsOn: []string{"unit1"}},
+		"target":  &Unit{Name: "target", Type: UnitTypeVirtualTarget, DependsOn: []string{"unit2", "unit3"}},
+	}
+	assert.EqualValues([]string{"unit3"}, graph.pendingNames("unit2"))
+}
+
+func TestGraph_ValidateNodes_Transaction(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["index"] = &Unit{Name: "index", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		Transaction: TransactionNone}
+	assert.NoError(graph.ValidateNodes())
+
+	graph.nodes["index"].Transaction = "never"
+	err := graph.ValidateNodes()
+	assert.EqualError(err, "Node index has unknown transaction mode never")
+}
+
+func TestGraph_unmarkNodes(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["unit"] = &Unit{Name: "unit", Type: UnitTypeMigration, DependsOn: []string{"nothing"}}
+	assert.NoError(graph.MarkNodesRun("unit"))
+	assert.Equal(0, graph.RemainingSize())
+	graph.unmarkNodes("unit", "unknown")
+	assert.Equal(1, graph.RemainingSize())
+}
+
+func TestGraph_ValidateNodes_Batch(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["backfill"] = &Unit{Name: "backfill", Type: UnitTypeBatch, DependsOn: []string{"nothing"},
+		Batch: BatchSection{Table: "replies"}}
+	assert.NoError(graph.ValidateNodes())
+
+	graph.nodes["backfill"].Batch = BatchSection{}
+	assert.EqualError(graph.ValidateNodes(), "Node backfill is a batch unit but has no batch table")
+
+	graph.nodes["backfill"].Batch = BatchSection{Table: "replies", Size: -1}
+	assert.EqualError(graph.ValidateNodes(), "Node backfill has negative batch size -1")
+
+	graph.nodes["backfill"].Type = UnitTypeMigration
+	assert.EqualError(graph.ValidateNodes(), "Node backfill has a batch section but is no batch unit")
+}
+
+func TestGraph_ValidateNodes_Seed(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["seed"] = &Unit{Name: "seed", Type: UnitTypeSeed, DependsOn: []string{"nothing"},
+		Seed: SeedSection{Groups: []SeedGroup{{Name: "admin"}}}}
+	assert.NoError(graph.ValidateNodes())
+
+	graph.nodes["seed"].SQL = SQLSection{Postgres: "SELECT 1;"}
+	assert.EqualError(graph.ValidateNodes(), "Node seed is a seed unit but has SQL sections")
+
+	graph.nodes["seed"].Type = UnitTypeMigration
+	assert.EqualError(graph.ValidateNodes(), "Node seed has a seed section but is no seed unit")
+}
+
+func TestGraph_ValidateNodes_Squashes(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["baseline/v1"] = &Unit{Name: "baseline/v1", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		Squashes: []string{"setup/create_test"}, SQL: SQLSection{SQLite: "CREATE TABLE test (id integer);"}}
+	assert.NoError(graph.ValidateNodes())
+
+	graph.nodes["setup/create_test"] = &Unit{Name: "setup/create_test", Type: UnitTypeMigration,
+		DependsOn: []string{"nothing"}, SQL: SQLSection{SQLite: "CREATE TABLE test (id integer);"}}
+	assert.EqualError(graph.ValidateNodes(),
+		"Node baseline/v1 squashes setup/create_test, which is still on the graph")
+}
+
+func TestGraph_ValidateNodes_Timeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["unit"] = &Unit{Name: "unit", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		Timeout: time.Minute, LockTimeout: time.Second, Retries: 3}
+	assert.NoError(graph.ValidateNodes())
+
+	graph.nodes["unit"].LockTimeout = -time.Second
+	assert.EqualError(graph.ValidateNodes(), "Node unit has a negative timeout")
+
+	graph.nodes["unit"].LockTimeout = 0
+	graph.nodes["unit"].Retries = -1
+	assert.EqualError(graph.ValidateNodes(), "Node unit has negative retries -1")
+
+	graph.nodes["unit"].Retries = 1
+	graph.nodes["unit"].Transaction = TransactionNone
+	assert.EqualError(graph.ValidateNodes(), "Node unit runs outside of a transaction and cannot be retried, "+
+		"a failed attempt may leave an invalid index behind")
+}
@@ -0,0 +1,258 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"database/sql"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// AttemptResult is the outcome of an attempt to execute a unit
+type AttemptResult string
+
+const (
+	// AttemptSucceeded is the result of an attempt that executed the unit and was committed
+	AttemptSucceeded AttemptResult = "succeeded"
+	// AttemptFailed is the result of an attempt that failed, the unit may be retried by a later attempt
+	AttemptFailed AttemptResult = "failed"
+	// AttemptRolledBack is the result of an attempt that executed the unit, but whose transaction was rolled back
+	// because a later unit of the transaction failed
+	AttemptRolledBack AttemptResult = "rolled_back"
+)
+
+// Attempt is an attempt to execute a unit as recorded in the history table. Every retry of a unit is an attempt
+// of its own.
+type Attempt struct {
+	// ID is assigned by the database, later attempts have larger IDs
+	ID     int64  `json:"id"`
+	Unit   string `json:"unit"`
+	Target string `json:"target"`
+	// Number counts the attempts of the unit in a migration, starting at 1
+	Number    int           `json:"attempt"`
+	Result    AttemptResult `json:"result"`
+	Error     string        `json:"error,omitempty"`
+	StartedOn time.Time     `json:"started_on"`
+	// Duration is the time the attempt took. The history table keeps it in milliseconds, JSON encodes it in
+	// nanoseconds.
+	Duration time.Duration `json:"duration_ns"`
+	// Hostname is the name of the host the migration ran on
+	Hostname string `json:"hostname"`
+	// Operator is the name of the user who ran the migration
+	Operator string `json:"operator"`
+	// Version is the version of the binary that ran the migration
+	Version string `json:"version"`
+}
+
+// HistoryFilter selects the attempts returned by GetHistory
+type HistoryFilter struct {
+	// Unit limits the attempts to the unit of this name if set
+	Unit string
+	// Failed limits the attempts to failed attempts
+	Failed bool
+	// Limit is the maximum number of attempts, all attempts are returned if it is zero
+	Limit int
+}
+
+// addAttempt records an attempt to execute the unit as soon as it has finished, outside of the migration
+// transaction. On SQLite, which allows a single writer, it is kept until the transaction or session has ended.
+// It is safe for concurrent use, failing to record the attempt is logged but does not fail the migration.
+func (r *Runner) addAttempt(unit Unit, number int, start time.Time, err error) {
+	var attempt = Attempt{
+		Unit:      unit.Name,
+		Target:    r.Target,
+		Number:    number,
+		Result:    AttemptSucceeded,
+		StartedOn: start,
+		Duration:  time.Since(start),
+		Hostname:  r.hostname,
+		Operator:  r.operator,
+		Version:   r.Version,
+	}
+	if err != nil {
+		attempt.Result = AttemptFailed
+		attempt.Error = err.Error()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.attempts = append(r.attempts, attempt)
+	if !writesHistoryLater(r.dialect) {
+		r.writeHistory()
+	}
+}
+
+// rollBackAttempts marks the succeeded attempts since the attempt with the given index as rolled back, it is
+// called when their transaction has been rolled back
+func (r *Runner) rollBackAttempts(first int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ids = []int64{}
+	for i := first; i < len(r.attempts); i++ {
+		attempt := &r.attempts[i]
+		if attempt.Result != AttemptSucceeded {
+			continue
+		}
+		attempt.Result = AttemptRolledBack
+		if i < r.written && attempt.ID != 0 {
+			ids = append(ids, attempt.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	err := r.dialect.MarkAttemptsRolledBack(ids)
+	if err != nil {
+		r.log.Warn("Could not record rolled back attempts in the migration history", zap.Error(err))
+	}
+}
+
+// recordHistory records the attempts that have not been recorded yet, it is called when a transaction has ended
+func (r *Runner) recordHistory() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writeHistory()
+}
+
+// writeHistory puts the attempts that have not been recorded yet into the history table, r.mutex must be held
+func (r *Runner) writeHistory() {
+	if r.written == len(r.attempts) {
+		return
+	}
+	pending := r.attempts[r.written:]
+	r.written = len(r.attempts)
+	err := r.dialect.RecordAttempts(pending)
+	if err != nil {
+		r.log.Warn("Could not record migration history", zap.Error(err))
+	}
+}
+
+// singleWriterDialect is implemented by dialects whose database allows a single writer at a time, which is the
+// migration transaction or session
+type singleWriterDialect interface {
+	singleWriter()
+}
+
+// writesHistoryLater returns true if the attempts cannot be recorded while the migration transaction or session
+// is open
+func writesHistoryLater(dialect Dialect) bool {
+	_, ok := dialect.(singleWriterDialect)
+	return ok
+}
+
+// recordAttempts inserts the attempts into the history table in a single transaction and sets their IDs, the query
+// receives the fields of an attempt in the order of the history table. If returning is set, the query returns the
+// ID, otherwise it is taken from the result.
+func recordAttempts(db minimalDB, query string, returning bool, attempts []Attempt) error {
+	if len(attempts) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := range attempts {
+		a := &attempts[i]
+		var args = []interface{}{a.Unit, a.Target, a.Number, string(a.Result), a.Error, a.StartedOn.UTC(),
+			int64(a.Duration / time.Millisecond), a.Hostname, a.Operator, a.Version}
+		if returning {
+			err = tx.QueryRow(query, args...).Scan(&a.ID)
+		} else {
+			var res sql.Result
+			res, err = tx.Exec(query, args...)
+			if err == nil {
+				a.ID, err = res.LastInsertId()
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// setAttemptResult sets the result of the attempts with the given IDs in a single transaction, the query
+// receives the result and the ID
+func setAttemptResult(db minimalDB, query string, ids []int64, result AttemptResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err = tx.Exec(query, string(result), id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// historyQuery builds the query selecting the attempts of the filter, newest first. placeholder returns the
+// placeholder of the nth parameter of the dialect.
+func historyQuery(filter HistoryFilter, placeholder func(n int) string) (string, []interface{}) {
+	var conditions = []string{}
+	var args = []interface{}{}
+	if filter.Unit != "" {
+		args = append(args, filter.Unit)
+		conditions = append(conditions, "name = "+placeholder(len(args)))
+	}
+	if filter.Failed {
+		args = append(args, string(AttemptFailed))
+		conditions = append(conditions, "result = "+placeholder(len(args)))
+	}
+	query := `SELECT id, name, target, attempt, result, error, started_on, duration_ms, hostname, operator, version
+FROM vape_history`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT " + placeholder(len(args))
+	}
+	return query + ";", args
+}
+
+// getHistory returns the attempts selected by the filter, newest first
+func getHistory(db minimalDB, filter HistoryFilter, placeholder func(n int) string) ([]Attempt, error) {
+	query, args := historyQuery(filter, placeholder)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attempts = []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		var durationMs int64
+		err = rows.Scan(&a.ID, &a.Unit, &a.Target, &a.Number, &a.Result, &a.Error, &a.StartedOn, &durationMs,
+			&a.Hostname, &a.Operator, &a.Version)
+		if err != nil {
+			return nil, err
+		}
+		a.Duration = time.Duration(durationMs) * time.Millisecond
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// pgPlaceholder returns the Postgres placeholder $n
+func pgPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// questionPlaceholder returns the placeholder ? of MySQL and SQLite
+func questionPlaceholder(int) string {
+	return "?"
+}
+
+// currentOperator returns the name of the user running the process
+func currentOperator() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
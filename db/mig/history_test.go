@@ -0,0 +1,98 @@
+package mig
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// historyDialect records the attempts passed to RecordAttempts and the IDs passed to MarkAttemptsRolledBack
+type historyDialect struct {
+	Dialect
+	attempts   []Attempt
+	rolledBack []int64
+}
+
+func (d *historyDialect) RecordAttempts(attempts []Attempt) error {
+	for i := range attempts {
+		attempts[i].ID = int64(len(d.attempts) + 1)
+		d.attempts = append(d.attempts, attempts[i])
+	}
+	return nil
+}
+
+func (d *historyDialect) MarkAttemptsRolledBack(ids []int64) error {
+	d.rolledBack = append(d.rolledBack, ids...)
+	return nil
+}
+
+// noHistoryDB returns a database mock without a history table, failing to record the history is only logged
+func noHistoryDB() *minimalDBMock {
+	db := new(minimalDBMock)
+	db.On("Begin").Return(nil, errors.New("No history table"))
+	return db
+}
+
+func TestRunner_addAttempt(t *testing.T) {
+	assert := require.New(t)
+
+	dialect := &historyDialect{}
+	runner := NewRunner(dialect, nil)
+	runner.Target = "default"
+	runner.Version = "1.2.3"
+	start := time.Now()
+	runner.addAttempt(Unit{Name: "committed"}, 1, start, nil)
+
+	// Attempts are recorded as soon as they have finished
+	assert.Len(dialect.attempts, 1)
+	first := len(runner.attempts)
+	runner.addAttempt(Unit{Name: "rolled_back"}, 1, start, nil)
+	runner.addAttempt(Unit{Name: "failed"}, 1, start, errors.New("Test error"))
+	assert.Len(dialect.attempts, 3)
+	runner.rollBackAttempts(first)
+	runner.recordHistory()
+
+	assert.Len(dialect.attempts, 3)
+	assert.Equal(AttemptSucceeded, dialect.attempts[0].Result)
+	assert.Equal(AttemptSucceeded, dialect.attempts[1].Result)
+	assert.EqualValues([]int64{2}, dialect.rolledBack)
+	assert.Equal(AttemptRolledBack, runner.attempts[1].Result)
+	assert.Equal(AttemptFailed, dialect.attempts[2].Result)
+	assert.Equal("Test error", dialect.attempts[2].Error)
+	for _, attempt := range dialect.attempts {
+		assert.Equal("default", attempt.Target)
+		assert.Equal("1.2.3", attempt.Version)
+		assert.Equal(start, attempt.StartedOn)
+	}
+
+	// Migrations without rolled back attempts mark nothing
+	dialect.rolledBack = nil
+	runner.rollBackAttempts(len(runner.attempts))
+	assert.Nil(dialect.rolledBack)
+
+	// SQLite keeps the attempts until the migration transaction has ended
+	runner = NewRunner(OpenFromSQLiteConn(nil), nil)
+	runner.addAttempt(Unit{Name: "kept"}, 1, start, nil)
+	assert.Len(runner.attempts, 1)
+	assert.Equal(0, runner.written)
+	assert.False(writesHistoryLater(OpenFromPGConn(nil)))
+	assert.False(writesHistoryLater(OpenFromMySQLConn(nil)))
+}
+
+func TestHistoryQuery(t *testing.T) {
+	assert := require.New(t)
+
+	query, args := historyQuery(HistoryFilter{}, pgPlaceholder)
+	assert.Equal(`SELECT id, name, target, attempt, result, error, started_on, duration_ms, hostname, operator, version
+FROM vape_history ORDER BY id DESC;`, query)
+	assert.Empty(args)
+
+	query, args = historyQuery(HistoryFilter{Unit: "unit", Failed: true, Limit: 10}, pgPlaceholder)
+	assert.Contains(query, "FROM vape_history WHERE name = $1 AND result = $2 ORDER BY id DESC LIMIT $3;")
+	assert.EqualValues([]interface{}{"unit", "failed", 10}, args)
+
+	query, args = historyQuery(HistoryFilter{Failed: true, Limit: 10}, questionPlaceholder)
+	assert.Contains(query, "FROM vape_history WHERE result = ? ORDER BY id DESC LIMIT ?;")
+	assert.EqualValues([]interface{}{"failed", 10}, args)
+}
@@ -0,0 +1,145 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// LintUnit checks the contents of a unit file more strictly than loading it. Keys that are not part of the unit
+// format, unknown unit types, migration and batch units without SQL, seed units without rows and targets carrying
+// SQL are reported.
+// The parsed unit is returned unless the file could not be parsed at all.
+func LintUnit(filename string, dat []byte) (*Unit, []string) {
+	var name = strings.TrimSuffix(filename, ".yaml")
+	if !strings.HasSuffix(filename, ".yaml") {
+		return nil, []string{fmt.Sprintf("%s: Unit file must have file extension .yaml", filename)}
+	}
+	unit, err := parseUnit(filename, dat)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("%s: %s", name, err)}
+	}
+
+	var problems = []string{}
+	var raw interface{}
+	if err = yaml.Unmarshal(dat, &raw); err == nil {
+		for _, key := range unknownKeys("", raw, reflect.TypeOf(Unit{})) {
+			problems = append(problems, fmt.Sprintf("%s: Unknown key %s", name, key))
+		}
+	}
+
+	var hasSQL = unit.SQL != (SQLSection{})
+	switch unit.Type {
+	case UnitTypeMigration, UnitTypeBatch:
+		if !hasSQL {
+			problems = append(problems, fmt.Sprintf("%s: Unit has no SQL", name))
+		}
+	case UnitTypeVirtualTarget:
+		if hasSQL || unit.Down != (SQLSection{}) || unit.RunIf != (SQLSection{}) {
+			problems = append(problems, fmt.Sprintf("%s: Target has SQL sections", name))
+		}
+		if unit.Transaction != TransactionDefault || unit.Batch != (BatchSection{}) || unit.Timeout != 0 ||
+			unit.LockTimeout != 0 || unit.Retries != 0 {
+			problems = append(problems, fmt.Sprintf("%s: Target has migration settings", name))
+		}
+	case UnitTypeSeed:
+		if len(unit.Seed.Categories) == 0 && len(unit.Seed.Groups) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: Seed unit has no rows", name))
+		}
+	case UnitTypeCode:
+	default:
+		problems = append(problems, fmt.Sprintf("%s: Unknown unit type %s", name, unit.Type))
+	}
+	return unit, problems
+}
+
+// LintDir checks all unit files in the directory with LintUnit and validates the graph they form, see
+// Graph.ValidateNodes. The SQL of the units is rendered with the given variables. Problems are returned sorted by
+// unit, the error is only set if the directory could not be read.
+func LintDir(dir string, vars map[string]string) ([]string, error) {
+	_, problems, err := loadDir(dir, vars)
+	if err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// loadDir lints the unit files in a directory of the file system and loads them into a graph rendered with the
+// variables. The problems found by LintUnit and by validating the graph are returned.
+func loadDir(dir string, vars map[string]string) (*Graph, []string, error) {
+	var graph = NewGraph()
+	var problems = []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		filename, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		unit, unitProblems := LintUnit(filepath.ToSlash(filename), dat)
+		problems = append(problems, unitProblems...)
+		if unit != nil {
+			unit.render(vars)
+			graph.nodes[unit.Name] = unit
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(problems)
+	if err := graph.ValidateNodes(); err != nil {
+		if validationErr, ok := err.(*ValidationError); ok {
+			problems = append(problems, validationErr.Problems...)
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+	return graph, problems, nil
+}
+
+// unknownKeys returns the keys of the parsed YAML value that have no matching field in the given struct type,
+// nested keys are joined with dots and the items of lists are numbered, e.g. seed.groups[0].name
+func unknownKeys(prefix string, raw interface{}, t reflect.Type) []string {
+	values, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	var fields = map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag != "" && tag != "-" {
+			fields[tag] = t.Field(i).Type
+		}
+	}
+	var unknown = []string{}
+	for key, value := range values {
+		name := fmt.Sprint(key)
+		fieldType, ok := fields[name]
+		if !ok {
+			unknown = append(unknown, prefix+name)
+			continue
+		}
+		if fieldType.Kind() == reflect.Struct {
+			unknown = append(unknown, unknownKeys(prefix+name+".", value, fieldType)...)
+		}
+		if items, ok := value.([]interface{}); ok && fieldType.Kind() == reflect.Slice &&
+			fieldType.Elem().Kind() == reflect.Struct {
+			for i, item := range items {
+				unknown = append(unknown, unknownKeys(fmt.Sprintf("%s%s[%d].", prefix, name, i), item, fieldType.Elem())...)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,137 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLintUnit(t *testing.T) {
+	assert := require.New(t)
+
+	unit, problems := LintUnit("test/unit.yaml", []byte(`description: Test
+depends_on:
+- nothing
+sqll:
+  postgres: SELECT 1;
+down:
+  postgress: SELECT 1;
+`))
+	assert.NotNil(unit)
+	assert.EqualValues([]string{
+		"test/unit: Unknown key down.postgress",
+		"test/unit: Unknown key sqll",
+		"test/unit: Unit has no SQL",
+	}, problems)
+
+	_, problems = LintUnit("test/target.yaml", []byte(`type: target
+depends_on:
+- nothing
+transaction: none
+sql:
+  postgres: SELECT 1;
+`))
+	assert.EqualValues([]string{
+		"test/target: Target has SQL sections",
+		"test/target: Target has migration settings",
+	}, problems)
+
+	_, problems = LintUnit("test/target.yaml", []byte(`type: target
+depends_on:
+- nothing
+environments: [dev]
+run_if:
+  sqlite: SELECT 1;
+`))
+	assert.EqualValues([]string{"test/target: Target has SQL sections"}, problems)
+
+	unit, problems = LintUnit("test/unit.yaml", []byte(`depends_on:
+- nothing
+timeout: 1m30s
+lock_timeout: 500ms
+retries: 3
+environments: [dev, staging]
+run_if:
+  postgres: SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'pg_trgm');
+sql:
+  postgres: ALTER TABLE replies ADD deleted boolean;
+`))
+	assert.Empty(problems)
+	assert.Equal(90*time.Second, unit.Timeout)
+	assert.Equal(500*time.Millisecond, unit.LockTimeout)
+	assert.Equal(3, unit.Retries)
+
+	_, problems = LintUnit("test/target.yaml", []byte("type: target\ndepends_on:\n- nothing\nretries: 1\n"))
+	assert.EqualValues([]string{"test/target: Target has migration settings"}, problems)
+
+	unit, problems = LintUnit("test/seed.yaml", []byte(`type: seed
+depends_on:
+- nothing
+seed:
+  categories:
+  - title: General
+    color: 0x3d85c6
+  groups:
+  - name: admin
+  - name: moderator
+    parnet: admin
+`))
+	assert.EqualValues([]string{"test/seed: Unknown key seed.groups[1].parnet"}, problems)
+	assert.Equal(int64(0x3d85c6), *unit.Seed.Categories[0].Color)
+	assert.Equal("moderator", unit.Seed.Groups[1].Name)
+
+	_, problems = LintUnit("test/seed.yaml", []byte("type: seed\ndepends_on:\n- nothing\n"))
+	assert.EqualValues([]string{"test/seed: Seed unit has no rows"}, problems)
+
+	_, problems = LintUnit("test/unit.yaml", []byte("type: migrtion\n"))
+	assert.EqualValues([]string{"test/unit: Unknown unit type migrtion"}, problems)
+
+	unit, problems = LintUnit("test/unit.txt", nil)
+	assert.Nil(unit)
+	assert.EqualValues([]string{"test/unit.txt: Unit file must have file extension .yaml"}, problems)
+
+	unit, problems = LintUnit("test/unit.yaml", []byte("depends_on: [\n"))
+	assert.Nil(unit)
+	assert.Len(problems, 1)
+}
+
+func TestLintDir(t *testing.T) {
+	assert := require.New(t)
+
+	problems, err := LintDir("arke", nil)
+	assert.NoError(err)
+	assert.Empty(problems)
+
+	dir, err := ioutil.TempDir("", "vape-lint")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "unit.yaml"),
+		[]byte("depends_on: [missing]\nsql:\n  postgres: SELECT 1;\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "target.yaml"),
+		[]byte("type: target\ndepends_on: [nothing]\n"), 0644))
+
+	problems, err = LintDir(dir, nil)
+	assert.NoError(err)
+	assert.EqualValues([]string{
+		"Node unit depends on Node missing which does not exist",
+		"Node unit is not reachable from any target",
+	}, problems)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "unit.yaml"),
+		[]byte("depends_on: [nothing]\nsql:\n  postgres: CREATE SCHEMA {{.schema}} AUTHORIZATION {{.owner}};\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "target.yaml"),
+		[]byte("type: target\ndepends_on: [unit]\n"), 0644))
+	problems, err = LintDir(dir, map[string]string{"owner": "arke"})
+	assert.NoError(err)
+	assert.Empty(problems)
+	problems, err = LintDir(dir, nil)
+	assert.NoError(err)
+	assert.Len(problems, 1)
+	assert.Contains(problems[0], "Node unit has an invalid template")
+
+	_, err = LintDir(filepath.Join(dir, "does-not-exist"), nil)
+	assert.Error(err)
+}
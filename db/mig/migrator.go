@@ -0,0 +1,143 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Migrator migrates a target the way vape does: it creates the migration tables, checks the executed units for
+// modifications, records the checksums missing from units executed before checksums were introduced and runs
+// the units of the target. It can be embedded into programs that migrate on startup:
+//
+//	migrator := mig.NewMigrator(mig.OpenFromPGConn(db), log)
+//	migrator.NoWait = true
+//	report, err := migrator.Migrate(ctx, graph, "default")
+type Migrator struct {
+	dialect Dialect
+	log     *zap.Logger
+
+	// AllowDrift migrates even if executed units have been modified, they are only logged. Otherwise Migrate
+	// fails with a *DriftError.
+	AllowDrift bool
+	// Parallel enables the concurrent execution of independent units, see Runner.Parallel
+	Parallel bool
+	// NoWait makes Migrate fail with ErrLocked instead of waiting if another instance is migrating the database
+	NoWait bool
+	// Version is the version of the program running the migration, it is recorded in the history table
+	Version string
+}
+
+// NewMigrator creates a migrator for the dialect that logs to the given logger, the logger may be nil
+func NewMigrator(dialect Dialect, log *zap.Logger) *Migrator {
+	if log == nil {
+		log = zap.New(nil)
+	}
+	return &Migrator{
+		dialect: dialect,
+		log:     log,
+	}
+}
+
+// Report describes a migration run by a Migrator
+type Report struct {
+	// Target is the name of the migrated target
+	Target string
+	// Executed contains the executed units in execution order, targets excluded. If the migration failed after
+	// units have been committed, it contains the committed units.
+	Executed []string
+	// Drifted contains the executed units that have been modified since they were executed, see AllowDrift
+	Drifted []string
+	// Checksummed contains the executed units whose missing checksum has been recorded
+	Checksummed []string
+	// Duration is the time the migration took
+	Duration time.Duration
+}
+
+// DriftError is returned by the migrator if executed units have been modified and AllowDrift is not set
+type DriftError struct {
+	Units []string
+}
+
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("Executed units have been modified: %v", e.Units)
+}
+
+// Migrate migrates the target of the graph. The report is returned even if the migration fails, the error is
+// one of the errors returned by Runner.Run, a *DriftError or ErrLocked if NoWait is set.
+func (m *Migrator) Migrate(ctx context.Context, g *Graph, target string) (*Report, error) {
+	start := time.Now()
+	report := &Report{Target: target, Executed: []string{}, Drifted: []string{}, Checksummed: []string{}}
+	executed, err := m.migrate(ctx, g, report)
+	for _, name := range executed {
+		if unit, _ := g.GetUnit(name); unit.Type != UnitTypeVirtualTarget {
+			report.Executed = append(report.Executed, name)
+		}
+	}
+	report.Duration = time.Since(start)
+	return report, err
+}
+
+// migrate runs the steps of Migrate and returns the executed units, targets included
+func (m *Migrator) migrate(ctx context.Context, g *Graph, report *Report) ([]string, error) {
+	m.log.Info("Loading Migration Target", zap.String("target", report.Target))
+	migGraph, err := g.GetTargetSubgraph(report.Target)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load Subgraph: %s", err)
+	}
+
+	runner := NewRunner(m.dialect, m.log)
+	runner.Parallel = m.Parallel
+	runner.NoWait = m.NoWait
+	runner.Target = report.Target
+	runner.Version = m.Version
+	// The tables are created and the checksums recorded under the migration lock, so that NoWait fails before
+	// anything waits for another migration
+	err = runner.locked(ctx, func(ex Tx) error {
+		return m.prepare(ctx, ex, migGraph, report)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runner.Run(ctx, migGraph)
+}
+
+// prepare creates the migration tables, checks the executed units for modifications and records missing checksums
+func (m *Migrator) prepare(ctx context.Context, ex Tx, migGraph *Graph, report *Report) error {
+	m.log.Info("Verifying and Loading Migration Data from Database")
+	err := m.dialect.createTables(ctx, ex)
+	if err != nil {
+		return fmt.Errorf("Error while loading migration tables: %s", err)
+	}
+
+	m.log.Info("Loading already executed Units")
+	executedInfo, err := m.dialect.getExecutedUnitInfo(ctx, ex)
+	if err != nil {
+		return fmt.Errorf("Error loading executed units: %s", err)
+	}
+
+	m.log.Info("Checking executed Units for changes")
+	report.Drifted = migGraph.GetDriftedUnits(m.dialect.Name(), executedInfo)
+	if len(report.Drifted) > 0 {
+		if !m.AllowDrift {
+			return &DriftError{Units: report.Drifted}
+		}
+		m.log.Warn("Executed units have been modified", zap.Strings("units", report.Drifted))
+	}
+
+	for _, v := range executedInfo {
+		if v.Checksum != "" {
+			continue
+		}
+		if node, err := migGraph.GetUnit(v.Name); err == nil {
+			m.log.Info("Recording checksum of unit executed before checksums were introduced", zap.String("unit", v.Name))
+			err = m.dialect.setChecksum(ctx, ex, node)
+			if err != nil {
+				return fmt.Errorf("Could not record checksum of unit %s: %s", v.Name, err)
+			}
+			report.Checksummed = append(report.Checksummed, v.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func init() {
+	sql.Register("mig-nop", nopDriver{})
+}
+
+// nopDriver is a database/sql driver whose transactions do nothing, migratorDialect answers the queries
+type nopDriver struct{}
+
+func (nopDriver) Open(name string) (driver.Conn, error) {
+	return nopConn{}, nil
+}
+
+type nopConn struct{}
+
+func (nopConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("Queries are not supported")
+}
+
+func (nopConn) Close() error {
+	return nil
+}
+
+func (nopConn) Begin() (driver.Tx, error) {
+	return nopConn{}, nil
+}
+
+func (nopConn) Commit() error {
+	return nil
+}
+
+func (nopConn) Rollback() error {
+	return nil
+}
+
+// migratorDialect keeps the migration table in memory and records the calls the migrator makes
+type migratorDialect struct {
+	Dialect
+	db       *sql.DB
+	held     bool
+	parallel bool
+	executed []ExecutedUnit
+	calls    []string
+	// mutex guards executed and calls while units are executed concurrently
+	mutex sync.Mutex
+}
+
+func (d *migratorDialect) Name() string {
+	return DialectPostgres
+}
+
+func (d *migratorDialect) SupportsParallel() bool {
+	return d.parallel
+}
+
+func (d *migratorDialect) TransactionalDDL() bool {
+	return true
+}
+
+func (d *migratorDialect) begin(ctx context.Context) (*sql.Tx, error) {
+	return d.db.BeginTx(ctx, nil)
+}
+
+func (d *migratorDialect) lock(ctx context.Context, ex Tx) error {
+	d.calls = append(d.calls, "lock")
+	return nil
+}
+
+func (d *migratorDialect) tryLock(ctx context.Context, ex Tx, session bool) (bool, error) {
+	d.calls = append(d.calls, "tryLock")
+	return !d.held, nil
+}
+
+func (d *migratorDialect) createTables(ctx context.Context, ex Tx) error {
+	d.calls = append(d.calls, "createTables")
+	return nil
+}
+
+func (d *migratorDialect) getExecutedUnitInfo(ctx context.Context, ex Tx) ([]ExecutedUnit, error) {
+	return d.executed, nil
+}
+
+func (d *migratorDialect) getExecutedUnits(ctx context.Context, ex Tx) ([]string, error) {
+	var names = []string{}
+	for _, v := range d.executed {
+		names = append(names, v.Name)
+	}
+	return names, nil
+}
+
+func (d *migratorDialect) setChecksum(ctx context.Context, ex Tx, unit Unit) error {
+	d.calls = append(d.calls, "setChecksum "+unit.Name)
+	for i, v := range d.executed {
+		if v.Name == unit.Name {
+			d.executed[i].Checksum = unit.Checksum(DialectPostgres)
+		}
+	}
+	return nil
+}
+
+func (d *migratorDialect) executeUnit(ctx context.Context, ex Tx, unit Unit) error {
+	if unit.Type != UnitTypeVirtualTarget {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.calls = append(d.calls, "execute "+unit.Name)
+		d.executed = append(d.executed, ExecutedUnit{
+			Name:     unit.Name,
+			Type:     unit.Type,
+			Checksum: unit.Checksum(DialectPostgres),
+		})
+	}
+	return nil
+}
+
+func (d *migratorDialect) conn(ctx context.Context) (*sql.Conn, error) {
+	return d.db.Conn(ctx)
+}
+
+func (d *migratorDialect) lockSession(ctx context.Context, conn Tx) error {
+	d.calls = append(d.calls, "lockSession")
+	return nil
+}
+
+func (d *migratorDialect) unlock(ctx context.Context, conn Tx) error {
+	d.calls = append(d.calls, "unlock")
+	return nil
+}
+
+func (d *migratorDialect) rollbackUnit(ctx context.Context, ex Tx, unit Unit) error {
+	if _, ok := ex.(*sql.Conn); ok {
+		d.calls = append(d.calls, "rollback "+unit.Name+" outside of transaction")
+	} else {
+		d.calls = append(d.calls, "rollback "+unit.Name)
+	}
+	var executed = []ExecutedUnit{}
+	for _, v := range d.executed {
+		if v.Name != unit.Name {
+			executed = append(executed, v)
+		}
+	}
+	d.executed = executed
+	return nil
+}
+
+func (d *migratorDialect) RecordAttempts(attempts []Attempt) error {
+	return nil
+}
+
+func migratorGraph(t *testing.T) *Graph {
+	graph := NewGraph()
+	require.NoError(t, graph.LoadFS(fstest.MapFS{
+		"app/tables.yaml": {Data: []byte("depends_on: [nothing]\nsql:\n  postgres: CREATE TABLE app ();\n" +
+			"down:\n  postgres: DROP TABLE app;\n")},
+		"app/indexes.yaml": {Data: []byte("depends_on: [app/tables]\nsql:\n  postgres: CREATE INDEX app_idx ON app ();\n" +
+			"down:\n  postgres: DROP INDEX app_idx;\n")},
+		"app.yaml": {Data: []byte("type: target\ndepends_on: [app/indexes]\n")},
+	}))
+	return graph
+}
+
+func TestMigrator_Migrate(t *testing.T) {
+	assert := assert.New(t)
+
+	migrator := NewMigrator(nil, nil)
+	assert.NotNil(migrator.log)
+
+	report, err := migrator.Migrate(context.Background(), NewGraph(), "missing")
+	assert.EqualError(err, "Could not load Subgraph: Target missing does not exist")
+	assert.Equal("missing", report.Target)
+	assert.Empty(report.Executed)
+	assert.Empty(report.Drifted)
+}
+
+func TestMigrator_Migrate_Report(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("mig-nop", "")
+	assert.NoError(err)
+	defer db.Close()
+	dialect := &migratorDialect{db: db}
+	graph := migratorGraph(t)
+	ctx := context.Background()
+
+	report, err := NewMigrator(dialect, nil).Migrate(ctx, graph, "app")
+	assert.NoError(err)
+	assert.Equal("app", report.Target)
+	assert.EqualValues([]string{"app/tables", "app/indexes"}, report.Executed)
+	assert.Empty(report.Drifted)
+	assert.Empty(report.Checksummed)
+	assert.True(report.Duration > 0)
+	// The tables are created under the migration lock
+	assert.EqualValues([]string{"lock", "createTables", "lock", "execute app/tables", "execute app/indexes"},
+		dialect.calls)
+
+	// Units recorded without a checksum get one
+	dialect.calls = nil
+	dialect.executed[0].Checksum = ""
+	report, err = NewMigrator(dialect, nil).Migrate(ctx, graph, "app")
+	assert.NoError(err)
+	assert.Empty(report.Executed)
+	assert.EqualValues([]string{"app/tables"}, report.Checksummed)
+	assert.EqualValues([]string{"lock", "createTables", "setChecksum app/tables", "lock"}, dialect.calls)
+	unit, err := graph.GetUnit("app/tables")
+	assert.NoError(err)
+	assert.Equal(unit.Checksum(DialectPostgres), dialect.executed[0].Checksum)
+}
+
+func TestMigrator_Migrate_Drift(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("mig-nop", "")
+	assert.NoError(err)
+	defer db.Close()
+	dialect := &migratorDialect{db: db, executed: []ExecutedUnit{
+		{Name: "app/tables", Type: UnitTypeMigration, Checksum: "modified"},
+		{Name: "app/indexes", Type: UnitTypeMigration},
+	}}
+	graph := migratorGraph(t)
+	ctx := context.Background()
+
+	// Modified units stop the migration before checksums are recorded
+	migrator := NewMigrator(dialect, nil)
+	report, err := migrator.Migrate(ctx, graph, "app")
+	assert.Equal(&DriftError{Units: []string{"app/tables"}}, err)
+	assert.EqualValues([]string{"app/tables"}, report.Drifted)
+	assert.Empty(report.Executed)
+	assert.Empty(report.Checksummed)
+	assert.EqualValues([]string{"lock", "createTables"}, dialect.calls)
+
+	// Drift is only reported if it is allowed
+	dialect.calls = nil
+	migrator.AllowDrift = true
+	report, err = migrator.Migrate(ctx, graph, "app")
+	assert.NoError(err)
+	assert.EqualValues([]string{"app/tables"}, report.Drifted)
+	assert.EqualValues([]string{"app/indexes"}, report.Checksummed)
+	assert.Empty(report.Executed)
+	assert.Equal("modified", dialect.executed[0].Checksum)
+}
+
+func TestMigrator_Migrate_NoWait(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("mig-nop", "")
+	assert.NoError(err)
+	defer db.Close()
+	dialect := &migratorDialect{db: db, held: true}
+	graph := migratorGraph(t)
+
+	// Nothing is created or waited for while another migration holds the lock
+	migrator := NewMigrator(dialect, nil)
+	migrator.NoWait = true
+	report, err := migrator.Migrate(context.Background(), graph, "app")
+	assert.Equal(ErrLocked, err)
+	assert.Empty(report.Executed)
+	assert.EqualValues([]string{"tryLock"}, dialect.calls)
+
+	dialect.calls = nil
+	dialect.held = false
+	report, err = migrator.Migrate(context.Background(), graph, "app")
+	assert.NoError(err)
+	assert.EqualValues([]string{"app/tables", "app/indexes"}, report.Executed)
+	assert.EqualValues([]string{"tryLock", "createTables", "tryLock", "execute app/tables", "execute app/indexes"},
+		dialect.calls)
+}
+
+func TestMigrator_Migrate_Parallel(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("mig-nop", "")
+	assert.NoError(err)
+	defer db.Close()
+	dialect := &migratorDialect{db: db, parallel: true}
+	graph := NewGraph()
+	assert.NoError(graph.LoadFS(fstest.MapFS{
+		"app/tables.yaml": {Data: []byte("depends_on: [nothing]\nsql:\n  postgres: CREATE TABLE app ();\n")},
+		"app/index_a.yaml": {Data: []byte("depends_on: [app/tables]\ntransaction: none\n" +
+			"sql:\n  postgres: CREATE INDEX CONCURRENTLY app_a ON app ();\n")},
+		"app/index_b.yaml": {Data: []byte("depends_on: [app/tables]\ntransaction: none\n" +
+			"sql:\n  postgres: CREATE INDEX CONCURRENTLY app_b ON app ();\n")},
+		"app.yaml": {Data: []byte("type: target\ndepends_on: [app/index_a, app/index_b]\n")},
+	}))
+
+	// The non-transactional units run concurrently, the session lock is held for both
+	migrator := NewMigrator(dialect, nil)
+	migrator.Parallel = true
+	report, err := migrator.Migrate(context.Background(), graph, "app")
+	assert.NoError(err)
+	assert.EqualValues([]string{"app/tables", "app/index_a", "app/index_b"}, report.Executed)
+	assert.EqualValues([]string{"lock", "createTables", "lock", "execute app/tables", "lockSession"},
+		dialect.calls[:5])
+	executed := dialect.calls[5:7]
+	sort.Strings(executed)
+	assert.EqualValues([]string{"execute app/index_a", "execute app/index_b"}, executed)
+	assert.EqualValues([]string{"unlock", "lock"}, dialect.calls[7:])
+}
+
+func TestDriftError(t *testing.T) {
+	err := &DriftError{Units: []string{"db_setup/categories"}}
+	assert.EqualError(t, err, "Executed units have been modified: [db_setup/categories]")
+}
@@ -0,0 +1,204 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	modelTableRegexp = regexp.MustCompile(`represents a row from '([^']+)'`)
+	modelFuncRegexp  = regexp.MustCompile(`retrieves a row from '([^']+)'`)
+	modelIndexRegexp = regexp.MustCompile(`Generated from index '([^']+)'`)
+)
+
+// Model describes a struct generated by xo from a table, as found in the source of the models package
+type Model struct {
+	// Struct is the name of the Go type
+	Struct string
+	// Table is the name of the table without schema
+	Table   string
+	Fields  []ModelField
+	Indexes []ModelIndex
+	Queries []ModelQuery
+}
+
+// ModelField is a struct field mapped to a column
+type ModelField struct {
+	Name   string
+	Column string
+	// GoType is the type of the field as written in the source, e.g. "sql.NullString"
+	GoType string
+}
+
+// ModelIndex is an index a lookup function has been generated from
+type ModelIndex struct {
+	Func string
+	Name string
+}
+
+// ModelQuery is a SQL query of a generated function or method
+type ModelQuery struct {
+	Func string
+	SQL  string
+}
+
+// LoadModels parses the Go files of the models package in the directory. Structs are mapped to tables with the
+// comment xo writes above them ("represents a row from 'public.users'"), fields to columns with the comment behind
+// them or their json tag. Lookup functions are mapped with their "retrieves a row from" and "Generated from index"
+// comments and the sqlstr constants of all functions are collected as queries.
+func LoadModels(dir string) ([]Model, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var byStruct = map[string]*Model{}
+	var byTable = map[string]*Model{}
+	var funcs = []*ast.FuncDecl{}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				switch decl := decl.(type) {
+				case *ast.GenDecl:
+					if model := parseModel(fset, decl); model != nil {
+						byStruct[model.Struct] = model
+						byTable[model.Table] = model
+					}
+				case *ast.FuncDecl:
+					funcs = append(funcs, decl)
+				}
+			}
+		}
+	}
+
+	for _, decl := range funcs {
+		model := funcModel(decl, byStruct, byTable)
+		if model == nil {
+			continue
+		}
+		name := decl.Name.Name
+		if decl.Recv != nil {
+			name = model.Struct + "." + name
+		}
+		if decl.Doc != nil {
+			if match := modelIndexRegexp.FindStringSubmatch(decl.Doc.Text()); match != nil {
+				model.Indexes = append(model.Indexes, ModelIndex{Func: name, Name: match[1]})
+			}
+		}
+		if query, ok := sqlstrConst(decl); ok {
+			model.Queries = append(model.Queries, ModelQuery{Func: name, SQL: query})
+		}
+	}
+
+	var models = make([]Model, 0, len(byStruct))
+	for _, model := range byStruct {
+		models = append(models, *model)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Struct < models[j].Struct })
+	return models, nil
+}
+
+// parseModel returns the model of a type declaration or nil if it is not a struct generated from a table
+func parseModel(fset *token.FileSet, decl *ast.GenDecl) *Model {
+	if decl.Tok != token.TYPE || decl.Doc == nil || len(decl.Specs) != 1 {
+		return nil
+	}
+	match := modelTableRegexp.FindStringSubmatch(decl.Doc.Text())
+	spec := decl.Specs[0].(*ast.TypeSpec)
+	structType, ok := spec.Type.(*ast.StructType)
+	if match == nil || !ok {
+		return nil
+	}
+	var model = &Model{Struct: spec.Name.Name, Table: normalizeName(match[1]), Fields: []ModelField{},
+		Indexes: []ModelIndex{}, Queries: []ModelQuery{}}
+	for _, field := range structType.Fields.List {
+		if len(field.Names) != 1 || !field.Names[0].IsExported() {
+			continue
+		}
+		var column string
+		if field.Comment != nil {
+			column = strings.TrimSpace(field.Comment.Text())
+		}
+		if column == "" && field.Tag != nil {
+			tag, _ := strconv.Unquote(field.Tag.Value)
+			column = strings.Split(reflect.StructTag(tag).Get("json"), ",")[0]
+		}
+		var goType bytes.Buffer
+		printer.Fprint(&goType, fset, field.Type)
+		model.Fields = append(model.Fields, ModelField{Name: field.Names[0].Name, Column: column,
+			GoType: goType.String()})
+	}
+	return model
+}
+
+// funcModel returns the model a function belongs to, either by its receiver or by the table in its comment
+func funcModel(decl *ast.FuncDecl, byStruct, byTable map[string]*Model) *Model {
+	if decl.Recv != nil && len(decl.Recv.List) == 1 {
+		recvType := decl.Recv.List[0].Type
+		if star, ok := recvType.(*ast.StarExpr); ok {
+			recvType = star.X
+		}
+		if ident, ok := recvType.(*ast.Ident); ok {
+			return byStruct[ident.Name]
+		}
+		return nil
+	}
+	if decl.Doc == nil {
+		return nil
+	}
+	if match := modelFuncRegexp.FindStringSubmatch(decl.Doc.Text()); match != nil {
+		return byTable[normalizeName(match[1])]
+	}
+	return nil
+}
+
+// sqlstrConst returns the value of the sqlstr constant declared in the function
+func sqlstrConst(decl *ast.FuncDecl) (string, bool) {
+	if decl.Body == nil {
+		return "", false
+	}
+	var query string
+	var found bool
+	ast.Inspect(decl.Body, func(node ast.Node) bool {
+		spec, ok := node.(*ast.ValueSpec)
+		if !ok || found || len(spec.Names) != 1 || spec.Names[0].Name != "sqlstr" || len(spec.Values) != 1 {
+			return !found
+		}
+		query, found = stringValue(spec.Values[0])
+		return false
+	})
+	return query, found
+}
+
+// stringValue evaluates a string literal or a concatenation of string literals
+func stringValue(expr ast.Expr) (string, bool) {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		if expr.Kind != token.STRING {
+			return "", false
+		}
+		value, err := strconv.Unquote(expr.Value)
+		return value, err == nil
+	case *ast.BinaryExpr:
+		if expr.Op != token.ADD {
+			return "", false
+		}
+		left, ok := stringValue(expr.X)
+		if !ok {
+			return "", false
+		}
+		right, ok := stringValue(expr.Y)
+		return left + right, ok
+	case *ast.ParenExpr:
+		return stringValue(expr.X)
+	}
+	return "", false
+}
@@ -0,0 +1,41 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLoadModels(t *testing.T) {
+	assert := require.New(t)
+
+	models, err := LoadModels("../models")
+	assert.NoError(err)
+	assert.Len(models, 9)
+
+	var topic Model
+	for _, model := range models {
+		if model.Struct == "Topic" {
+			topic = model
+		}
+	}
+	assert.Equal("topics", topic.Table)
+	assert.Contains(topic.Fields, ModelField{Name: "Snowflake", Column: "snowflake", GoType: "int64"})
+	assert.Contains(topic.Fields, ModelField{Name: "DeletedAt", Column: "deleted_at", GoType: "pq.NullTime"})
+	assert.Contains(topic.Fields, ModelField{Name: "CreatedAt", Column: "created_at", GoType: "*time.Time"})
+	assert.Contains(topic.Indexes, ModelIndex{Func: "TopicBySnowflake", Name: "topics_pkey"})
+
+	var funcs = map[string]string{}
+	for _, query := range topic.Queries {
+		funcs[query.Func] = query.SQL
+	}
+	assert.Contains(funcs, "Topic.Insert")
+	assert.Contains(funcs["Topic.Insert"], "INSERT INTO public.topics (snowflake, snowflake,")
+	assert.Contains(funcs, "TopicBySnowflake")
+}
+
+func TestLoadModels_NotFound(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := LoadModels("../does-not-exist")
+	assert.Error(err)
+}
@@ -0,0 +1,44 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"fmt"
+	"sort"
+)
+
+// GetPlan returns the rounds of units that a migration of the graph would execute, in the order
+// GetAllRunnableNodes would produce them. Units within a round are sorted by name. Non-transactional units
+// are moved into their own round after the other units of their round.
+//
+// The graph itself is not modified, nodes already marked as executed and skipped nodes are not part of the plan.
+func (g *Graph) GetPlan() ([][]Unit, error) {
+	var planGraph = &Graph{nodes: map[string]*Unit{}}
+	for name, node := range g.nodes {
+		unit := *node
+		planGraph.nodes[name] = &unit
+	}
+	var plan = [][]Unit{}
+	for nodes := planGraph.GetAllRunnableNodes(); len(nodes) > 0; nodes = planGraph.GetAllRunnableNodes() {
+		sort.Strings(nodes)
+		var round = make([]Unit, 0, len(nodes))
+		for _, name := range nodes {
+			if !planGraph.nodes[name].skipped {
+				round = append(round, *planGraph.nodes[name])
+			}
+		}
+		transactional, nonTransactional := splitNonTransactional(round)
+		if len(transactional) > 0 {
+			plan = append(plan, transactional)
+		}
+		if len(nonTransactional) > 0 {
+			plan = append(plan, nonTransactional)
+		}
+		err := planGraph.MarkNodesRun(nodes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if planGraph.RemainingSize() > 0 {
+		return nil, fmt.Errorf("Graph is stuck, %d nodes cannot be executed", planGraph.RemainingSize())
+	}
+	return plan, nil
+}
@@ -0,0 +1,75 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGraph_GetPlan(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+
+	graph.nodes["default"] = &Unit{
+		Name:      "default",
+		DependsOn: []string{"default2", "default3", "default4"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["default2"] = &Unit{
+		Name:      "default2",
+		DependsOn: []string{"nothing"},
+		Type:      UnitTypeMigration,
+	}
+
+	graph.nodes["default3"] = &Unit{
+		Name:      "default3",
+		DependsOn: []string{"nothing"},
+		Type:      UnitTypeMigration,
+	}
+
+	graph.nodes["default4"] = &Unit{
+		Name:      "default4",
+		DependsOn: []string{"default2", "default3"},
+		Type:      UnitTypeMigration,
+	}
+
+	plan, err := graph.GetPlan()
+	assert.NoError(err)
+	assert.Len(plan, 3)
+	assert.Equal("default2", plan[0][0].Name)
+	assert.Equal("default3", plan[0][1].Name)
+	assert.Equal("default4", plan[1][0].Name)
+	assert.Equal("default", plan[2][0].Name)
+	assert.Equal(4, graph.RemainingSize(), "Graph must not be modified")
+
+	assert.NoError(graph.MarkNodesRun("default2", "default3"))
+
+	plan, err = graph.GetPlan()
+	assert.NoError(err)
+	assert.Len(plan, 2)
+
+	graph.nodes["default4"].DependsOn = []string{"default"}
+
+	_, err = graph.GetPlan()
+	assert.Error(err)
+}
+
+func TestGraph_GetPlan_NonTransactional(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+	graph.nodes["create"] = &Unit{Name: "create", DependsOn: []string{"nothing"}, Type: UnitTypeMigration}
+	graph.nodes["index"] = &Unit{Name: "index", DependsOn: []string{"create"}, Type: UnitTypeMigration,
+		Transaction: TransactionNone}
+	graph.nodes["other"] = &Unit{Name: "other", DependsOn: []string{"create"}, Type: UnitTypeMigration}
+
+	plan, err := graph.GetPlan()
+	assert.NoError(err)
+	assert.Len(plan, 3)
+	assert.Equal("create", plan[0][0].Name)
+	assert.Len(plan[1], 1)
+	assert.Equal("other", plan[1][0].Name)
+	assert.Len(plan[2], 1)
+	assert.Equal("index", plan[2][0].Name)
+}
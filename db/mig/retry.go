@@ -0,0 +1,165 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go.uber.org/zap"
+	"time"
+)
+
+// retryDelay is the time the runner waits before the first retry of a unit, it grows with every attempt
+var retryDelay = 100 * time.Millisecond
+
+// unitSavepoint is the savepoint a unit with retries is rolled back to if an attempt fails inside a transaction
+const unitSavepoint = "vape_unit"
+
+// lockTimeoutDialect is implemented by dialects that can limit how long statements wait for locks
+type lockTimeoutDialect interface {
+	// setLockTimeout limits the lock waits of the statements executed on ex, a zero timeout restores the default.
+	// inTx is true if ex is a transaction, the limit then ends with the transaction.
+	setLockTimeout(ctx context.Context, ex Tx, timeout time.Duration, inTx bool) error
+}
+
+// retryDialect is implemented by dialects that recognise the failures a unit is retried on
+type retryDialect interface {
+	// isRetryable returns true if err is a serialization failure, a deadlock or a lock timeout
+	isRetryable(err error) bool
+}
+
+// executeUnit executes and records a unit with the timeout, lock timeout and retries of the unit unless it is
+// skipped or its run_if query returns false. Every attempt is logged.
+//
+// Inside a transaction a unit with retries is executed behind a savepoint and a failed attempt is rolled back to
+// the savepoint. Outside of a transaction a retry starts again with the first statement of the unit, batch units
+// continue after their last checkpoint. Units with transaction: none are never retried, see Graph.ValidateNodes.
+func (r *Runner) executeUnit(ctx context.Context, ex Tx, unit Unit) error {
+	if unit.Type == UnitTypeVirtualTarget {
+		return r.executeAttempt(ctx, ex, unit)
+	}
+	met := !unit.skipped
+	if met {
+		var err error
+		met, err = conditionMet(ctx, ex, r.dialect.Name(), unit)
+		if err != nil {
+			return err
+		}
+	}
+	if !met {
+		r.log.Info("Skipping unit, it is not part of the environment or its run_if query returned false",
+			zap.String("unit", unit.Name))
+		r.mutex.Lock()
+		if r.skipped == nil {
+			r.skipped = map[string]bool{}
+		}
+		r.skipped[unit.Name] = true
+		r.mutex.Unlock()
+		return nil
+	}
+	_, inTx := ex.(*sql.Tx)
+	retrier, canRetry := r.dialect.(retryDialect)
+	log := r.log.With(
+		zap.String("unit", unit.Name),
+		zap.Int("retries", unit.Retries),
+		zap.Duration("timeout", unit.Timeout),
+		zap.Duration("lock_timeout", unit.LockTimeout),
+	)
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := r.attempt(ctx, ex, unit, inTx && unit.Retries > 0)
+		r.addAttempt(unit, attempt, start, err)
+		duration := zap.Duration("duration", time.Since(start))
+		if err == nil {
+			log.Info("Unit attempt succeeded", zap.Int("attempt", attempt), duration)
+			return nil
+		}
+		retryable := canRetry && retrier.isRetryable(err)
+		if !retryable || attempt > unit.Retries {
+			log.Error("Unit attempt failed", zap.Int("attempt", attempt), duration, zap.Bool("retryable", retryable),
+				zap.Error(err))
+			return err
+		}
+		log.Warn("Unit attempt failed, retrying", zap.Int("attempt", attempt), duration, zap.Error(err))
+		select {
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// attempt executes the unit once within its timeout and lock timeout. If savepoint is set, the attempt is
+// rolled back to a savepoint if it fails.
+func (r *Runner) attempt(ctx context.Context, ex Tx, unit Unit, savepoint bool) error {
+	if unit.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, unit.Timeout)
+		defer cancel()
+	}
+	if savepoint {
+		if _, err := ex.ExecContext(ctx, "SAVEPOINT "+unitSavepoint+";"); err != nil {
+			return err
+		}
+	}
+	err := r.attemptLocked(ctx, ex, unit)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Timed out after %s: %s", unit.Timeout, err)
+	}
+	if savepoint {
+		// The attempt context may have timed out, the savepoint is handled without it
+		err = endSavepoint(ex, err)
+	}
+	return err
+}
+
+// attemptLocked executes the unit once with the lock timeout of the unit
+func (r *Runner) attemptLocked(ctx context.Context, ex Tx, unit Unit) error {
+	if unit.LockTimeout <= 0 {
+		return r.executeAttempt(ctx, ex, unit)
+	}
+	limiter, ok := r.dialect.(lockTimeoutDialect)
+	if !ok {
+		r.log.Warn("Dialect cannot limit lock waits, lock_timeout is ignored", zap.String("unit", unit.Name))
+		return r.executeAttempt(ctx, ex, unit)
+	}
+	_, inTx := ex.(*sql.Tx)
+	err := limiter.setLockTimeout(ctx, ex, unit.LockTimeout, inTx)
+	if err != nil {
+		return fmt.Errorf("Could not set lock timeout: %s", err)
+	}
+	err = r.executeAttempt(ctx, ex, unit)
+	if err != nil && inTx {
+		// The failed transaction or savepoint ends the limit
+		return err
+	}
+	resetErr := limiter.setLockTimeout(context.Background(), ex, 0, inTx)
+	if err == nil && resetErr != nil {
+		err = fmt.Errorf("Could not reset lock timeout: %s", resetErr)
+	}
+	return err
+}
+
+// durationMillis returns the duration in milliseconds, rounded up to at least one millisecond
+func durationMillis(d time.Duration) int64 {
+	ms := int64((d + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		return 1
+	}
+	return ms
+}
+
+// endSavepoint rolls back to the savepoint of the unit if the attempt failed with err and releases it
+func endSavepoint(ex Tx, err error) error {
+	ctx := context.Background()
+	if err != nil {
+		_, rollbackErr := ex.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+unitSavepoint+";")
+		if rollbackErr != nil {
+			return fmt.Errorf("%s, could not roll back to savepoint: %s", err, rollbackErr)
+		}
+	}
+	_, releaseErr := ex.ExecContext(ctx, "RELEASE SAVEPOINT "+unitSavepoint+";")
+	if err == nil {
+		return releaseErr
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// flakyTx is a txRecorder whose query fails with err the given number of times
+type flakyTx struct {
+	txRecorder
+	query    string
+	err      error
+	failures int
+}
+
+func (tx *flakyTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if query == tx.query && tx.failures > 0 {
+		tx.queries = append(tx.queries, query)
+		tx.failures--
+		return nil, tx.err
+	}
+	return tx.txRecorder.ExecContext(ctx, query, args...)
+}
+
+func TestRunner_executeUnit_Retries(t *testing.T) {
+	assert := require.New(t)
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 0
+
+	runner := NewRunner(&MySQLDialect{db: noHistoryDB()}, nil)
+	unit := Unit{Name: "unit", Type: UnitTypeMigration, SQL: SQLSection{MySQL: "ALTER TABLE a ADD b int;"},
+		LockTimeout: 1500 * time.Millisecond, Retries: 2}
+	lockErr := errors.New("Error 1205: Lock wait timeout exceeded; try restarting transaction")
+
+	conn := &flakyTx{query: "ALTER TABLE a ADD b int;", err: lockErr, failures: 2}
+	assert.NoError(runner.executeUnit(context.Background(), conn, unit))
+	var setTimeout = "SET SESSION lock_wait_timeout = 2, innodb_lock_wait_timeout = 2;"
+	var resetTimeout = "SET SESSION lock_wait_timeout = DEFAULT, innodb_lock_wait_timeout = DEFAULT;"
+	assert.EqualValues([]string{
+		setTimeout, "ALTER TABLE a ADD b int;", resetTimeout,
+		setTimeout, "ALTER TABLE a ADD b int;", resetTimeout,
+		setTimeout, "ALTER TABLE a ADD b int;", mysqlMarkExecutedQuery, resetTimeout,
+	}, conn.queries)
+
+	conn = &flakyTx{query: "ALTER TABLE a ADD b int;", err: lockErr, failures: 3}
+	assert.Equal(lockErr, runner.executeUnit(context.Background(), conn, unit))
+	assert.Len(conn.queries, 9)
+
+	// Other errors are not retried
+	conn = &flakyTx{query: "ALTER TABLE a ADD b int;", err: errors.New("Syntax error"),
+		failures: 1}
+	assert.EqualError(runner.executeUnit(context.Background(), conn, unit), "Syntax error")
+	assert.Len(conn.queries, 3)
+}
+
+func TestRunner_executeUnit_Timeout(t *testing.T) {
+	assert := require.New(t)
+
+	RegisterCode("test/timeout", func(ctx context.Context, tx Tx) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, nil)
+	runner := NewRunner(&MySQLDialect{db: noHistoryDB()}, nil)
+	unit := Unit{Name: "test/timeout", Type: UnitTypeCode, Timeout: 10 * time.Millisecond, Retries: 1}
+
+	conn := &txRecorder{}
+	assert.EqualError(runner.executeUnit(context.Background(), conn, unit),
+		"Timed out after 10ms: context deadline exceeded")
+	assert.Empty(conn.queries)
+}
+
+func TestEndSavepoint(t *testing.T) {
+	assert := require.New(t)
+
+	tx := &txRecorder{}
+	assert.NoError(endSavepoint(tx, nil))
+	assert.EqualError(endSavepoint(tx, errors.New("Unit error")), "Unit error")
+	assert.EqualValues([]string{
+		"RELEASE SAVEPOINT vape_unit;",
+		"ROLLBACK TO SAVEPOINT vape_unit;",
+		"RELEASE SAVEPOINT vape_unit;",
+	}, tx.queries)
+
+	tx = &txRecorder{fail: "ROLLBACK TO SAVEPOINT vape_unit;"}
+	assert.EqualError(endSavepoint(tx, errors.New("Unit error")),
+		"Unit error, could not roll back to savepoint: Test error")
+}
+
+func TestDialect_setLockTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	tx := &txRecorder{}
+	dialect := OpenFromPGConn(nil)
+	assert.NoError(dialect.setLockTimeout(context.Background(), tx, 2*time.Second, true))
+	assert.NoError(dialect.setLockTimeout(context.Background(), tx, 0, true))
+	assert.NoError(dialect.setLockTimeout(context.Background(), tx, time.Microsecond, false))
+	assert.EqualValues([]string{
+		"SET LOCAL lock_timeout TO 2000;",
+		"SET LOCAL lock_timeout TO DEFAULT;",
+		"SET lock_timeout TO 1;",
+	}, tx.queries)
+}
+
+func TestDialect_isRetryable(t *testing.T) {
+	assert := require.New(t)
+
+	pg := OpenFromPGConn(nil)
+	assert.True(pg.isRetryable(&pq.Error{Code: "40001"}))
+	assert.True(pg.isRetryable(&pq.Error{Code: "40P01"}))
+	assert.True(pg.isRetryable(fmt.Errorf("Batch after key 1 failed: %w", error(&pq.Error{Code: "55P03"}))))
+	assert.False(pg.isRetryable(&pq.Error{Code: "42P01"}))
+	assert.False(pg.isRetryable(errors.New("deadlock detected")))
+
+	mysql := OpenFromMySQLConn(nil)
+	assert.True(mysql.isRetryable(errors.New("Error 1213: Deadlock found when trying to get lock")))
+	assert.False(mysql.isRetryable(errors.New("Error 1146: Table 'a' doesn't exist")))
+
+	sqlite := OpenFromSQLiteConn(nil)
+	assert.True(sqlite.isRetryable(errors.New("database is locked")))
+	assert.False(sqlite.isRetryable(errors.New("no such table: a")))
+}
@@ -0,0 +1,144 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go.uber.org/zap"
+)
+
+// Rollback reverts the executed units that the unit or target to does not depend on and returns their names in
+// rollback order, see Graph.GetRollbackOrder. The connection of the rollback holds the migration lock from reading
+// the executed units until the last unit is reverted. Units are reverted in a single transaction on dialects with
+// transactional DDL, non-transactional units are reverted on their own and units reverted before them stay
+// reverted. Dialects without transactional DDL revert every unit on its own.
+func (r *Runner) Rollback(ctx context.Context, g *Graph, to string) ([]string, error) {
+	session, ok := r.dialect.(sessionDialect)
+	if !ok {
+		return nil, fmt.Errorf("Dialect %s cannot hold the migration lock for a rollback", r.dialect.Name())
+	}
+	conn, err := session.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = r.acquireLock(ctx, conn, session.lockSession, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := session.unlock(ctx, conn); err != nil {
+			r.log.Warn("Could not release migration lock", zap.Error(err))
+		}
+	}()
+
+	if !r.dialect.TransactionalDDL() {
+		units, err := r.rollbackOrder(ctx, conn, g, to)
+		if err != nil {
+			return nil, err
+		}
+		return unitNames(units), r.rollbackEach(ctx, conn, units)
+	}
+
+	tx, err := r.beginRollback(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	units, err := r.rollbackOrder(ctx, tx, g, to)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, unit := range units {
+		if !unit.IsNonTransactional() {
+			err = r.dialect.rollbackUnit(ctx, tx, unit)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			continue
+		}
+		// The units before it are committed, the unit itself cannot run in a transaction
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		r.log.Info("Rolling back Unit outside of transaction", zap.String("unit", unit.Name))
+		err = r.dialect.rollbackUnit(ctx, conn, unit)
+		if err != nil {
+			return nil, err
+		}
+		tx, err = r.beginRollback(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Could not commit rollback: %s", err)
+	}
+	return unitNames(units), nil
+}
+
+// beginRollback starts a transaction on conn that holds the migration lock of the dialect as well. The session
+// lock of conn does not lock SQLite, whose migration lock is a write transaction.
+func (r *Runner) beginRollback(ctx context.Context, conn *sql.Conn) (*sql.Tx, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = r.dialect.lock(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("Could not acquire migration lock: %s", err)
+	}
+	return tx, nil
+}
+
+// rollbackOrder loads the executed units on ex and returns the units to revert in rollback order
+func (r *Runner) rollbackOrder(ctx context.Context, ex Tx, g *Graph, to string) ([]Unit, error) {
+	executed, err := r.dialect.getExecutedUnits(ctx, ex)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading executed units: %s", err)
+	}
+	names, err := g.GetRollbackOrder(to, executed)
+	if err != nil {
+		return nil, fmt.Errorf("Could not determine rollback order: %s", err)
+	}
+	var units = make([]Unit, 0, len(names))
+	for _, name := range names {
+		unit, err := g.GetUnit(name)
+		if err != nil {
+			return nil, fmt.Errorf("Attempted to roll back non-existant unit %s", name)
+		}
+		if !unit.IsReversible(r.dialect.Name()) {
+			return nil, fmt.Errorf("Unit %s has no down section and cannot be rolled back", unit.Name)
+		}
+		units = append(units, unit)
+	}
+	return units, nil
+}
+
+// rollbackEach reverts the units one at a time on conn
+func (r *Runner) rollbackEach(ctx context.Context, conn Tx, units []Unit) error {
+	var done = []string{}
+	for _, unit := range units {
+		err := r.dialect.rollbackUnit(ctx, conn, unit)
+		if err != nil {
+			return fmt.Errorf("%s, units %v have been rolled back before", err, done)
+		}
+		if unit.Type != UnitTypeVirtualTarget {
+			done = append(done, unit.Name)
+		}
+	}
+	return nil
+}
+
+func unitNames(units []Unit) []string {
+	var names = make([]string, 0, len(units))
+	for _, unit := range units {
+		names = append(names, unit.Name)
+	}
+	return names
+}
@@ -0,0 +1,86 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRunner_Rollback(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("mig-nop", "")
+	assert.NoError(err)
+	defer db.Close()
+	dialect := &migratorDialect{db: db}
+	graph := migratorGraph(t)
+	ctx := context.Background()
+	_, err = NewMigrator(dialect, nil).Migrate(ctx, graph, "app")
+	assert.NoError(err)
+
+	// The executed units are read and reverted while the lock is held
+	dialect.calls = nil
+	names, err := NewRunner(dialect, nil).Rollback(ctx, graph, "app/tables")
+	assert.NoError(err)
+	assert.EqualValues([]string{"app/indexes"}, names)
+	assert.EqualValues([]string{"lockSession", "lock", "rollback app/indexes", "unlock"}, dialect.calls)
+
+	// Nothing is rolled back while another migration holds the lock
+	dialect.calls = nil
+	dialect.held = true
+	runner := NewRunner(dialect, nil)
+	runner.NoWait = true
+	_, err = runner.Rollback(ctx, graph, "nothing")
+	assert.Equal(ErrLocked, err)
+	assert.EqualValues([]string{"tryLock"}, dialect.calls)
+	assert.Len(dialect.executed, 1)
+
+	dialect.calls = nil
+	dialect.held = false
+	names, err = runner.Rollback(ctx, graph, "nothing")
+	assert.NoError(err)
+	assert.EqualValues([]string{"app/tables"}, names)
+	assert.EqualValues([]string{"tryLock", "lock", "rollback app/tables", "unlock"}, dialect.calls)
+	assert.Empty(dialect.executed)
+
+	names, err = runner.Rollback(ctx, graph, "nothing")
+	assert.NoError(err)
+	assert.Empty(names)
+}
+
+func TestRunner_Rollback_NonTransactional(t *testing.T) {
+	assert := require.New(t)
+
+	db, err := sql.Open("mig-nop", "")
+	assert.NoError(err)
+	defer db.Close()
+	dialect := &migratorDialect{db: db}
+	graph := NewGraph()
+	assert.NoError(graph.LoadFS(fstest.MapFS{
+		"app/tables.yaml": {Data: []byte("depends_on: [nothing]\nsql:\n  postgres: CREATE TABLE app ();\n" +
+			"down:\n  postgres: DROP TABLE app;\n")},
+		"app/indexes.yaml": {Data: []byte("depends_on: [app/tables]\ntransaction: none\n" +
+			"sql:\n  postgres: CREATE INDEX CONCURRENTLY app_idx ON app ();\n" +
+			"down:\n  postgres: DROP INDEX CONCURRENTLY app_idx;\n")},
+		"app/irreversible.yaml": {Data: []byte("depends_on: [app/indexes]\nsql:\n  postgres: SELECT 1;\n")},
+		"app.yaml":              {Data: []byte("type: target\ndepends_on: [app/irreversible]\n")},
+	}))
+	dialect.executed = []ExecutedUnit{{Name: "app/tables"}, {Name: "app/indexes"}, {Name: "app/irreversible"}}
+	ctx := context.Background()
+
+	// Units without a down section stop the rollback before anything is reverted
+	_, err = NewRunner(dialect, nil).Rollback(ctx, graph, "nothing")
+	assert.EqualError(err, "Unit app/irreversible has no down section and cannot be rolled back")
+	assert.EqualValues([]string{"lockSession", "lock", "unlock"}, dialect.calls)
+
+	// Non-transactional units are reverted outside of the transaction, the next transaction locks again
+	dialect.calls = nil
+	dialect.executed = dialect.executed[:2]
+	names, err := NewRunner(dialect, nil).Rollback(ctx, graph, "nothing")
+	assert.NoError(err)
+	assert.EqualValues([]string{"app/indexes", "app/tables"}, names)
+	assert.EqualValues([]string{"lockSession", "lock", "rollback app/indexes outside of transaction", "lock",
+		"rollback app/tables", "unlock"}, dialect.calls)
+}
@@ -0,0 +1,595 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Runner executes the units of a graph against a database.
+//
+// All units and their bookkeeping are executed inside a single transaction that holds an advisory lock, so two
+// runners cannot migrate the same database at the same time. The runner that waited for the lock sees the units
+// executed by the other runner and skips them.
+//
+// Dialects without transactional DDL execute the units on a single connection that holds a session lock instead.
+// Every unit is committed as soon as it completes, a failed unit is reported as a PartialMigrationError.
+//
+// Set NoWait to fail with ErrLocked instead of waiting for the lock.
+type Runner struct {
+	dialect Dialect
+	log     *zap.Logger
+
+	// Parallel executes the units of a round that are committed one at a time concurrently, every unit on a
+	// connection of its own while the connection of the runner holds the migration lock. Units inside the
+	// migration transaction share its connection and are executed sequentially, so are all units if the dialect
+	// does not support it.
+	Parallel bool
+	// Target is the name of the migration target, it is recorded in the history table
+	Target string
+	// Version is the version of the binary running the migration, it is recorded in the history table
+	Version string
+	// NoWait makes the runner fail with ErrLocked instead of waiting if another runner holds the migration lock.
+	// Dialects that cannot acquire the lock without waiting ignore it.
+	NoWait bool
+
+	mutex    sync.Mutex
+	attempts []Attempt
+	// written is the number of attempts that have been put into the history table
+	written  int
+	hostname string
+	operator string
+	// skipped contains the units of the migration whose run_if query returned false
+	skipped map[string]bool
+	// reseed contains the executed seed units whose rows have changed, they are executed again
+	reseed map[string]bool
+}
+
+// NewRunner creates a runner for the dialect that logs to the given logger, the logger may be nil
+func NewRunner(dialect Dialect, log *zap.Logger) *Runner {
+	if log == nil {
+		log = zap.New(nil)
+	}
+	return &Runner{
+		dialect: dialect,
+		log:     log,
+	}
+}
+
+// Run migrates the graph. It returns the names of the executed units in execution order.
+//
+// If any unit fails, the transaction is rolled back and the error of the first failing unit (in execution order)
+// is returned. Non-transactional units are executed in their own round after the transaction of the rounds
+// before them has been committed, a new transaction is started for the rounds after them. If units have been
+// committed before a unit fails, they are returned along with a *PartialMigrationError. This is always the case
+// on dialects without transactional DDL.
+//
+// Skipped units and units whose run_if query returns false are passed over in the order of the graph, they are
+// neither executed, recorded nor returned.
+//
+// Executed seed units whose rows have changed since they were executed are executed again, see Graph.ChangedSeeds.
+//
+// Every attempt to execute a unit is recorded in the history table as soon as it has finished, outside of the
+// migration transaction. Succeeded attempts are marked as rolled back if their transaction is rolled back.
+func (r *Runner) Run(ctx context.Context, g *Graph) ([]string, error) {
+	r.attempts = nil
+	r.written = 0
+	r.hostname, _ = os.Hostname()
+	r.operator = currentOperator()
+	r.skipped = map[string]bool{}
+	r.reseed = map[string]bool{}
+	if _, ok := r.dialect.(tryLockDialect); r.NoWait && !ok {
+		r.log.Warn("Dialect cannot acquire the migration lock without waiting, NoWait is ignored")
+	}
+	if r.Parallel && !r.dialect.SupportsParallel() {
+		r.log.Warn("Dialect does not support parallel execution, executing units sequentially")
+	}
+	if g.hasSeeds() {
+		info, err := r.dialect.GetExecutedUnitInfo()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range g.ChangedSeeds(r.dialect.Name(), info) {
+			r.reseed[name] = true
+		}
+	}
+	executed, err := r.migrate(ctx, g)
+	r.recordHistory()
+	return r.withoutSkipped(executed), err
+}
+
+// migrate runs the transactions and sessions of the migration and returns the committed units
+func (r *Runner) migrate(ctx context.Context, g *Graph) ([]string, error) {
+	if !r.dialect.TransactionalDDL() {
+		return r.runSession(ctx, g)
+	}
+
+	var committed = []string{}
+	for {
+		executed, deferred, err := r.runTransaction(ctx, g)
+		if err != nil && len(committed) == 0 {
+			return nil, err
+		}
+		if err != nil {
+			return r.partialError(committed, g, err)
+		}
+		committed = append(committed, executed...)
+		if len(deferred) == 0 {
+			return committed, nil
+		}
+		executed, err = r.runNonTransactional(ctx, g, deferred)
+		committed = append(committed, executed...)
+		if err != nil {
+			return r.partialError(committed, g, err)
+		}
+	}
+}
+
+// runTransaction executes rounds in a transaction until the graph is done or a round contains non-transactional
+// units. The non-transactional units of that round are returned.
+func (r *Runner) runTransaction(ctx context.Context, g *Graph) ([]string, []Unit, error) {
+	r.log.Info("Entering Database Transaction")
+	tx, err := r.dialect.begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	first := len(r.attempts)
+	defer r.recordHistory()
+
+	executed, deferred, err := r.run(ctx, tx, g, true)
+	if err != nil {
+		tx.Rollback()
+		r.rollBackAttempts(first)
+		g.unmarkNodes(executed...)
+		return nil, nil, err
+	}
+
+	r.log.Info("Committing Migration")
+	err = tx.Commit()
+	if err != nil {
+		r.rollBackAttempts(first)
+		g.unmarkNodes(executed...)
+		return nil, nil, fmt.Errorf("Could not commit migration: %s", err)
+	}
+	return executed, deferred, nil
+}
+
+// runNonTransactional executes the units one at a time outside of a transaction, each unit is recorded as soon as
+// it completes
+func (r *Runner) runNonTransactional(ctx context.Context, g *Graph, units []Unit) ([]string, error) {
+	session, ok := r.dialect.(sessionDialect)
+	if !ok {
+		return nil, fmt.Errorf("Dialect %s cannot execute units outside of a transaction", r.dialect.Name())
+	}
+	conn, err := session.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = r.acquireLock(ctx, conn, session.lockSession, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := session.unlock(ctx, conn); err != nil {
+			r.log.Warn("Could not release migration lock", zap.Error(err))
+		}
+	}()
+
+	if finder, ok := r.dialect.(InvalidIndexFinder); ok {
+		invalid, err := finder.GetInvalidIndexes()
+		if err != nil {
+			return nil, err
+		}
+		if len(invalid) > 0 {
+			return nil, &InvalidIndexError{Indexes: invalid}
+		}
+	}
+
+	// Units may have been executed by another runner since the last transaction was committed
+	executedUnits, err := r.dialect.getExecutedUnits(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var alreadyExecuted = map[string]bool{}
+	for _, name := range executedUnits {
+		alreadyExecuted[name] = !r.reseed[name]
+	}
+
+	var pending = []Unit{}
+	for _, unit := range units {
+		if !alreadyExecuted[unit.Name] {
+			pending = append(pending, unit)
+		}
+	}
+	var mutex sync.Mutex
+	var done = map[string]bool{}
+	err = r.executeRound(ctx, conn, pending, func(ex Tx, unit Unit) error {
+		r.log.Info("Executing Unit outside of transaction", zap.String("unit", unit.Name))
+		err := r.executeUnit(ctx, ex, unit)
+		if err == nil {
+			mutex.Lock()
+			done[unit.Name] = true
+			mutex.Unlock()
+		}
+		return err
+	})
+
+	var executed = []string{}
+	var names = []string{}
+	for _, unit := range units {
+		if done[unit.Name] {
+			executed = append(executed, unit.Name)
+			delete(r.reseed, unit.Name)
+		}
+		if done[unit.Name] || alreadyExecuted[unit.Name] {
+			names = append(names, unit.Name)
+		}
+	}
+	if markErr := g.MarkNodesRun(names...); markErr != nil && err == nil {
+		err = fmt.Errorf("Could not mark units as executed: %s", markErr)
+	}
+	return executed, err
+}
+
+// runSession migrates the graph on a single connection without a transaction
+func (r *Runner) runSession(ctx context.Context, g *Graph) ([]string, error) {
+	session, ok := r.dialect.(sessionDialect)
+	if !ok {
+		return nil, fmt.Errorf("Dialect %s supports neither transactional DDL nor sessions", r.dialect.Name())
+	}
+	r.log.Warn("Dialect has no transactional DDL, units are committed one at a time")
+	conn, err := session.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	executed, _, err := r.run(ctx, conn, g, false)
+	if unlockErr := session.unlock(ctx, conn); unlockErr != nil {
+		r.log.Warn("Could not release migration lock", zap.Error(unlockErr))
+	}
+	if err != nil {
+		return r.partialError(executed, g, err)
+	}
+	return executed, nil
+}
+
+// partialError wraps the error of a unit that failed outside of a transaction into a *PartialMigrationError
+func (r *Runner) partialError(committed []string, g *Graph, err error) ([]string, error) {
+	if unitErr, ok := err.(*UnitError); ok {
+		committed = r.withoutSkipped(committed)
+		return committed, &PartialMigrationError{
+			Executed: committed,
+			Failed:   unitErr.Unit,
+			Pending:  g.pendingNames(unitErr.Unit),
+			Err:      unitErr.Err,
+		}
+	}
+	return committed, err
+}
+
+// withoutSkipped returns the names that are not skipped units
+func (r *Runner) withoutSkipped(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var filtered = []string{}
+	for _, name := range names {
+		if !r.skipped[name] {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// run executes the graph on tx and returns the executed units. If a unit fails, the units that completed
+// before it are returned along with the error.
+//
+// If deferNonTransactional is true, run stops at the first round with non-transactional units. The other units
+// of the round are executed and the non-transactional units are returned.
+func (r *Runner) run(ctx context.Context, tx Tx, g *Graph, deferNonTransactional bool) ([]string, []Unit, error) {
+	err := r.acquireLock(ctx, tx, r.dialect.lock, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Units may have been executed by another runner while we waited for the lock
+	executedUnits, err := r.dialect.getExecutedUnits(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range executedUnits {
+		if _, ok := g.nodes[name]; ok && !r.reseed[name] {
+			g.MarkNodesRun(name)
+		}
+	}
+	err = r.satisfyBaselines(g, executedUnits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unsupported = []string{}
+	for _, name := range g.sortedNames() {
+		if node := g.nodes[name]; !node.executed && !node.skipped && !node.SupportsDialect(r.dialect.Name()) {
+			unsupported = append(unsupported, name)
+		}
+	}
+	if len(unsupported) > 0 {
+		return nil, nil, fmt.Errorf("Units have no SQL for dialect %s: %v", r.dialect.Name(), unsupported)
+	}
+	var unseedable = []string{}
+	for _, name := range g.sortedNames() {
+		if node := g.nodes[name]; !node.executed && !node.skipped && node.Type == UnitTypeSeed && !canSeed(r.dialect) {
+			unseedable = append(unseedable, name)
+		}
+	}
+	if len(unseedable) > 0 {
+		return nil, nil, fmt.Errorf("Seed units can only be executed on the public schema of Postgres: %v", unseedable)
+	}
+
+	r.log.Info("Starting Migration", zap.Int("unit_num", g.RemainingSize()))
+	var executed = []string{}
+	for nodes := g.GetAllRunnableNodes(); len(nodes) > 0; nodes = g.GetAllRunnableNodes() {
+		sort.Strings(nodes)
+		r.log.Info("Executing Round", zap.Int("unit_num", len(nodes)), zap.Strings("nodes", nodes))
+		var units = make([]Unit, 0, len(nodes))
+		for _, name := range nodes {
+			unit, err := g.GetUnit(name)
+			if err != nil {
+				return executed, nil, fmt.Errorf("Attempted to migrate non-existant unit %s", name)
+			}
+			units = append(units, unit)
+		}
+		var deferred = []Unit{}
+		if deferNonTransactional {
+			units, deferred = splitNonTransactional(units)
+		}
+
+		var mutex sync.Mutex
+		var done = map[string]bool{}
+		err = r.executeRound(ctx, tx, units, func(ex Tx, unit Unit) error {
+			err := r.executeUnit(ctx, ex, unit)
+			if err == nil {
+				mutex.Lock()
+				done[unit.Name] = true
+				mutex.Unlock()
+			}
+			return err
+		})
+		if err != nil {
+			for _, unit := range units {
+				if done[unit.Name] {
+					executed = append(executed, unit.Name)
+				}
+			}
+			return executed, nil, err
+		}
+
+		var names = make([]string, 0, len(units))
+		for _, unit := range units {
+			names = append(names, unit.Name)
+		}
+		for _, name := range names {
+			delete(r.reseed, name)
+		}
+		err = g.MarkNodesRun(names...)
+		executed = append(executed, names...)
+		if err != nil {
+			return executed, nil, fmt.Errorf("Could not mark units as executed: %s", err)
+		}
+		if len(deferred) > 0 {
+			return executed, deferred, nil
+		}
+		if g.IsStuck() {
+			return executed, nil, fmt.Errorf("Migration got stuck after units %v", nodes)
+		}
+	}
+	return executed, nil, nil
+}
+
+// executeAttempt executes and records a unit once, batch units are executed by runBatch
+func (r *Runner) executeAttempt(ctx context.Context, ex Tx, unit Unit) error {
+	if unit.Type == UnitTypeBatch {
+		return r.runBatch(ctx, ex, unit)
+	}
+	return r.dialect.executeUnit(ctx, ex, unit)
+}
+
+// splitNonTransactional separates the non-transactional units from the other units
+func splitNonTransactional(units []Unit) ([]Unit, []Unit) {
+	var transactional = []Unit{}
+	var nonTransactional = []Unit{}
+	for _, unit := range units {
+		if unit.IsNonTransactional() {
+			nonTransactional = append(nonTransactional, unit)
+		} else {
+			transactional = append(transactional, unit)
+		}
+	}
+	return transactional, nonTransactional
+}
+
+// acquireLock acquires the migration lock on ex with lock. If NoWait is set and the dialect supports it, the lock
+// is only acquired if it is free and ErrLocked is returned otherwise. session is true if ex is the connection of
+// a session and not a transaction.
+func (r *Runner) acquireLock(ctx context.Context, ex Tx, lock func(context.Context, Tx) error, session bool) error {
+	r.log.Info("Acquiring migration lock")
+	if try, ok := r.dialect.(tryLockDialect); ok && r.NoWait {
+		locked, err := try.tryLock(ctx, ex, session)
+		if err != nil {
+			return fmt.Errorf("Could not acquire migration lock: %s", err)
+		}
+		if !locked {
+			return ErrLocked
+		}
+		return nil
+	}
+	err := lock(ctx, ex)
+	if err != nil {
+		return fmt.Errorf("Could not acquire migration lock: %s", err)
+	}
+	return nil
+}
+
+// locked runs fn while holding the migration lock. fn runs in a transaction that is committed if fn succeeds,
+// dialects without transactional DDL run it on a connection holding the session lock instead.
+func (r *Runner) locked(ctx context.Context, fn func(ex Tx) error) error {
+	if r.dialect.TransactionalDDL() {
+		tx, err := r.dialect.begin(ctx)
+		if err != nil {
+			return err
+		}
+		err = r.acquireLock(ctx, tx, r.dialect.lock, false)
+		if err == nil {
+			err = fn(tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	session, ok := r.dialect.(sessionDialect)
+	if !ok {
+		return fmt.Errorf("Dialect %s supports neither transactional DDL nor sessions", r.dialect.Name())
+	}
+	conn, err := session.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = r.acquireLock(ctx, conn, session.lockSession, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := session.unlock(ctx, conn); err != nil {
+			r.log.Warn("Could not release migration lock", zap.Error(err))
+		}
+	}()
+	return fn(conn)
+}
+
+// tryLockDialect is implemented by dialects that can acquire the migration lock without waiting for it
+type tryLockDialect interface {
+	// tryLock acquires the migration lock like lock, or lockSession if session is true, if no other migration
+	// holds it. It returns false if the lock is held by another migration.
+	tryLock(ctx context.Context, ex Tx, session bool) (bool, error)
+}
+
+// ErrLocked is returned by runners with NoWait set if another migration holds the migration lock
+var ErrLocked = errors.New("Migration lock is held by another migration")
+
+// sessionDialect is implemented by dialects that can execute units outside of a transaction. Dialects without
+// transactional DDL execute all units of a migration on a single connection, the others only non-transactional
+// units. The connection holds the migration lock from lockSession until unlock is called.
+type sessionDialect interface {
+	conn(ctx context.Context) (*sql.Conn, error)
+	lockSession(ctx context.Context, conn Tx) error
+	unlock(ctx context.Context, conn Tx) error
+}
+
+// UnitError is returned by the runner if the SQL of a unit fails
+type UnitError struct {
+	Unit string
+	Err  error
+}
+
+func (e *UnitError) Error() string {
+	return fmt.Sprintf("Unit %s failed: %s", e.Unit, e.Err)
+}
+
+// PartialMigrationError is returned by the runner if a unit fails after other units have been committed, which
+// happens on dialects without transactional DDL and after non-transactional units. The executed units have been
+// committed and recorded in the migration table, running the migration again resumes
+// with the failed unit. Since the failed unit may consist of several statements, it may have been partially
+// applied and has to be checked by hand first.
+type PartialMigrationError struct {
+	// Executed contains the units executed and recorded before the failure
+	Executed []string
+	// Failed is the name of the failed unit
+	Failed string
+	// Pending contains the units that have not been attempted
+	Pending []string
+	// Err is the error of the failed unit
+	Err error
+}
+
+func (e *PartialMigrationError) Error() string {
+	return fmt.Sprintf("Unit %s failed after %d units were committed, it may be partially applied and must be "+
+		"checked before migrating again: %s", e.Failed, len(e.Executed), e.Err)
+}
+
+// InvalidIndexError is returned by the runner if the database contains invalid indexes before non-transactional
+// units are executed. Invalid indexes are left behind by failed non-transactional units like
+// CREATE INDEX CONCURRENTLY and have to be dropped by hand.
+type InvalidIndexError struct {
+	Indexes []string
+}
+
+func (e *InvalidIndexError) Error() string {
+	return fmt.Sprintf("Invalid indexes left behind by failed units must be dropped before migrating: %v", e.Indexes)
+}
+
+// runRound executes the units one after another and stops on the first error
+func runRound(units []Unit, execUnit func(Unit) error) error {
+	for _, unit := range units {
+		if err := execUnit(unit); err != nil {
+			return &UnitError{Unit: unit.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// runRoundParallel executes all units concurrently. If units fail, the error of the first failed unit in
+// the order of the slice is returned, regardless of which unit failed first in time.
+func runRoundParallel(units []Unit, execUnit func(Unit) error) error {
+	var errs = make([]error, len(units))
+	var wg sync.WaitGroup
+	wg.Add(len(units))
+	for i := range units {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = execUnit(units[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return &UnitError{Unit: units[i].Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// executeRound executes the units of a round on ex with execUnit. If Parallel is set, the dialect supports it and
+// ex is a connection holding the session lock, the units are executed concurrently, every unit on a connection of
+// its own. Units in a transaction are always executed sequentially on it.
+func (r *Runner) executeRound(ctx context.Context, ex Tx, units []Unit, execUnit func(Tx, Unit) error) error {
+	session, ok := r.dialect.(sessionDialect)
+	_, isConn := ex.(*sql.Conn)
+	if !r.Parallel || !ok || !isConn || len(units) < 2 || !r.dialect.SupportsParallel() {
+		return runRound(units, func(unit Unit) error {
+			return execUnit(ex, unit)
+		})
+	}
+	return runRoundParallel(units, func(unit Unit) error {
+		conn, err := session.conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return execUnit(conn, unit)
+	})
+}
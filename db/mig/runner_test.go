@@ -0,0 +1,126 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunner_Run(t *testing.T) {
+	assert := assert.New(t)
+
+	mockDB := new(minimalDBMock)
+	mockDB.On("BeginTx", mock.Anything, (*sql.TxOptions)(nil)).Return(nil, errors.New("Test error"))
+
+	runner := NewRunner(&PostgresDialect{db: mockDB}, nil)
+	assert.NotNil(runner.log)
+
+	_, err := runner.Run(context.Background(), NewGraph())
+	assert.Error(err)
+	mockDB.AssertExpectations(t)
+}
+
+func TestRunner_RunSession(t *testing.T) {
+	assert := assert.New(t)
+
+	mockDB := new(minimalDBMock)
+	mockDB.On("Conn", mock.Anything).Return(nil, errors.New("Test error"))
+
+	runner := NewRunner(&MySQLDialect{db: mockDB}, nil)
+	_, err := runner.Run(context.Background(), NewGraph())
+	assert.EqualError(err, "Test error")
+	mockDB.AssertExpectations(t)
+	mockDB.AssertNotCalled(t, "BeginTx", mock.Anything, mock.Anything)
+}
+
+func TestPartialMigrationError(t *testing.T) {
+	err := &PartialMigrationError{
+		Executed: []string{"unit1", "unit2"},
+		Failed:   "unit3",
+		Pending:  []string{"unit4"},
+		Err:      errors.New("Test error"),
+	}
+	assert.EqualError(t, err, "Unit unit3 failed after 2 units were committed, it may be partially applied "+
+		"and must be checked before migrating again: Test error")
+}
+
+func TestRunRound(t *testing.T) {
+	assert := assert.New(t)
+
+	units := []Unit{{Name: "unit1"}, {Name: "unit2"}, {Name: "unit3"}}
+
+	var called = []string{}
+	assert.NoError(runRound(units, func(unit Unit) error {
+		called = append(called, unit.Name)
+		return nil
+	}))
+	assert.EqualValues([]string{"unit1", "unit2", "unit3"}, called)
+
+	called = []string{}
+	err := runRound(units, func(unit Unit) error {
+		called = append(called, unit.Name)
+		if unit.Name != "unit1" {
+			return errors.New("Test error")
+		}
+		return nil
+	})
+	assert.EqualError(err, "Unit unit2 failed: Test error")
+	assert.EqualValues([]string{"unit1", "unit2"}, called)
+}
+
+func TestRunRoundParallel(t *testing.T) {
+	assert := assert.New(t)
+
+	units := []Unit{{Name: "unit1"}, {Name: "unit2"}, {Name: "unit3"}}
+
+	var mutex sync.Mutex
+	var called = map[string]bool{}
+	assert.NoError(runRoundParallel(units, func(unit Unit) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		called[unit.Name] = true
+		return nil
+	}))
+	assert.Len(called, 3)
+
+	// unit3 fails first but unit2 comes first in the round and must be reported
+	for i := 0; i < 10; i++ {
+		err := runRoundParallel(units, func(unit Unit) error {
+			switch unit.Name {
+			case "unit2":
+				time.Sleep(time.Millisecond)
+				return errors.New("Test error 2")
+			case "unit3":
+				return errors.New("Test error 3")
+			}
+			return nil
+		})
+		assert.EqualError(err, "Unit unit2 failed: Test error 2")
+	}
+}
+
+func TestSplitNonTransactional(t *testing.T) {
+	assert := assert.New(t)
+
+	transactional, nonTransactional := splitNonTransactional([]Unit{
+		{Name: "unit1"},
+		{Name: "unit2", Transaction: TransactionNone},
+		{Name: "unit3"},
+	})
+	assert.Len(transactional, 2)
+	assert.Equal("unit1", transactional[0].Name)
+	assert.Equal("unit3", transactional[1].Name)
+	assert.Len(nonTransactional, 1)
+	assert.Equal("unit2", nonTransactional[0].Name)
+}
+
+func TestInvalidIndexError(t *testing.T) {
+	err := &InvalidIndexError{Indexes: []string{"replies_topic_index"}}
+	assert.EqualError(t, err, "Invalid indexes left behind by failed units must be dropped before migrating: "+
+		"[replies_topic_index]")
+}
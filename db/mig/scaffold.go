@@ -0,0 +1,174 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// ScaffoldOptions describes a unit created by ScaffoldUnit
+type ScaffoldOptions struct {
+	// Description is written to the unit file, it is required
+	Description string
+	// Type is the type of the unit, it defaults to a migration
+	Type UnitType
+	// DependsOn lists the dependencies of the unit, it defaults to "nothing"
+	DependsOn []string
+	// Target is the target the unit is added to, it may be empty
+	Target string
+}
+
+// ScaffoldUnit creates the file of a new unit in the directory and adds the unit to the dependencies of the target.
+// The unit needs a description, the dependencies and the target must exist in the directory. Migration and batch
+// units are created with empty SQL sections for all dialects, which have to be filled in before LintUnit accepts
+// them.
+//
+// The target file is edited in place, its formatting is kept.
+func ScaffoldUnit(dir, name string, opts ScaffoldOptions) error {
+	name = strings.TrimSuffix(name, ".yaml")
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "..") {
+		return fmt.Errorf("Invalid unit name %q", name)
+	}
+	if strings.TrimSpace(opts.Description) == "" {
+		return fmt.Errorf("Unit %s has no description", name)
+	}
+	if opts.Type == "" {
+		opts.Type = UnitTypeMigration
+	}
+	if len(opts.DependsOn) == 0 {
+		opts.DependsOn = []string{nothingUnit.Name}
+	}
+
+	graph, _, err := loadDir(dir, nil)
+	if err != nil {
+		return err
+	}
+	if _, exists := graph.nodes[name]; exists {
+		return fmt.Errorf("Unit %s already exists", name)
+	}
+	for _, dependency := range opts.DependsOn {
+		if _, ok := graph.nodes[dependency]; !ok {
+			return fmt.Errorf("Dependency %s does not exist", dependency)
+		}
+	}
+	var targetFile string
+	var targetDat []byte
+	if opts.Target != "" {
+		target, ok := graph.nodes[opts.Target]
+		if !ok || target.Type != UnitTypeVirtualTarget {
+			return fmt.Errorf("Target %s does not exist", opts.Target)
+		}
+		targetFile = filepath.Join(dir, filepath.FromSlash(opts.Target+".yaml"))
+		dat, err := ioutil.ReadFile(targetFile)
+		if err != nil {
+			return err
+		}
+		targetDat, err = addDependency(opts.Target, dat, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(name+".yaml"))
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(scaffoldUnitFile(opts))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || targetFile == "" {
+		return err
+	}
+	return ioutil.WriteFile(targetFile, targetDat, 0644)
+}
+
+// scaffoldUnitFile returns the contents of a new unit file
+func scaffoldUnitFile(opts ScaffoldOptions) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "description: %s\n", quoteYAML(opts.Description))
+	if opts.Type != UnitTypeMigration {
+		fmt.Fprintf(&buf, "type: %s\n", opts.Type)
+	}
+	buf.WriteString("depends_on:\n")
+	for _, dependency := range opts.DependsOn {
+		fmt.Fprintf(&buf, "- %s\n", dependency)
+	}
+	if opts.Type == UnitTypeBatch {
+		buf.WriteString("batch:\n  table: \"\"\n")
+	}
+	if opts.Type == UnitTypeSeed {
+		buf.WriteString("seed:\n  categories: []\n  groups: []\n")
+	}
+	if opts.Type == UnitTypeMigration || opts.Type == UnitTypeBatch {
+		for _, section := range []string{"sql", "down"} {
+			fmt.Fprintf(&buf, "%s:\n", section)
+			for _, dialect := range []string{DialectPostgres, DialectSQLite, DialectMySQL} {
+				fmt.Fprintf(&buf, "  %s: \"\"\n", dialect)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// quoteYAML quotes a string as a double-quoted YAML scalar
+func quoteYAML(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// addDependency appends a dependency to the depends_on list of a unit file. The list items are indented like the
+// existing items, a target that only depends on "nothing" depends on the new unit instead.
+func addDependency(filename string, dat []byte, dependency string) ([]byte, error) {
+	before, err := parseUnit(filename, dat)
+	if err != nil {
+		return nil, err
+	}
+	var lines = strings.Split(strings.TrimRight(string(dat), "\n"), "\n")
+	var manualErr = errors.New("Could not add the unit to the depends_on list of " + filename + ", add it by hand")
+	var start = -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "depends_on:") {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("Unit %s has no depends_on list", filename)
+	}
+	if strings.TrimSpace(strings.TrimPrefix(lines[start], "depends_on:")) != "" {
+		// Flow sequences like [a, b] are not edited
+		return nil, manualErr
+	}
+	var last = start
+	for i := start + 1; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "- "); i++ {
+		last = i
+	}
+	var indent = ""
+	if last > start {
+		indent = lines[last][:strings.Index(lines[last], "-")]
+	}
+	item := fmt.Sprintf("%s- %s", indent, dependency)
+
+	expected := append(before.DependsOnWithoutNothing(), dependency)
+	if len(before.DependsOn) == 1 && before.DependsOn[0] == nothingUnit.Name {
+		lines[last] = item
+	} else {
+		lines = append(lines[:last+1], append([]string{item}, lines[last+1:]...)...)
+	}
+	result := []byte(strings.Join(lines, "\n") + "\n")
+
+	after, err := parseUnit(filename, result)
+	if err != nil || !reflect.DeepEqual(after.DependsOn, expected) {
+		return nil, manualErr
+	}
+	return result, nil
+}
@@ -0,0 +1,70 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScaffoldUnit(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "vape-new")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "default.yaml"),
+		[]byte("description: Default\ntype: target\ndepends_on:\n  - nothing\n"), 0644))
+
+	assert.NoError(ScaffoldUnit(dir, "setup/create_test.yaml", ScaffoldOptions{
+		Description: "Create the test table",
+		Target:      "default",
+	}))
+	assert.NoError(ScaffoldUnit(dir, "setup/index_test", ScaffoldOptions{
+		Description: "Index the test table",
+		DependsOn:   []string{"setup/create_test"},
+		Target:      "default",
+	}))
+
+	dat, err := ioutil.ReadFile(filepath.Join(dir, "default.yaml"))
+	assert.NoError(err)
+	assert.Equal("description: Default\ntype: target\ndepends_on:\n  - setup/create_test\n  - setup/index_test\n",
+		string(dat))
+
+	dat, err = ioutil.ReadFile(filepath.Join(dir, "setup", "index_test.yaml"))
+	assert.NoError(err)
+	unit, problems := LintUnit("setup/index_test.yaml", dat)
+	assert.Equal("Index the test table", unit.Description)
+	assert.EqualValues([]string{"setup/create_test"}, unit.DependsOn)
+	assert.EqualValues([]string{"setup/index_test: Unit has no SQL"}, problems)
+
+	assert.NoError(ScaffoldUnit(dir, "seed/test", ScaffoldOptions{Description: "Seed test rows", Type: UnitTypeSeed}))
+	dat, err = ioutil.ReadFile(filepath.Join(dir, "seed", "test.yaml"))
+	assert.NoError(err)
+	_, problems = LintUnit("seed/test.yaml", dat)
+	assert.EqualValues([]string{"seed/test: Seed unit has no rows"}, problems)
+
+	opts := ScaffoldOptions{Description: "Other"}
+	assert.EqualError(ScaffoldUnit(dir, "setup/index_test", opts), "Unit setup/index_test already exists")
+	assert.EqualError(ScaffoldUnit(dir, "setup/other", ScaffoldOptions{}), "Unit setup/other has no description")
+	opts.DependsOn = []string{"missing"}
+	assert.EqualError(ScaffoldUnit(dir, "setup/other", opts), "Dependency missing does not exist")
+	opts.DependsOn, opts.Target = nil, "setup/create_test"
+	assert.EqualError(ScaffoldUnit(dir, "setup/other", opts), "Target setup/create_test does not exist")
+	assert.EqualError(ScaffoldUnit(dir, "../other", ScaffoldOptions{}), `Invalid unit name "../other"`)
+}
+
+func TestAddDependency(t *testing.T) {
+	assert := require.New(t)
+
+	dat, err := addDependency("target.yaml", []byte("depends_on:\n- a\ntype: target"), "b")
+	assert.NoError(err)
+	assert.Equal("depends_on:\n- a\n- b\ntype: target\n", string(dat))
+
+	_, err = addDependency("target.yaml", []byte("depends_on: [a]\ntype: target\n"), "b")
+	assert.EqualError(err, "Could not add the unit to the depends_on list of target.yaml, add it by hand")
+
+	_, err = addDependency("target.yaml", []byte("type: target\n"), "b")
+	assert.EqualError(err, "Unit target.yaml has no depends_on list")
+}
@@ -0,0 +1,178 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+const pgSchemaTablesQuery = `SELECT table_name FROM information_schema.tables
+WHERE table_schema = current_schema() AND table_type = 'BASE TABLE';`
+
+const pgSchemaColumnsQuery = `SELECT table_name, column_name, data_type, is_nullable FROM information_schema.columns
+WHERE table_schema = current_schema() ORDER BY table_name, ordinal_position;`
+
+const pgSchemaIndexesQuery = `SELECT tablename, indexname FROM pg_indexes WHERE schemaname = current_schema();`
+
+const sqliteSchemaTablesQuery = `SELECT name FROM sqlite_master WHERE type='table';`
+
+const sqliteSchemaColumnsQuery = `SELECT m.name, p.name, p.type,
+CASE WHEN p."notnull" = 0 AND p.pk = 0 THEN 'YES' ELSE 'NO' END FROM sqlite_master m JOIN pragma_table_info(m.name) p
+WHERE m.type='table' ORDER BY m.name, p.cid;`
+
+const sqliteSchemaIndexesQuery = `SELECT tbl_name, name FROM sqlite_master WHERE type='index';`
+
+const mysqlSchemaTablesQuery = `SELECT table_name FROM information_schema.tables
+WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE';`
+
+const mysqlSchemaColumnsQuery = `SELECT table_name, column_name, data_type, is_nullable FROM information_schema.columns
+WHERE table_schema = DATABASE() ORDER BY table_name, ordinal_position;`
+
+const mysqlSchemaIndexesQuery = `SELECT DISTINCT table_name, index_name FROM information_schema.statistics
+WHERE table_schema = DATABASE();`
+
+// SchemaInspector is implemented by dialects that can read the schema of the database
+type SchemaInspector interface {
+	// InspectSchema returns the tables of the current schema with their columns and indexes
+	InspectSchema() (*Schema, error)
+}
+
+// Schema describes the tables of a database. Names are lower case.
+type Schema struct {
+	Tables map[string]*SchemaTable
+}
+
+// SchemaTable describes a table of a database
+type SchemaTable struct {
+	Name string
+	// Columns lists the columns in the order of the table definition
+	Columns []SchemaColumn
+	// Indexes lists the names of the indexes on the table, including the ones created by constraints
+	Indexes []string
+}
+
+// SchemaColumn describes a column of a table
+type SchemaColumn struct {
+	Name string
+	// Type is the data type as reported by the database, e.g. "bigint" or "timestamp with time zone"
+	Type     string
+	Nullable bool
+}
+
+// Column returns the column with the given name or nil if the table has no such column
+func (t *SchemaTable) Column(name string) *SchemaColumn {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
+		}
+	}
+	return nil
+}
+
+// HasColumn returns true if the table has a column with the given name
+func (t *SchemaTable) HasColumn(name string) bool {
+	return t.Column(name) != nil
+}
+
+// IndexTable returns the name of the table the index is defined on, or an empty string if there is no such index
+func (s *Schema) IndexTable(name string) string {
+	for _, table := range s.Tables {
+		for _, index := range table.Indexes {
+			if index == name {
+				return table.Name
+			}
+		}
+	}
+	return ""
+}
+
+// InspectSchema returns the tables of the current schema with their columns and indexes
+func (d *PostgresDialect) InspectSchema() (*Schema, error) {
+	return inspectSchema(d.db, pgSchemaTablesQuery, pgSchemaColumnsQuery, pgSchemaIndexesQuery)
+}
+
+// InspectSchema returns the tables of the database with their columns and indexes
+func (d *SQLiteDialect) InspectSchema() (*Schema, error) {
+	return inspectSchema(d.db, sqliteSchemaTablesQuery, sqliteSchemaColumnsQuery, sqliteSchemaIndexesQuery)
+}
+
+// InspectSchema returns the tables of the current database with their columns and indexes
+func (d *MySQLDialect) InspectSchema() (*Schema, error) {
+	return inspectSchema(d.db, mysqlSchemaTablesQuery, mysqlSchemaColumnsQuery, mysqlSchemaIndexesQuery)
+}
+
+var _ SchemaInspector = (*PostgresDialect)(nil)
+var _ SchemaInspector = (*SQLiteDialect)(nil)
+var _ SchemaInspector = (*MySQLDialect)(nil)
+
+// inspectSchema reads the schema with the given queries. The tables query returns table names, the columns query
+// returns the table, name, type and nullability ("YES" or "NO") of every column and the indexes query returns pairs
+// of table names and index names.
+func inspectSchema(db minimalDB, tablesQuery, columnsQuery, indexesQuery string) (*Schema, error) {
+	var schema = &Schema{Tables: map[string]*SchemaTable{}}
+	tables, err := queryStrings(db, tablesQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range tables {
+		name := strings.ToLower(row[0])
+		schema.Tables[name] = &SchemaTable{Name: name, Columns: []SchemaColumn{}, Indexes: []string{}}
+	}
+	columns, err := queryStrings(db, columnsQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range columns {
+		if table, ok := schema.Tables[strings.ToLower(row[0])]; ok {
+			table.Columns = append(table.Columns, SchemaColumn{
+				Name:     strings.ToLower(row[1]),
+				Type:     strings.ToLower(row[2]),
+				Nullable: strings.EqualFold(row[3], "YES"),
+			})
+		}
+	}
+	indexes, err := queryStrings(db, indexesQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range indexes {
+		if table, ok := schema.Tables[strings.ToLower(row[0])]; ok {
+			table.Indexes = append(table.Indexes, strings.ToLower(row[1]))
+		}
+	}
+	for _, table := range schema.Tables {
+		sort.Strings(table.Indexes)
+	}
+	return schema, nil
+}
+
+// queryStrings returns all rows of a query whose columns are strings
+func queryStrings(db minimalDB, query string) ([][]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result = [][]string{}
+	for rows.Next() {
+		var values = make([]sql.NullString, len(columns))
+		var dest = make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		var row = make([]string, len(columns))
+		for i, value := range values {
+			row[i] = value.String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
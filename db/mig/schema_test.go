@@ -0,0 +1,34 @@
+package mig
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPostgresDialect_InspectSchema(t *testing.T) {
+	assert := require.New(t)
+
+	mockDB := new(minimalDBMock)
+	dialect := &PostgresDialect{
+		db: mockDB,
+	}
+	mockDB.On("Query", pgSchemaTablesQuery, []interface{}(nil)).Return((*sql.Rows)(nil), errors.New("Test error"))
+
+	_, err := dialect.InspectSchema()
+	assert.EqualError(err, "Test error")
+	mockDB.AssertExpectations(t)
+}
+
+func TestSchema(t *testing.T) {
+	assert := require.New(t)
+
+	schema := &Schema{Tables: map[string]*SchemaTable{
+		"users": {Name: "users", Columns: []SchemaColumn{{Name: "snowflake"}, {Name: "name"}}, Indexes: []string{"users_name_index"}},
+	}}
+	assert.True(schema.Tables["users"].HasColumn("name"))
+	assert.False(schema.Tables["users"].HasColumn("email"))
+	assert.Equal("users", schema.IndexTable("users_name_index"))
+	assert.Equal("", schema.IndexTable("users_email_index"))
+}
@@ -0,0 +1,177 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"iris.arke.works/forum/db/models"
+	"iris.arke.works/forum/snowflakes"
+	"sort"
+	"time"
+)
+
+// SeedIDs generates the snowflakes of new seed rows, rows that already exist keep their snowflake. It uses the
+// instance ID reserved for migrations, so its snowflakes cannot collide with those of the forum instances.
+var SeedIDs = &snowflakes.Generator{
+	StartTime:  time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC).Unix(),
+	InstanceID: snowflakes.MigrationInstanceID,
+}
+
+// SeedSection declares the rows of a seed unit:
+//
+//	type: seed
+//	depends_on:
+//	- db_setup
+//	seed:
+//	  categories:
+//	  - title: General
+//	    description: Anything goes
+//	    color: 0x3d85c6
+//	  groups:
+//	  - name: admin
+//	  - name: moderator
+//	    parent: admin
+type SeedSection struct {
+	Categories []SeedCategory `yaml:"categories"`
+	Groups     []SeedGroup    `yaml:"groups"`
+}
+
+// SeedCategory is a row of the categories table, it is identified by its title
+type SeedCategory struct {
+	Title       string `yaml:"title"`
+	Description string `yaml:"description"`
+	// Color is an RGB value, e.g. 0x3d85c6
+	Color *int64 `yaml:"color"`
+}
+
+// SeedGroup is a row of the groups table, it is identified by its name
+type SeedGroup struct {
+	Name       string `yaml:"name"`
+	Permission string `yaml:"permission"`
+	// Parent is the name of the parent group, it must exist or be seeded before the group
+	Parent string `yaml:"parent"`
+}
+
+// canSeed returns true if seed units can be executed on the dialect. The models package only supports Postgres
+// and addresses the tables of the public schema, so tenant schemas cannot be seeded.
+func canSeed(dialect Dialect) bool {
+	pg, ok := dialect.(*PostgresDialect)
+	return ok && !pg.tenant
+}
+
+// ChangedSeeds returns the sorted names of the executed seed units on the graph whose rows have changed since
+// they were executed. They are executed again by the next migration.
+func (g *Graph) ChangedSeeds(dialect string, executed []ExecutedUnit) []string {
+	var changed = []string{}
+	for _, v := range executed {
+		node, ok := g.nodes[v.Name]
+		if ok && isChangedSeed(dialect, node, v) {
+			changed = append(changed, v.Name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func isChangedSeed(dialect string, node *Unit, executed ExecutedUnit) bool {
+	return node.Type == UnitTypeSeed && node.Checksum(dialect) != executed.Checksum
+}
+
+// hasSeeds returns true if the graph contains seed units
+func (g *Graph) hasSeeds() bool {
+	for _, node := range g.nodes {
+		if node.Type == UnitTypeSeed {
+			return true
+		}
+	}
+	return false
+}
+
+// seedDB adapts the transaction of a seed unit to the models package
+type seedDB struct {
+	ctx context.Context
+	tx  Tx
+}
+
+func (d seedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.tx.ExecContext(d.ctx, query, args...)
+}
+
+func (d seedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.tx.QueryContext(d.ctx, query, args...)
+}
+
+func (d seedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return d.tx.QueryRowContext(d.ctx, query, args...)
+}
+
+// runSeed upserts the rows of a seed unit. Rows that already exist keep their snowflake, creation and deletion
+// time, only the columns the unit declares are overwritten, e.g. a category keeps its color if the unit declares
+// none. New rows get a snowflake from SeedIDs.
+func runSeed(ctx context.Context, tx Tx, unit Unit) error {
+	db := seedDB{ctx: ctx, tx: tx}
+	for _, row := range unit.Seed.Categories {
+		category := models.Category{Title: row.Title}
+		existing, err := models.CategoryByTitle(db, row.Title)
+		if err == nil {
+			category.Snowflake, category.CreatedAt, category.DeletedAt =
+				existing.Snowflake, existing.CreatedAt, existing.DeletedAt
+			category.Description, category.Color = existing.Description, existing.Color
+		} else if err == sql.ErrNoRows {
+			category.Snowflake, category.CreatedAt, err = newSeedRow()
+		}
+		if err == nil {
+			if row.Description != "" {
+				category.Description = sql.NullString{String: row.Description, Valid: true}
+			}
+			if row.Color != nil {
+				category.Color = sql.NullInt64{Int64: *row.Color, Valid: true}
+			}
+			err = category.Upsert(db)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not seed category %s: %s", row.Title, err)
+		}
+	}
+	for _, row := range unit.Seed.Groups {
+		var parentID int64
+		if row.Parent != "" {
+			parent, err := models.GroupByName(db, row.Parent)
+			if err != nil {
+				return fmt.Errorf("Could not find parent %s of group %s: %s", row.Parent, row.Name, err)
+			}
+			parentID = parent.Snowflake
+		}
+		group := models.Group{Name: row.Name}
+		existing, err := models.GroupByName(db, row.Name)
+		if err == nil {
+			group.Snowflake, group.CreatedAt, group.DeletedAt = existing.Snowflake, existing.CreatedAt, existing.DeletedAt
+			group.Permission, group.ParentID = existing.Permission, existing.ParentID
+		} else if err == sql.ErrNoRows {
+			group.Snowflake, group.CreatedAt, err = newSeedRow()
+		}
+		if err == nil {
+			if row.Permission != "" {
+				group.Permission = []byte(row.Permission)
+			}
+			if row.Parent != "" {
+				group.ParentID = sql.NullInt64{Int64: parentID, Valid: true}
+			}
+			err = group.Upsert(db)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not seed group %s: %s", row.Name, err)
+		}
+	}
+	return nil
+}
+
+// newSeedRow returns the snowflake and creation time of a row that does not exist yet
+func newSeedRow() (int64, *time.Time, error) {
+	id, err := SeedIDs.NewID()
+	if err != nil {
+		return 0, nil, err
+	}
+	now := time.Now().UTC()
+	return id, &now, nil
+}
@@ -0,0 +1,84 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"strings"
+	"unicode"
+)
+
+// splitStatements splits SQL of the dialect into its statements at semicolons. Semicolons inside of string
+// literals, quoted identifiers, dollar-quoted strings and comments do not end a statement. Dollar-quoted strings
+// only exist on Postgres, on MySQL a dollar sign is part of an identifier and a backslash escapes the next
+// character of a string literal. Statements are trimmed and statements that only consist of comments are dropped.
+func splitStatements(query, dialect string) []string {
+	var statements = []string{}
+	var start = 0
+	var hasCode = false
+	flush := func(end int) {
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(query[start:end]))
+		}
+		start = end
+		hasCode = false
+	}
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == ';':
+			flush(i + 1)
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(query)
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(query)
+			}
+		case c == '\'' || c == '"' || c == '`':
+			hasCode = true
+			// A doubled quote inside of a quoted string is an escaped quote, scanning on finds the next quote
+			escapes := dialect == DialectMySQL && c != '`'
+			for i++; i < len(query) && query[i] != c; i++ {
+				if escapes && query[i] == '\\' {
+					i++
+				}
+			}
+		case c == '$' && dialect == DialectPostgres && (i == 0 || !isIdentifierChar(query[i-1])):
+			hasCode = true
+			if tag := dollarTag(query[i:]); tag != "" {
+				if end := strings.Index(query[i+len(tag):], tag); end >= 0 {
+					i += len(tag) + end + len(tag) - 1
+				} else {
+					i = len(query)
+				}
+			}
+		case !unicode.IsSpace(rune(c)):
+			hasCode = true
+		}
+	}
+	flush(len(query))
+	return statements
+}
+
+// isIdentifierChar returns true if c may be part of an unquoted identifier, a dollar sign following it does not
+// start a dollar-quoted string
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string like $$ or $body$ at the start of s, or an empty
+// string if s does not start with one. Positional parameters like $1 are not tags.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '$' {
+			return s[:i+1]
+		}
+		if !(c == '_' || unicode.IsLetter(rune(c)) || (i > 1 && unicode.IsDigit(rune(c)))) {
+			return ""
+		}
+	}
+	return ""
+}
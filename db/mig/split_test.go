@@ -0,0 +1,61 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.EqualValues([]string{}, splitStatements("", DialectPostgres))
+	assert.EqualValues([]string{}, splitStatements("  \n-- Only a comment\n", DialectPostgres))
+	assert.EqualValues([]string{"SELECT 1"}, splitStatements("SELECT 1", DialectPostgres))
+	assert.EqualValues([]string{
+		"CREATE INDEX CONCURRENTLY a ON t(a);",
+		"CREATE INDEX CONCURRENTLY b ON t(b);",
+	}, splitStatements("CREATE INDEX CONCURRENTLY a ON t(a);\n\tCREATE INDEX CONCURRENTLY b ON t(b);\n", DialectPostgres))
+
+	assert.EqualValues([]string{
+		"SELECT 'a;b', 'it''s;', \"c;d\", `e;f`;",
+		"-- comment; with semicolon\nSELECT 2;",
+		"/* block; comment */ SELECT 3;",
+	}, splitStatements("SELECT 'a;b', 'it''s;', \"c;d\", `e;f`;\n-- comment; with semicolon\nSELECT 2;\n/* block; comment */ SELECT 3;\n-- trailing", DialectPostgres))
+
+	assert.EqualValues([]string{
+		"DO $$ BEGIN PERFORM 1; END $$;",
+		"DO $body$ BEGIN PERFORM $1; END $body$;",
+		"SELECT $1;",
+	}, splitStatements("DO $$ BEGIN PERFORM 1; END $$;\nDO $body$ BEGIN PERFORM $1; END $body$;\nSELECT $1;", DialectPostgres))
+
+	// Backslashes only escape quotes on MySQL, elsewhere they end the string
+	assert.EqualValues([]string{
+		`INSERT INTO t VALUES ('a\';b', "c\";d");`,
+		"SELECT 2;",
+	}, splitStatements(`INSERT INTO t VALUES ('a\';b', "c\";d"); SELECT 2;`, DialectMySQL))
+	assert.EqualValues([]string{
+		`SELECT 'a\';`,
+		`SELECT 'b';`,
+	}, splitStatements(`SELECT 'a\'; SELECT 'b';`, DialectPostgres))
+
+	// Dollar signs only quote on Postgres and not inside of identifiers
+	assert.EqualValues([]string{
+		"CREATE TABLE price$eur$ (a int);",
+		"SELECT $x$;",
+		"SELECT 2;",
+	}, splitStatements("CREATE TABLE price$eur$ (a int);\nSELECT $x$;\nSELECT 2;", DialectMySQL))
+	assert.EqualValues([]string{
+		"CREATE TABLE price$eur$ (a int);",
+		"SELECT 2;",
+	}, splitStatements("CREATE TABLE price$eur$ (a int);\nSELECT 2;", DialectPostgres))
+}
+
+func TestDollarTag(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("$$", dollarTag("$$ body $$"))
+	assert.Equal("$body_1$", dollarTag("$body_1$ text $body_1$"))
+	assert.Equal("", dollarTag("$1"))
+	assert.Equal("", dollarTag("$"))
+	assert.Equal("", dollarTag("$a b$"))
+}
@@ -0,0 +1,151 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var sqlFileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// SQLDirOptions describes how LoadSQLDir turns a directory of SQL files into units
+type SQLDirOptions struct {
+	// Prefix is prepended to the names of the units, with a prefix of "legacy" the file 001_init.up.sql becomes
+	// the unit "legacy/001_init"
+	Prefix string
+	// Target is the name of the target depending on the last unit, it defaults to the prefix
+	Target string
+	// Dialect is the dialect the SQL files are written for
+	Dialect string
+	// DependsOn lists the dependencies of the first unit, it defaults to "nothing"
+	DependsOn []string
+}
+
+// LoadSQLDir loads the numbered migrations in the root of a file system as written for golang-migrate,
+// NNN_name.up.sql and the optional NNN_name.down.sql, into the graph. The file system can be a directory opened
+// with os.DirFS, an embed.FS or a fstest.MapFS, use fs.Sub to load a subdirectory. The migrations become a chain
+// of units in the order of their numbers, every unit depends on the one before it, and a target depends on the
+// last unit. The SQL is used as is for the dialect of the options, it is not rendered as a template.
+//
+// Files that are not named like migrations are ignored, two migrations with the same number, down files
+// without an up file and units whose names already exist in the graph are errors.
+func (g *Graph) LoadSQLDir(fsys fs.FS, opts SQLDirOptions) error {
+	if opts.Prefix == "" {
+		return fmt.Errorf("SQL directory needs a prefix for its units")
+	}
+	if _, ok := sqlSectionFor(opts.Dialect, ""); !ok {
+		return fmt.Errorf("Unknown dialect %q for SQL directory", opts.Dialect)
+	}
+	if opts.Target == "" {
+		opts.Target = opts.Prefix
+	}
+	if len(opts.DependsOn) == 0 {
+		opts.DependsOn = []string{nothingUnit.Name}
+	}
+
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	type migration struct {
+		version uint64
+		name    string
+		up      *string
+		down    *string
+	}
+	var migrations = map[uint64]*migration{}
+	for _, file := range files {
+		match := sqlFileRegexp.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid migration number in %s: %s", file.Name(), err)
+		}
+		dat, err := fs.ReadFile(fsys, file.Name())
+		if err != nil {
+			return err
+		}
+		name := match[1] + "_" + match[2]
+		m, ok := migrations[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			migrations[version] = m
+		} else if m.name != name {
+			return fmt.Errorf("Migrations %s and %s have the same number", m.name, name)
+		}
+		sql := string(dat)
+		if match[3] == "up" {
+			m.up = &sql
+		} else {
+			m.down = &sql
+		}
+	}
+
+	var sorted = make([]*migration, 0, len(migrations))
+	for _, m := range migrations {
+		if m.up == nil {
+			return fmt.Errorf("Migration %s has a down file but no up file", m.name)
+		}
+		sorted = append(sorted, m)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].version < sorted[j].version })
+
+	var units = make([]*Unit, 0, len(sorted)+1)
+	var dependsOn = opts.DependsOn
+	for _, m := range sorted {
+		unit := &Unit{
+			Name:        opts.Prefix + "/" + m.name,
+			Description: fmt.Sprintf("Imported from %s.up.sql", m.name),
+			DependsOn:   dependsOn,
+			Type:        UnitTypeMigration,
+		}
+		unit.SQL, _ = sqlSectionFor(opts.Dialect, *m.up)
+		if m.down != nil {
+			unit.Down, _ = sqlSectionFor(opts.Dialect, *m.down)
+		}
+		units = append(units, unit)
+		dependsOn = []string{unit.Name}
+	}
+	units = append(units, &Unit{
+		Name:        opts.Target,
+		Description: fmt.Sprintf("Migrations imported as %s", opts.Prefix),
+		DependsOn:   dependsOn,
+		Type:        UnitTypeVirtualTarget,
+	})
+
+	// Units are imported from the file of their up migration, the target from the directory
+	var sources = map[string]string{opts.Target: "the SQL directory of " + opts.Prefix}
+	for _, m := range sorted {
+		sources[opts.Prefix+"/"+m.name] = m.name + ".up.sql"
+	}
+	for _, unit := range units {
+		err = g.conflict(unit.Name, sources[unit.Name])
+		if err != nil {
+			return err
+		}
+	}
+	for _, unit := range units {
+		err = g.addUnit(unit, sources[unit.Name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlSectionFor returns a SQL section that only contains SQL for the dialect, false for unknown dialects
+func sqlSectionFor(dialect, sql string) (SQLSection, bool) {
+	switch dialect {
+	case DialectPostgres:
+		return SQLSection{Postgres: sql}, true
+	case DialectSQLite:
+		return SQLSection{SQLite: sql}, true
+	case DialectMySQL:
+		return SQLSection{MySQL: sql}, true
+	}
+	return SQLSection{}, false
+}
@@ -0,0 +1,119 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestGraph_LoadSQLDir(t *testing.T) {
+	assert := require.New(t)
+
+	dir := fstest.MapFS{
+		"10_add_posts.up.sql":      {Data: []byte("CREATE TABLE posts (id integer);")},
+		"2_add_users.up.sql":       {Data: []byte("CREATE TABLE users (id integer);")},
+		"2_add_users.down.sql":     {Data: []byte("DROP TABLE users;")},
+		"1_init.up.sql":            {Data: []byte("")},
+		"README.md":                {Data: []byte("Migrations of the old forum")},
+		"archive/3_old.up.sql":     {Data: []byte("CREATE TABLE old (id integer);")},
+		"archive/3_old.down.sql":   {Data: []byte("DROP TABLE old;")},
+		"archive/4_older.down.sql": {Data: []byte("DROP TABLE older;")},
+	}
+
+	graph := NewGraph()
+	assert.NoError(graph.Load("arke"))
+	assert.NoError(graph.LoadSQLDir(dir, SQLDirOptions{Prefix: "legacy", Dialect: DialectSQLite}))
+	assert.NoError(graph.ValidateNodes())
+
+	unit, err := graph.GetUnit("legacy/1_init")
+	assert.NoError(err)
+	assert.EqualValues([]string{"nothing"}, unit.DependsOn)
+	assert.EqualValues(UnitTypeMigration, unit.Type)
+	assert.Equal("Imported from 1_init.up.sql", unit.Description)
+
+	unit, err = graph.GetUnit("legacy/2_add_users")
+	assert.NoError(err)
+	assert.EqualValues([]string{"legacy/1_init"}, unit.DependsOn)
+	assert.Equal(SQLSection{SQLite: "CREATE TABLE users (id integer);"}, unit.SQL)
+	assert.Equal(SQLSection{SQLite: "DROP TABLE users;"}, unit.Down)
+
+	unit, err = graph.GetUnit("legacy/10_add_posts")
+	assert.NoError(err)
+	assert.EqualValues([]string{"legacy/2_add_users"}, unit.DependsOn)
+	assert.True(unit.Down.Get(DialectSQLite) == "")
+
+	_, err = graph.GetUnit("legacy/3_old")
+	assert.Error(err, "Subdirectories must not be imported")
+
+	target, err := graph.GetUnit("legacy")
+	assert.NoError(err)
+	assert.EqualValues(UnitTypeVirtualTarget, target.Type)
+	assert.EqualValues([]string{"legacy/10_add_posts"}, target.DependsOn)
+
+	subgraph, err := graph.GetTargetSubgraph("legacy")
+	assert.NoError(err)
+	assert.Equal(5, subgraph.Size())
+
+	// A second import can depend on the first and have its own target name
+	assert.NoError(graph.LoadSQLDir(dir, SQLDirOptions{Prefix: "copy", Target: "copy-target",
+		Dialect: DialectSQLite, DependsOn: []string{"legacy"}}))
+	unit, err = graph.GetUnit("copy/1_init")
+	assert.NoError(err)
+	assert.EqualValues([]string{"legacy"}, unit.DependsOn)
+	_, err = graph.GetUnit("copy-target")
+	assert.NoError(err)
+	assert.NoError(graph.ValidateNodes())
+}
+
+func TestGraph_LoadSQLDir_DirFS(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "vape-sqldir")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "1_init.up.sql"), []byte("SELECT 1;"), 0644))
+
+	graph := NewGraph()
+	assert.NoError(graph.LoadSQLDir(os.DirFS(dir), SQLDirOptions{Prefix: "legacy", Dialect: DialectPostgres}))
+	unit, err := graph.GetUnit("legacy/1_init")
+	assert.NoError(err)
+	assert.Equal(SQLSection{Postgres: "SELECT 1;"}, unit.SQL)
+
+	assert.Error(graph.LoadSQLDir(os.DirFS(filepath.Join(dir, "does-not-exist")),
+		SQLDirOptions{Prefix: "missing", Dialect: DialectSQLite}))
+}
+
+func TestGraph_LoadSQLDir_Errors(t *testing.T) {
+	assert := require.New(t)
+
+	dir := fstest.MapFS{"1_init.up.sql": {Data: []byte("SELECT 1;")}}
+
+	graph := NewGraph()
+	assert.EqualError(graph.LoadSQLDir(dir, SQLDirOptions{Dialect: DialectSQLite}),
+		"SQL directory needs a prefix for its units")
+	assert.EqualError(graph.LoadSQLDir(dir, SQLDirOptions{Prefix: "legacy", Dialect: "oracle"}),
+		`Unknown dialect "oracle" for SQL directory`)
+
+	assert.NoError(graph.LoadSQLDir(dir, SQLDirOptions{Prefix: "legacy", Dialect: DialectSQLite}))
+	assert.EqualError(graph.LoadSQLDir(dir, SQLDirOptions{Prefix: "legacy", Target: "other",
+		Dialect: DialectSQLite}), "Unit legacy/1_init from 1_init.up.sql conflicts with the unit of the same name "+
+		"from 1_init.up.sql")
+	_, err := graph.GetUnit("other")
+	assert.Error(err, "A failed import must not add any units")
+	assert.EqualError(graph.LoadSQLDir(fstest.MapFS{"2_users.up.sql": {Data: []byte("SELECT 2;")}},
+		SQLDirOptions{Prefix: "users", Target: "legacy", Dialect: DialectSQLite}),
+		"Unit legacy from the SQL directory of users conflicts with the unit of the same name from the SQL "+
+			"directory of legacy")
+
+	dir["001_init.up.sql"] = &fstest.MapFile{Data: []byte("SELECT 2;")}
+	assert.Contains(graph.LoadSQLDir(dir, SQLDirOptions{Prefix: "dup", Dialect: DialectSQLite}).Error(),
+		"have the same number")
+	delete(dir, "001_init.up.sql")
+
+	dir["2_users.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE users;")}
+	assert.EqualError(graph.LoadSQLDir(dir, SQLDirOptions{Prefix: "down", Dialect: DialectSQLite}),
+		"Migration 2_users has a down file but no up file")
+}
@@ -0,0 +1,302 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"bytes"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const pgDumpUnsupportedQuery = `SELECT 'view ' || c.relname FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind IN ('v', 'm') AND n.nspname = current_schema()
+UNION ALL SELECT 'function ' || p.proname FROM pg_proc p
+JOIN pg_namespace n ON n.oid = p.pronamespace WHERE n.nspname = current_schema()
+UNION ALL SELECT 'type ' || t.typname FROM pg_type t
+JOIN pg_namespace n ON n.oid = t.typnamespace WHERE t.typtype IN ('d', 'e', 'r') AND n.nspname = current_schema()
+UNION ALL SELECT 'trigger ' || tg.tgname FROM pg_trigger tg JOIN pg_class c ON c.oid = tg.tgrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace WHERE NOT tg.tgisinternal AND n.nspname = current_schema();`
+
+const pgDumpSequencesQuery = `SELECT quote_ident(c.relname) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'S' AND n.nspname = current_schema() AND c.relname NOT LIKE 'vape\_%'
+AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = c.oid AND d.deptype = 'i')
+ORDER BY c.relname;`
+
+const pgDumpColumnsQuery = `SELECT quote_ident(c.relname), quote_ident(a.attname), format_type(a.atttypid, a.atttypmod),
+CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END, coalesce(pg_get_expr(d.adbin, d.adrelid), '')
+FROM pg_attribute a JOIN pg_class c ON c.oid = a.attrelid JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE c.relkind = 'r' AND n.nspname = current_schema() AND c.relname NOT LIKE 'vape\_%'
+AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY c.relname, a.attnum;`
+
+const pgDumpConstraintsQuery = `SELECT quote_ident(c.relname), quote_ident(con.conname), pg_get_constraintdef(con.oid), con.contype::text
+FROM pg_constraint con JOIN pg_class c ON c.oid = con.conrelid JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = current_schema() AND c.relname NOT LIKE 'vape\_%' AND con.contype IN ('p', 'u', 'c', 'x', 'f')
+ORDER BY c.relname, con.contype = 'f', con.conname;`
+
+const pgDumpIndexesQuery = `SELECT pg_get_indexdef(i.indexrelid) FROM pg_index i
+JOIN pg_class ic ON ic.oid = i.indexrelid JOIN pg_class c ON c.oid = i.indrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = current_schema() AND c.relname NOT LIKE 'vape\_%'
+AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid AND con.contype IN ('p', 'u', 'x'))
+ORDER BY ic.relname;`
+
+const sqliteDumpQuery = `SELECT sql FROM sqlite_master
+WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite\_%' ESCAPE '\' AND tbl_name NOT LIKE 'vape\_%' ESCAPE '\'
+ORDER BY CASE type WHEN 'table' THEN 0 WHEN 'index' THEN 1 WHEN 'view' THEN 2 ELSE 3 END, name;`
+
+const mysqlDumpUnsupportedQuery = `SELECT concat('view ', table_name) FROM information_schema.views
+WHERE table_schema = DATABASE()
+UNION ALL SELECT concat('routine ', routine_name) FROM information_schema.routines WHERE routine_schema = DATABASE()
+UNION ALL SELECT concat('trigger ', trigger_name) FROM information_schema.triggers WHERE trigger_schema = DATABASE();`
+
+const mysqlDumpTablesQuery = `SELECT table_name FROM information_schema.tables
+WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' AND table_name NOT LIKE 'vape\_%'
+ORDER BY table_name;`
+
+var mysqlAutoIncrementRegexp = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// SchemaDumper is implemented by dialects that can write the DDL of the current schema, like pg_dump --schema-only
+// does. The tables of the migration toolkit are left out.
+type SchemaDumper interface {
+	// DumpSchema returns the statements creating the tables, sequences, constraints and indexes of the schema
+	DumpSchema() (string, error)
+}
+
+var _ SchemaDumper = (*PostgresDialect)(nil)
+var _ SchemaDumper = (*SQLiteDialect)(nil)
+var _ SchemaDumper = (*MySQLDialect)(nil)
+
+// DumpSchema returns the statements creating the sequences, tables, constraints and indexes of the current schema.
+// Schemas containing views, functions, custom types or triggers cannot be dumped.
+func (d *PostgresDialect) DumpSchema() (string, error) {
+	err := checkDumpable(d.db, pgDumpUnsupportedQuery)
+	if err != nil {
+		return "", err
+	}
+	var rows = make([][][]string, 4)
+	for i, query := range []string{pgDumpSequencesQuery, pgDumpColumnsQuery, pgDumpConstraintsQuery,
+		pgDumpIndexesQuery} {
+		rows[i], err = queryStrings(d.db, query)
+		if err != nil {
+			return "", err
+		}
+	}
+	return writePGDump(rows[0], rows[1], rows[2], rows[3]), nil
+}
+
+// DumpSchema returns the statements of the database as stored by SQLite, tables first
+func (d *SQLiteDialect) DumpSchema() (string, error) {
+	rows, err := queryStrings(d.db, sqliteDumpQuery)
+	if err != nil {
+		return "", err
+	}
+	var statements = make([]string, 0, len(rows))
+	for _, row := range rows {
+		statements = append(statements, strings.TrimSpace(row[0])+";\n")
+	}
+	return strings.Join(statements, "\n"), nil
+}
+
+// DumpSchema returns the statements creating the tables of the current database as reported by SHOW CREATE TABLE.
+// Foreign key checks are disabled while the tables are created, so they may be created in any order. Databases
+// containing views, routines or triggers cannot be dumped.
+func (d *MySQLDialect) DumpSchema() (string, error) {
+	err := checkDumpable(d.db, mysqlDumpUnsupportedQuery)
+	if err != nil {
+		return "", err
+	}
+	tables, err := queryStrings(d.db, mysqlDumpTablesQuery)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("SET FOREIGN_KEY_CHECKS = 0;\n")
+	for _, table := range tables {
+		rows, err := queryStrings(d.db, "SHOW CREATE TABLE `"+strings.Replace(table[0], "`", "``", -1)+"`;")
+		if err != nil {
+			return "", err
+		}
+		if len(rows) != 1 || len(rows[0]) < 2 {
+			return "", fmt.Errorf("Could not read the definition of table %s", table[0])
+		}
+		fmt.Fprintf(&buf, "\n%s;\n", mysqlAutoIncrementRegexp.ReplaceAllString(rows[0][1], ""))
+	}
+	buf.WriteString("\nSET FOREIGN_KEY_CHECKS = 1;\n")
+	return buf.String(), nil
+}
+
+// checkDumpable runs a query listing the objects of the schema a dump cannot contain
+func checkDumpable(db minimalDB, query string) error {
+	rows, err := queryStrings(db, query)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	var objects = make([]string, 0, len(rows))
+	for _, row := range rows {
+		objects = append(objects, row[0])
+	}
+	return fmt.Errorf("Schema contains objects that cannot be dumped: %s", strings.Join(objects, ", "))
+}
+
+// writePGDump writes the DDL of a Postgres schema in the layout of pg_dump. Sequences are created first, then the
+// tables with their columns and constraints. Foreign keys are added once all tables exist, followed by the indexes
+// that do not belong to a constraint.
+//
+// sequences contains sequence names, columns the table, name, type, nullability ("YES" or "NO") and default of
+// every column, constraints the table, name, definition and type of every constraint and indexes the definition
+// of every index.
+func writePGDump(sequences, columns, constraints, indexes [][]string) string {
+	var buf bytes.Buffer
+	for _, row := range sequences {
+		fmt.Fprintf(&buf, "CREATE SEQUENCE %s;\n\n", row[0])
+	}
+	var tables = []string{}
+	var definitions = map[string][]string{}
+	for _, row := range columns {
+		if _, ok := definitions[row[0]]; !ok {
+			tables = append(tables, row[0])
+		}
+		definition := row[1] + " " + row[2]
+		if row[4] != "" {
+			definition += " DEFAULT " + row[4]
+		}
+		if row[3] == "NO" {
+			definition += " NOT NULL"
+		}
+		definitions[row[0]] = append(definitions[row[0]], definition)
+	}
+	var foreignKeys = []string{}
+	for _, row := range constraints {
+		if row[3] == "f" {
+			foreignKeys = append(foreignKeys, fmt.Sprintf("ALTER TABLE ONLY %s\n    ADD CONSTRAINT %s %s;\n",
+				row[0], row[1], row[2]))
+			continue
+		}
+		definitions[row[0]] = append(definitions[row[0]], fmt.Sprintf("CONSTRAINT %s %s", row[1], row[2]))
+	}
+	for _, table := range tables {
+		fmt.Fprintf(&buf, "CREATE TABLE %s (\n    %s\n);\n\n", table, strings.Join(definitions[table], ",\n    "))
+	}
+	for _, foreignKey := range foreignKeys {
+		fmt.Fprintf(&buf, "%s\n", foreignKey)
+	}
+	for _, row := range indexes {
+		fmt.Fprintf(&buf, "%s;\n", row[0])
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// SquashOptions describes a unit written by WriteSquashUnit
+type SquashOptions struct {
+	// Description is written to the unit file
+	Description string
+	// Dialect is the dialect of the SQL
+	Dialect string
+	// SQL creates the schema of the squashed units, see SchemaDumper
+	SQL string
+	// Squashes lists the units the unit replaces
+	Squashes []string
+}
+
+// WriteSquashUnit writes the file of a unit replacing the squashed units to the directory. The unit depends on
+// nothing and creates the schema with the SQL of the options for their dialect. The squashed units have to be
+// removed from the graph before it can be loaded, see Unit.Squashes.
+func WriteSquashUnit(dir, name string, opts SquashOptions) error {
+	name = strings.TrimSuffix(name, ".yaml")
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "..") {
+		return fmt.Errorf("Invalid unit name %q", name)
+	}
+	if _, ok := sqlSectionFor(opts.Dialect, ""); !ok {
+		return fmt.Errorf("Unknown dialect %q", opts.Dialect)
+	}
+	if len(opts.Squashes) == 0 {
+		return fmt.Errorf("Unit %s squashes no units", name)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "description: %s\n", quoteYAML(opts.Description))
+	buf.WriteString("depends_on:\n- nothing\nsquashes:\n")
+	for _, squashed := range opts.Squashes {
+		fmt.Fprintf(&buf, "- %s\n", squashed)
+	}
+	fmt.Fprintf(&buf, "sql:\n  %s: |\n", opts.Dialect)
+	for _, line := range strings.Split(strings.TrimRight(opts.SQL, "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			buf.WriteString("\n")
+		} else {
+			fmt.Fprintf(&buf, "    %s\n", line)
+		}
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(name+".yaml"))
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("Unit %s already exists", name)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SatisfyBaselines marks the pending units squashing other units as satisfied if all units they squash have been
+// executed, they are recorded without executing their SQL. It returns the names of the satisfied units. A database
+// that has only executed some of the squashed units cannot be migrated with the squashing unit.
+func (g *Graph) SatisfyBaselines(executedUnits []string) ([]string, error) {
+	var executed = map[string]bool{}
+	for _, name := range executedUnits {
+		executed[name] = true
+	}
+	var satisfied = []string{}
+	for _, name := range g.sortedNames() {
+		node := g.nodes[name]
+		if node.executed || len(node.Squashes) == 0 {
+			continue
+		}
+		var missing = []string{}
+		for _, squashed := range node.Squashes {
+			if !executed[squashed] {
+				missing = append(missing, squashed)
+			}
+		}
+		if len(missing) == len(node.Squashes) {
+			continue
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("Unit %s squashes units of which only some have been executed, migrate with a "+
+				"version containing %v first", name, missing)
+		}
+		node.satisfied = true
+		satisfied = append(satisfied, name)
+	}
+	return satisfied, nil
+}
+
+// satisfyBaselines marks the units of the graph whose squashed units have been executed as satisfied, see
+// Graph.SatisfyBaselines
+func (r *Runner) satisfyBaselines(g *Graph, executedUnits []string) error {
+	satisfied, err := g.SatisfyBaselines(executedUnits)
+	if err != nil {
+		return err
+	}
+	for _, name := range satisfied {
+		r.log.Info("Units squashed into unit have been executed, it is recorded without executing it",
+			zap.String("unit", name))
+	}
+	return nil
+}
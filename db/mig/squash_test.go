@@ -0,0 +1,120 @@
+package mig
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWritePGDump(t *testing.T) {
+	assert := require.New(t)
+
+	dump := writePGDump(
+		[][]string{{"counters_id_seq"}},
+		[][]string{
+			{"counters", "id", "bigint", "NO", "nextval('counters_id_seq'::regclass)"},
+			{"groups", "snowflake", "bigint", "NO", ""},
+			{"groups", "name", "character varying(1024)", "NO", ""},
+			{"groups", "parent_id", "bigint", "YES", ""},
+		},
+		[][]string{
+			{"groups", "groups_name_key", "UNIQUE (name)", "u"},
+			{"groups", "groups_pkey", "PRIMARY KEY (snowflake)", "p"},
+			{"groups", "groups_parent_id_fkey", "FOREIGN KEY (parent_id) REFERENCES groups(snowflake)", "f"},
+		},
+		[][]string{{"CREATE INDEX groups_name_index ON groups USING btree (name)"}},
+	)
+	assert.Equal(`CREATE SEQUENCE counters_id_seq;
+
+CREATE TABLE counters (
+    id bigint DEFAULT nextval('counters_id_seq'::regclass) NOT NULL
+);
+
+CREATE TABLE groups (
+    snowflake bigint NOT NULL,
+    name character varying(1024) NOT NULL,
+    parent_id bigint,
+    CONSTRAINT groups_name_key UNIQUE (name),
+    CONSTRAINT groups_pkey PRIMARY KEY (snowflake)
+);
+
+ALTER TABLE ONLY groups
+    ADD CONSTRAINT groups_parent_id_fkey FOREIGN KEY (parent_id) REFERENCES groups(snowflake);
+
+CREATE INDEX groups_name_index ON groups USING btree (name);`, dump)
+	assert.Equal("", writePGDump(nil, nil, nil, nil))
+}
+
+func TestWriteSquashUnit(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "vape-squash")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	sql := "CREATE TABLE test (\n    id bigint NOT NULL\n);\n\nCREATE INDEX test_index ON test (id);\n"
+	opts := SquashOptions{
+		Description: `Schema of target "default"`,
+		Dialect:     DialectPostgres,
+		SQL:         sql,
+		Squashes:    []string{"setup/create_test", "setup/index_test"},
+	}
+	assert.NoError(WriteSquashUnit(dir, "baseline/v1", opts))
+
+	dat, err := ioutil.ReadFile(filepath.Join(dir, "baseline", "v1.yaml"))
+	assert.NoError(err)
+	unit, problems := LintUnit("baseline/v1.yaml", dat)
+	assert.Empty(problems)
+	assert.Equal(`Schema of target "default"`, unit.Description)
+	assert.EqualValues([]string{"nothing"}, unit.DependsOn)
+	assert.EqualValues(opts.Squashes, unit.Squashes)
+	assert.Equal(SQLSection{Postgres: sql}, unit.SQL)
+
+	assert.EqualError(WriteSquashUnit(dir, "baseline/v1", opts), "Unit baseline/v1 already exists")
+	assert.EqualError(WriteSquashUnit(dir, "../v2", opts), `Invalid unit name "../v2"`)
+	opts.Squashes = nil
+	assert.EqualError(WriteSquashUnit(dir, "baseline/v2", opts), "Unit baseline/v2 squashes no units")
+	opts.Dialect = "oracle"
+	assert.EqualError(WriteSquashUnit(dir, "baseline/v2", opts), `Unknown dialect "oracle"`)
+}
+
+func TestGraph_SatisfyBaselines(t *testing.T) {
+	assert := require.New(t)
+
+	newGraph := func() *Graph {
+		graph := NewGraph()
+		graph.nodes["baseline"] = &Unit{Name: "baseline", DependsOn: []string{"nothing"}, Type: UnitTypeMigration,
+			Squashes: []string{"old1", "old2"}, SQL: SQLSection{Postgres: "CREATE TABLE test (id integer);"}}
+		graph.nodes["later"] = &Unit{Name: "later", DependsOn: []string{"baseline"}, Type: UnitTypeMigration}
+		return graph
+	}
+
+	graph := newGraph()
+	satisfied, err := graph.SatisfyBaselines([]string{"old1", "old2"})
+	assert.NoError(err)
+	assert.EqualValues([]string{"baseline"}, satisfied)
+	assert.True(graph.nodes["baseline"].IsSatisfied())
+	assert.False(graph.nodes["later"].IsSatisfied())
+
+	// The plan still contains the unit, scripts only record it
+	plan, err := graph.GetPlan()
+	assert.NoError(err)
+	assert.True(plan[0][0].IsSatisfied())
+	var script bytes.Buffer
+	assert.NoError(writeScript(&script, DialectPostgres, "", plan[:1], true))
+	assert.NotContains(script.String(), "CREATE TABLE test")
+	assert.Contains(script.String(), "INSERT INTO vape_migrations (name, type, hash) VALUES ('baseline', 'migration'")
+
+	graph = newGraph()
+	satisfied, err = graph.SatisfyBaselines(nil)
+	assert.NoError(err)
+	assert.Empty(satisfied)
+	assert.False(graph.nodes["baseline"].IsSatisfied())
+
+	_, err = newGraph().SatisfyBaselines([]string{"old1"})
+	assert.EqualError(err, "Unit baseline squashes units of which only some have been executed, migrate with a "+
+		"version containing [old2] first")
+}
@@ -0,0 +1,146 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"sort"
+	"time"
+)
+
+// UnitState describes the state of a unit in relation to the migration table
+type UnitState string
+
+const (
+	// UnitStateApplied marks a unit that is recorded in the migration table. A target is applied once all
+	// of its dependencies are applied.
+	UnitStateApplied UnitState = "applied"
+	// UnitStateDrifted marks an applied unit whose SQL has changed since it was executed
+	UnitStateDrifted UnitState = "drifted"
+	// UnitStatePending marks a unit that will be executed on the next migration, including seed units whose rows
+	// have changed since they were executed
+	UnitStatePending UnitState = "pending"
+	// UnitStateSatisfied marks a unit squashing units that have all been executed, the next migration records it
+	// without executing it, see Graph.SatisfyBaselines
+	UnitStateSatisfied UnitState = "satisfied"
+	// UnitStateNotInGraph marks a unit that is recorded in the migration table but not present on the graph
+	UnitStateNotInGraph UnitState = "not_in_graph"
+	// UnitStateAlwaysExec marks a unit that is executed on every migration and never recorded
+	UnitStateAlwaysExec UnitState = "always_exec"
+	// UnitStateSkipped marks a unit that is not part of the environment of the graph or whose run_if query
+	// returned false, see Graph.EvaluateConditions
+	UnitStateSkipped UnitState = "skipped"
+)
+
+// UnitStatus is the state of a single unit as reported by GetStatus
+type UnitStatus struct {
+	Name       string     `json:"name"`
+	Type       UnitType   `json:"type"`
+	State      UnitState  `json:"state"`
+	ExecutedOn *time.Time `json:"executed_on,omitempty"`
+}
+
+// GetStatus compares the units on the graph with the units recorded in the migration table of the given dialect.
+//
+// The units of the graph are returned in execution order, followed by the recorded units that are not on
+// the graph. The "nothing" unit is not part of the status. Units squashing executed units are satisfied, which marks
+// them on the graph like Graph.SatisfyBaselines does.
+func (g *Graph) GetStatus(dialect string, executed []ExecutedUnit) ([]UnitStatus, error) {
+	order, err := g.GetExecutionOrder()
+	if err != nil {
+		return nil, err
+	}
+	var executedMap = map[string]ExecutedUnit{}
+	var executedNames = make([]string, 0, len(executed))
+	for _, v := range executed {
+		executedMap[v.Name] = v
+		executedNames = append(executedNames, v.Name)
+	}
+	satisfiedNames, err := g.SatisfyBaselines(executedNames)
+	if err != nil {
+		return nil, err
+	}
+	var satisfied = map[string]bool{}
+	for _, name := range satisfiedNames {
+		satisfied[name] = true
+	}
+	var states = map[string]UnitState{
+		nothingUnit.Name: UnitStateApplied,
+	}
+	var status = []UnitStatus{}
+	for _, name := range order {
+		if name == nothingUnit.Name {
+			continue
+		}
+		node := g.nodes[name]
+		var unitStatus = UnitStatus{
+			Name:  node.Name,
+			Type:  node.Type,
+			State: UnitStatePending,
+		}
+		switch {
+		case node.Type == UnitTypeVirtualTarget:
+			unitStatus.State = UnitStateApplied
+			for _, dep := range node.DependsOn {
+				if states[dep] == UnitStatePending || states[dep] == UnitStateSatisfied {
+					unitStatus.State = UnitStatePending
+				}
+			}
+		case node.AlwaysExec:
+			unitStatus.State = UnitStateAlwaysExec
+		default:
+			if v, ok := executedMap[name]; ok {
+				executedOn := v.ExecutedOn
+				unitStatus.State = UnitStateApplied
+				unitStatus.ExecutedOn = &executedOn
+				if isDrifted(dialect, node, v) {
+					unitStatus.State = UnitStateDrifted
+				}
+				if isChangedSeed(dialect, node, v) {
+					unitStatus.State = UnitStatePending
+				}
+			} else if satisfied[name] {
+				unitStatus.State = UnitStateSatisfied
+			} else if node.skipped {
+				unitStatus.State = UnitStateSkipped
+			}
+		}
+		states[name] = unitStatus.State
+		status = append(status, unitStatus)
+	}
+	for _, v := range executed {
+		if _, ok := g.nodes[v.Name]; ok {
+			continue
+		}
+		executedOn := v.ExecutedOn
+		status = append(status, UnitStatus{
+			Name:       v.Name,
+			Type:       v.Type,
+			State:      UnitStateNotInGraph,
+			ExecutedOn: &executedOn,
+		})
+	}
+	return status, nil
+}
+
+// GetDriftedUnits returns the sorted names of all executed units on the graph whose checksum for the dialect
+// differs from the checksum recorded in the migration table. Units without a recorded checksum are never reported,
+// neither are seed units, which are executed again when their rows change.
+func (g *Graph) GetDriftedUnits(dialect string, executed []ExecutedUnit) []string {
+	var drifted = []string{}
+	for _, v := range executed {
+		node, ok := g.nodes[v.Name]
+		if !ok {
+			continue
+		}
+		if isDrifted(dialect, node, v) {
+			drifted = append(drifted, v.Name)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted
+}
+
+func isDrifted(dialect string, node *Unit, executed ExecutedUnit) bool {
+	if node.Type == UnitTypeVirtualTarget || node.Type == UnitTypeSeed || executed.Checksum == "" {
+		return false
+	}
+	return node.Checksum(dialect) != executed.Checksum
+}
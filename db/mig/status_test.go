@@ -0,0 +1,168 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGraph_GetStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+
+	graph.nodes["default"] = &Unit{
+		Name:      "default",
+		DependsOn: []string{"default2", "default3"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["default2"] = &Unit{
+		Name:      "default2",
+		DependsOn: []string{"nothing"},
+		Type:      UnitTypeMigration,
+	}
+
+	graph.nodes["default3"] = &Unit{
+		Name:      "default3",
+		DependsOn: []string{"default2"},
+		Type:      UnitTypeMigration,
+	}
+
+	graph.nodes["default4"] = &Unit{
+		Name:       "default4",
+		DependsOn:  []string{"nothing"},
+		Type:       UnitTypeMigration,
+		AlwaysExec: true,
+	}
+
+	executedOn := time.Date(2017, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+	status, err := graph.GetStatus(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Type: UnitTypeMigration, ExecutedOn: executedOn},
+		{Name: "removed", Type: UnitTypeMigration, ExecutedOn: executedOn},
+	})
+	assert.NoError(err)
+	assert.EqualValues([]UnitStatus{
+		{Name: "default2", Type: UnitTypeMigration, State: UnitStateApplied, ExecutedOn: &executedOn},
+		{Name: "default4", Type: UnitTypeMigration, State: UnitStateAlwaysExec},
+		{Name: "default3", Type: UnitTypeMigration, State: UnitStatePending},
+		{Name: "default", Type: UnitTypeVirtualTarget, State: UnitStatePending},
+		{Name: "removed", Type: UnitTypeMigration, State: UnitStateNotInGraph, ExecutedOn: &executedOn},
+	}, status)
+
+	status, err = graph.GetStatus(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Type: UnitTypeMigration, ExecutedOn: executedOn},
+		{Name: "default3", Type: UnitTypeMigration, ExecutedOn: executedOn},
+	})
+	assert.NoError(err)
+	assert.Equal(UnitStateApplied, status[3].State)
+
+	status, err = graph.GetStatus(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Type: UnitTypeMigration, ExecutedOn: executedOn, Checksum: "modified"},
+	})
+	assert.NoError(err)
+	assert.Equal(UnitStateDrifted, status[0].State)
+
+	// Skipped units do not keep targets pending, units recorded before they were skipped stay applied
+	graph.nodes["default3"].skipped = true
+	status, err = graph.GetStatus(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Type: UnitTypeMigration, ExecutedOn: executedOn},
+	})
+	assert.NoError(err)
+	assert.Equal(UnitStateSkipped, status[2].State)
+	assert.Equal(UnitStateApplied, status[3].State)
+	graph.nodes["default2"].skipped = true
+	status, err = graph.GetStatus(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Type: UnitTypeMigration, ExecutedOn: executedOn},
+	})
+	assert.NoError(err)
+	assert.Equal(UnitStateApplied, status[0].State)
+	graph.nodes["default2"].skipped = false
+	graph.nodes["default3"].skipped = false
+
+	// Units squashing executed units are recorded by the next migration, they keep targets pending until then
+	graph.nodes["default3"].Squashes = []string{"old1", "old2"}
+	status, err = graph.GetStatus(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Type: UnitTypeMigration, ExecutedOn: executedOn},
+		{Name: "old1", Type: UnitTypeMigration, ExecutedOn: executedOn},
+		{Name: "old2", Type: UnitTypeMigration, ExecutedOn: executedOn},
+	})
+	assert.NoError(err)
+	assert.Equal(UnitStateSatisfied, status[2].State)
+	assert.Equal(UnitStatePending, status[3].State)
+	_, err = graph.GetStatus(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Type: UnitTypeMigration, ExecutedOn: executedOn},
+		{Name: "old1", Type: UnitTypeMigration, ExecutedOn: executedOn},
+	})
+	assert.EqualError(err, "Unit default3 squashes units of which only some have been executed, migrate with a "+
+		"version containing [old2] first")
+	graph.nodes["default3"].Squashes = nil
+
+	graph.nodes["default2"].DependsOn = []string{"default3"}
+
+	_, err = graph.GetStatus(DialectPostgres, nil)
+	assert.Error(err)
+}
+
+func TestGraph_GetDriftedUnits(t *testing.T) {
+	assert := assert.New(t)
+
+	graph := NewGraph()
+
+	graph.nodes["default"] = &Unit{
+		Name:      "default",
+		DependsOn: []string{"default2"},
+		Type:      UnitTypeVirtualTarget,
+	}
+
+	graph.nodes["default2"] = &Unit{
+		Name:      "default2",
+		DependsOn: []string{"nothing"},
+		Type:      UnitTypeMigration,
+		SQL:       SQLSection{Postgres: "CREATE TABLE test ();"},
+	}
+
+	graph.nodes["default3"] = &Unit{
+		Name:      "default3",
+		DependsOn: []string{"nothing"},
+		Type:      UnitTypeMigration,
+		SQL:       SQLSection{Postgres: "CREATE TABLE test3 ();"},
+	}
+
+	assert.Empty(graph.GetDriftedUnits(DialectPostgres, nil))
+
+	assert.Empty(graph.GetDriftedUnits(DialectPostgres, []ExecutedUnit{
+		{Name: "default2", Checksum: graph.nodes["default2"].Checksum(DialectPostgres)},
+		{Name: "default3"},
+		{Name: "removed", Checksum: "modified"},
+	}))
+
+	assert.EqualValues([]string{"default2", "default3"}, graph.GetDriftedUnits(DialectPostgres, []ExecutedUnit{
+		{Name: "default3", Checksum: "modified"},
+		{Name: "default2", Checksum: "modified"},
+	}))
+
+	// Seed units with changed rows are executed again instead
+	graph.nodes["seed"] = &Unit{
+		Name:      "seed",
+		DependsOn: []string{"nothing"},
+		Type:      UnitTypeSeed,
+		Seed:      SeedSection{Groups: []SeedGroup{{Name: "admin"}}},
+	}
+	executed := []ExecutedUnit{{Name: "seed", Checksum: "modified"}, {Name: "default2", Checksum: "modified"}}
+	assert.EqualValues([]string{"default2"}, graph.GetDriftedUnits(DialectPostgres, executed))
+	assert.EqualValues([]string{"seed"}, graph.ChangedSeeds(DialectPostgres, executed))
+	assert.Empty(graph.ChangedSeeds(DialectPostgres, []ExecutedUnit{
+		{Name: "seed", Checksum: graph.nodes["seed"].Checksum(DialectPostgres)},
+	}))
+
+	status, err := graph.GetStatus(DialectPostgres, executed)
+	assert.NoError(err)
+	for _, v := range status {
+		if v.Name == "seed" {
+			assert.Equal(UnitStatePending, v.State)
+			assert.NotNil(v.ExecutedOn)
+		}
+	}
+}
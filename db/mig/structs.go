@@ -1,9 +1,13 @@
 package mig // import "iris.arke.works/forum/db/mig"
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"gopkg.in/yaml.v2"
+	"io/fs"
 	"strings"
+	"time"
 )
 
 // Unit contains the definition of a migration unit that is represented by a node in a DAG
@@ -14,8 +18,91 @@ type Unit struct {
 	AlwaysExec  bool       `yaml:"always_exec"`
 	Type        UnitType   `yaml:"type"`
 	SQL         SQLSection `yaml:"sql"`
+	Down        SQLSection `yaml:"down"`
+	// Transaction is set to "none" for units that cannot run inside a transaction, like CREATE INDEX CONCURRENTLY
+	Transaction TransactionMode `yaml:"transaction"`
+	// Batch configures the key ranges of batch units
+	Batch BatchSection `yaml:"batch"`
+	// Timeout limits the duration of every attempt to execute the unit, e.g. "30s"
+	Timeout time.Duration `yaml:"timeout"`
+	// LockTimeout limits how long every statement of the unit waits for a lock. It is ignored on SQLite, where the
+	// migration holds the lock of the whole database.
+	LockTimeout time.Duration `yaml:"lock_timeout"`
+	// Retries is the number of times the unit is attempted again after a serialization or lock failure. Units with
+	// transaction: none cannot be retried.
+	Retries int `yaml:"retries"`
+	// Environments limits the unit to the listed environments, see Graph.SetEnvironment. A unit without
+	// environments is part of every environment.
+	Environments []string `yaml:"environments"`
+	// RunIf is a query per dialect that returns a single boolean, e.g. whether an extension is available. The unit
+	// is skipped if the query returns false, NULL or no row. It is evaluated right before the unit would be executed.
+	RunIf SQLSection `yaml:"run_if"`
+	// Seed declares the rows of seed units
+	Seed SeedSection `yaml:"seed"`
+	// Squashes lists the units replaced by this unit, see WriteSquashUnit. On a database that has executed all of
+	// them the unit is recorded without executing its SQL.
+	Squashes []string `yaml:"squashes"`
 
 	executed bool
+	// skipped is set if the unit is not part of the environment of the graph or its run_if query returned false
+	skipped bool
+	// satisfied is set if the units squashed by the unit have been executed
+	satisfied bool
+	// templateErr is set if the SQL could not be rendered with the variables of the graph
+	templateErr error
+}
+
+// IsReversible returns true if the unit can be rolled back on the given dialect. Targets and units without SQL
+// are always reversible since they do not execute any code, other migrations need a down section and code units
+// a registered down function.
+func (u Unit) IsReversible(dialect string) bool {
+	if u.Type == UnitTypeCode {
+		funcs, ok := lookupCode(u.Name)
+		return ok && funcs.down != nil
+	}
+	if u.Type == UnitTypeVirtualTarget || u.SQL.Get(dialect) == "" {
+		return true
+	}
+	return u.Down.Get(dialect) != ""
+}
+
+// InEnvironment returns true if the unit has no environments or env is one of them
+func (u Unit) InEnvironment(env string) bool {
+	if len(u.Environments) == 0 {
+		return true
+	}
+	for _, v := range u.Environments {
+		if v == env {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSkipped returns true if the unit is not part of the environment of the graph or its run_if query returned false
+func (u Unit) IsSkipped() bool {
+	return u.skipped
+}
+
+// IsSatisfied returns true if the units squashed by the unit have been executed, it is recorded without being
+// executed, see Graph.SatisfyBaselines
+func (u Unit) IsSatisfied() bool {
+	return u.satisfied
+}
+
+// SupportsDialect returns true if the unit can be executed on the given dialect. This is the case for targets,
+// code units, units that have no SQL for any dialect and units that have SQL for the given dialect.
+func (u Unit) SupportsDialect(dialect string) bool {
+	if u.Type == UnitTypeVirtualTarget || u.SQL.Get(dialect) != "" {
+		return true
+	}
+	return u.SQL == SQLSection{}
+}
+
+// IsNonTransactional returns true if the unit has to be executed outside of the migration transaction.
+// Batch units commit every batch and are always non-transactional.
+func (u Unit) IsNonTransactional() bool {
+	return u.Transaction == TransactionNone || u.Type == UnitTypeBatch
 }
 
 // DependsOnWithoutNothing returns the list of dependencies that are not "nothing"
@@ -31,13 +118,84 @@ func (u Unit) DependsOnWithoutNothing() []string {
 	return retDeps
 }
 
-// SQLSection defines the SQLQueries for various dialects. At the moment only postgres is implemented
-// since a graph-based migration requires a DDL-level transaction to be safe
+// Checksum returns the hex encoded SHA-256 hash of the unit SQL for the given dialect. It is stored in the
+// migration table to detect units that have been modified after they were executed. The SQL is hashed as rendered
+// with the variables of the graph, changing a variable changes the checksum of the units using it.
+//
+// The checksum of a seed unit is the hash of its rows, a seed unit whose rows have changed is executed again.
+func (u Unit) Checksum(dialect string) string {
+	if u.Type == UnitTypeSeed {
+		dat, _ := yaml.Marshal(u.Seed)
+		sum := sha256.Sum256(dat)
+		return hex.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256([]byte(u.SQL.Get(dialect)))
+	return hex.EncodeToString(sum[:])
+}
+
+// SQLSection defines the SQLQueries for various dialects. A graph-based migration is only safe with DDL-level
+// transactions, MySQL has none and is migrated one unit at a time instead (see MySQLDialect)
+//
+// The SQL is a text/template rendered with the variables of the graph when the unit is loaded, see Graph.SetVars.
 type SQLSection struct {
 	// Postgres contains the PG/SQL string to be executed for the unit
 	Postgres string `yaml:"postgres"`
+	// SQLite contains the SQL string to be executed for the unit on SQLite databases
+	SQLite string `yaml:"sqlite"`
+	// MySQL contains the SQL string to be executed for the unit on MySQL and MariaDB databases
+	MySQL string `yaml:"mysql"`
+}
+
+// Get returns the SQL for the given dialect name, unknown dialects have no SQL
+func (s SQLSection) Get(dialect string) string {
+	switch dialect {
+	case DialectPostgres:
+		return s.Postgres
+	case DialectSQLite:
+		return s.SQLite
+	case DialectMySQL:
+		return s.MySQL
+	}
+	return ""
+}
+
+// BatchSection defines the key ranges a batch unit is executed on. The SQL of a batch unit is a single statement
+// with two parameters, the key after which the batch starts and the last key of the batch:
+//
+//	type: batch
+//	batch:
+//	  table: replies
+//	  size: 5000
+//	sql:
+//	  postgres: UPDATE replies SET deleted = false WHERE snowflake > $1 AND snowflake <= $2;
+type BatchSection struct {
+	// Table is the table the batches are taken from
+	Table string `yaml:"table"`
+	// Key is the integer column the table is ordered by, it defaults to snowflake
+	Key string `yaml:"key"`
+	// Size is the number of rows in each batch, it defaults to DefaultBatchSize
+	Size int `yaml:"size"`
+}
+
+// KeyColumn returns the key column of the batches
+func (b BatchSection) KeyColumn() string {
+	if b.Key == "" {
+		return "snowflake"
+	}
+	return b.Key
 }
 
+// BatchSize returns the number of rows in each batch
+func (b BatchSection) BatchSize() int {
+	if b.Size <= 0 {
+		return DefaultBatchSize
+	}
+	return b.Size
+}
+
+// DefaultBatchSize is the number of rows in a batch if the unit does not declare a size
+const DefaultBatchSize = 1000
+
 // UnitType defines how a unit is treated on the graph
 type UnitType string
 
@@ -46,6 +204,25 @@ const (
 	UnitTypeMigration UnitType = "migration"
 	// UnitTypeVirtualTarget defines a target unit which groups various units together without executing code
 	UnitTypeVirtualTarget = "target"
+	// UnitTypeCode defines a unit which executes the Go code registered for its name with RegisterCode
+	UnitTypeCode UnitType = "code"
+	// UnitTypeBatch defines a unit which executes its SQL repeatedly over key ranges of a table, committing and
+	// recording a checkpoint after every batch
+	UnitTypeBatch UnitType = "batch"
+	// UnitTypeSeed defines a unit which upserts the rows of its seed section with the models package, it is
+	// executed again whenever its rows change
+	UnitTypeSeed UnitType = "seed"
+)
+
+// TransactionMode defines if a unit is executed inside the migration transaction
+type TransactionMode string
+
+const (
+	// TransactionDefault executes the unit inside the migration transaction
+	TransactionDefault TransactionMode = ""
+	// TransactionNone executes the unit in its own round outside of the migration transaction. Every statement
+	// of the unit is executed on its own and the unit is recorded only after all statements succeeded.
+	TransactionNone TransactionMode = "none"
 )
 
 var nothingUnit = Unit{
@@ -62,10 +239,9 @@ var nothingUnit = Unit{
 // loadUnitFile will load and parse a Unit file
 // It accepts a basepath and a filename which are joined together. The filename should be relative
 // to the basepath and acts as a unitname.
-// The filename must end in either .mig or .trgt
-var loadUnitFile = func(basepath, filename string) (*Unit, error) {
-	var retUnit = &Unit{}
-
+// The filename must end in .yaml
+// The SQL of the unit is rendered with the given variables, template errors are reported by ValidateNodes.
+var loadUnitFile = func(basepath, filename string, vars map[string]string) (*Unit, error) {
 	if !strings.HasSuffix(filename, ".yaml") {
 		return nil, errors.New("Unit file must have file extension .yaml")
 	}
@@ -80,7 +256,37 @@ var loadUnitFile = func(basepath, filename string) (*Unit, error) {
 		return nil, err
 	}
 
-	err = yaml.Unmarshal(dat, retUnit)
+	unit, err := parseUnit(filename, dat)
+	if err != nil {
+		return nil, err
+	}
+	unit.render(vars)
+	return unit, nil
+}
+
+// loadUnitFS loads and parses a unit file of a file system like loadUnitFile, the filename is the path of the file
+// in the file system and must end in .yaml
+func loadUnitFS(fsys fs.FS, filename string, vars map[string]string) (*Unit, error) {
+	if !strings.HasSuffix(filename, ".yaml") {
+		return nil, errors.New("Unit file must have file extension .yaml")
+	}
+	dat, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	unit, err := parseUnit(filename, dat)
+	if err != nil {
+		return nil, err
+	}
+	unit.render(vars)
+	return unit, nil
+}
+
+// parseUnit parses the contents of a unit file, the filename without the .yaml extension is the name of the unit
+func parseUnit(filename string, dat []byte) (*Unit, error) {
+	var retUnit = &Unit{}
+
+	err := yaml.Unmarshal(dat, retUnit)
 	if err != nil {
 		return nil, err
 	}
@@ -8,18 +8,103 @@ import (
 func TestLoadUnitFile(t *testing.T) {
 	assert := require.New(t)
 
-	_, err := loadUnitFile("this-is-not-a-path", "unit.xml")
+	_, err := loadUnitFile("this-is-not-a-path", "unit.xml", nil)
 	assert.Error(err)
 
-	_, err = loadUnitFile("this-is-not-a-apth", "unit.yaml")
+	_, err = loadUnitFile("this-is-not-a-apth", "unit.yaml", nil)
 	assert.Error(err)
 
-	_, err = loadUnitFile("arke", "does-not-exist-unit.yaml")
+	_, err = loadUnitFile("arke", "does-not-exist-unit.yaml", nil)
 	assert.Error(err)
 
-	_, err = loadUnitFile("mock-migs", "no-marshal.yaml")
+	_, err = loadUnitFile("mock-migs", "no-marshal.yaml", nil)
 	assert.Error(err)
 
-	_, err = loadUnitFile("mock-migs", ".yaml")
+	_, err = loadUnitFile("mock-migs", ".yaml", nil)
 	assert.Error(err)
 }
+
+func TestUnit_IsReversible(t *testing.T) {
+	assert := require.New(t)
+
+	assert.True(Unit{Type: UnitTypeVirtualTarget}.IsReversible(DialectPostgres))
+	assert.True(Unit{Type: UnitTypeMigration}.IsReversible(DialectPostgres))
+	assert.False(Unit{
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE test ();"},
+	}.IsReversible(DialectPostgres))
+	assert.True(Unit{
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE test ();"},
+		Down: SQLSection{Postgres: "DROP TABLE test;"},
+	}.IsReversible(DialectPostgres))
+}
+
+func TestUnit_Checksum(t *testing.T) {
+	assert := require.New(t)
+
+	unit := Unit{SQL: SQLSection{Postgres: "CREATE TABLE test ();"}}
+	assert.Len(unit.Checksum(DialectPostgres), 64)
+	assert.Equal(unit.Checksum(DialectPostgres), Unit{Name: "other", SQL: unit.SQL}.Checksum(DialectPostgres))
+	assert.NotEqual(unit.Checksum(DialectPostgres), Unit{SQL: SQLSection{Postgres: "CREATE TABLE test2 ();"}}.Checksum(DialectPostgres))
+
+	// Seed units are hashed by their rows
+	seed := Unit{Type: UnitTypeSeed, Seed: SeedSection{Groups: []SeedGroup{{Name: "admin"}}}}
+	assert.Len(seed.Checksum(DialectPostgres), 64)
+	assert.Equal(seed.Checksum(DialectPostgres), seed.Checksum(DialectSQLite))
+	assert.NotEqual(seed.Checksum(DialectPostgres), Unit{Type: UnitTypeSeed}.Checksum(DialectPostgres))
+	assert.NotEqual(seed.Checksum(DialectPostgres), Unit{Type: UnitTypeSeed,
+		Seed: SeedSection{Groups: []SeedGroup{{Name: "admin", Permission: "all"}}}}.Checksum(DialectPostgres))
+}
+
+func TestUnit_SupportsDialect(t *testing.T) {
+	assert := require.New(t)
+
+	assert.True(Unit{Type: UnitTypeVirtualTarget}.SupportsDialect(DialectSQLite))
+	assert.True(Unit{Type: UnitTypeMigration}.SupportsDialect(DialectSQLite))
+
+	unit := Unit{
+		Type: UnitTypeMigration,
+		SQL:  SQLSection{Postgres: "CREATE TABLE test ();"},
+	}
+	assert.True(unit.SupportsDialect(DialectPostgres))
+	assert.False(unit.SupportsDialect(DialectSQLite))
+	assert.False(unit.SupportsDialect("unknown"))
+}
+
+func TestSQLSection_Get(t *testing.T) {
+	assert := require.New(t)
+
+	section := SQLSection{Postgres: "pg", SQLite: "lite", MySQL: "my"}
+	assert.Equal("pg", section.Get(DialectPostgres))
+	assert.Equal("lite", section.Get(DialectSQLite))
+	assert.Equal("my", section.Get(DialectMySQL))
+	assert.Equal("", section.Get("unknown"))
+}
+
+func TestUnit_IsNonTransactional(t *testing.T) {
+	assert := require.New(t)
+
+	assert.False(Unit{}.IsNonTransactional())
+	assert.True(Unit{Transaction: TransactionNone}.IsNonTransactional())
+}
+
+func TestUnit_InEnvironment(t *testing.T) {
+	assert := require.New(t)
+
+	assert.True(Unit{}.InEnvironment(""))
+	assert.True(Unit{}.InEnvironment("production"))
+	assert.True(Unit{Environments: []string{"dev", "staging"}}.InEnvironment("staging"))
+	assert.False(Unit{Environments: []string{"dev", "staging"}}.InEnvironment("production"))
+	assert.False(Unit{Environments: []string{"dev"}}.InEnvironment(""))
+}
+
+func TestBatchSection(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("snowflake", BatchSection{}.KeyColumn())
+	assert.Equal("id", BatchSection{Key: "id"}.KeyColumn())
+	assert.Equal(DefaultBatchSize, BatchSection{}.BatchSize())
+	assert.Equal(50, BatchSection{Size: 50}.BatchSize())
+	assert.True(Unit{Type: UnitTypeBatch}.IsNonTransactional())
+}
@@ -0,0 +1,66 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// defaultVars are the variables units are rendered with if they are not set. The built-in units render to the
+// SQL they had before they were templates with them, so their checksums do not change.
+var defaultVars = map[string]string{
+	// schema is the schema the units are migrated in. The built-in units do not reference it, their tables are
+	// created in the search path of the connection, which vape tenants sets to the schema of each tenant.
+	"schema": "public",
+	// varchar_size is the size of the name and title columns of the built-in units on Postgres and SQLite. MySQL
+	// limits the size of indexed columns, its columns are varchar(768).
+	"varchar_size": "1024",
+}
+
+// render executes the SQL sections, the run_if queries and the batch settings of the unit as text/template
+// templates with the variables as data, e.g. "CREATE TABLE {{.schema}}.topics". Variables that are not set fall
+// back to defaultVars, referencing a variable that is neither set nor has a default is an error. If any template
+// fails, the error is kept on the unit and reported by Graph.ValidateNodes, the sections are left unrendered.
+func (u *Unit) render(vars map[string]string) {
+	var data = map[string]string{}
+	for key, value := range defaultVars {
+		data[key] = value
+	}
+	for key, value := range vars {
+		data[key] = value
+	}
+	var fields = []struct {
+		name  string
+		value *string
+	}{
+		{"sql.postgres", &u.SQL.Postgres},
+		{"sql.sqlite", &u.SQL.SQLite},
+		{"sql.mysql", &u.SQL.MySQL},
+		{"down.postgres", &u.Down.Postgres},
+		{"down.sqlite", &u.Down.SQLite},
+		{"down.mysql", &u.Down.MySQL},
+		{"run_if.postgres", &u.RunIf.Postgres},
+		{"run_if.sqlite", &u.RunIf.SQLite},
+		{"run_if.mysql", &u.RunIf.MySQL},
+		{"batch.table", &u.Batch.Table},
+		{"batch.key", &u.Batch.Key},
+	}
+	var rendered = make([]string, len(fields))
+	for i, field := range fields {
+		tmpl, err := template.New(field.name).Option("missingkey=error").Parse(*field.value)
+		if err != nil {
+			u.templateErr = err
+			return
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, data)
+		if err != nil {
+			u.templateErr = err
+			return
+		}
+		rendered[i] = buf.String()
+	}
+	for i, field := range fields {
+		*field.value = rendered[i]
+	}
+	u.templateErr = nil
+}
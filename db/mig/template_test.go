@@ -0,0 +1,92 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestUnit_render(t *testing.T) {
+	assert := require.New(t)
+
+	unit := &Unit{
+		SQL: SQLSection{
+			Postgres: "CREATE TABLE {{.schema}}.{{.table_prefix}}replies (id bigint);\n" +
+				"ALTER TABLE {{.schema}}.{{.table_prefix}}replies OWNER TO {{.owner}};",
+			SQLite: "CREATE TABLE {{.table_prefix}}replies (id bigint);",
+		},
+		Down:  SQLSection{Postgres: "DROP TABLE {{.schema}}.{{.table_prefix}}replies;"},
+		Batch: BatchSection{Table: "{{.table_prefix}}replies"},
+	}
+	plain := *unit
+	unit.render(map[string]string{"schema": "forum", "table_prefix": "arke_", "owner": "arke"})
+	assert.NoError(unit.templateErr)
+	assert.Equal("CREATE TABLE forum.arke_replies (id bigint);\nALTER TABLE forum.arke_replies OWNER TO arke;",
+		unit.SQL.Postgres)
+	assert.Equal("CREATE TABLE arke_replies (id bigint);", unit.SQL.SQLite)
+	assert.Equal("DROP TABLE forum.arke_replies;", unit.Down.Postgres)
+	assert.Equal("arke_replies", unit.Batch.Table)
+
+	// The checksum covers the rendered SQL
+	other := plain
+	other.render(map[string]string{"schema": "other", "table_prefix": "arke_", "owner": "arke"})
+	assert.NotEqual(unit.Checksum(DialectPostgres), other.Checksum(DialectPostgres))
+	assert.Equal(unit.Checksum(DialectSQLite), other.Checksum(DialectSQLite))
+
+	// Failed templates are kept unrendered
+	missing := plain
+	missing.render(map[string]string{"schema": "forum"})
+	assert.EqualError(missing.templateErr, `template: sql.postgres:1:27: executing "sql.postgres" at `+
+		`<.table_prefix>: map has no entry for key "table_prefix"`)
+	assert.Equal(plain.SQL, missing.SQL)
+
+	invalid := Unit{SQL: SQLSection{MySQL: "SELECT {{.schema"}}
+	invalid.render(nil)
+	assert.Error(invalid.templateErr)
+
+	static := Unit{SQL: SQLSection{Postgres: "SELECT 1;"}}
+	static.render(nil)
+	assert.NoError(static.templateErr)
+	assert.Equal("SELECT 1;", static.SQL.Postgres)
+}
+
+func TestGraph_ValidateNodes_Template(t *testing.T) {
+	assert := require.New(t)
+
+	graph := NewGraph()
+	graph.nodes["unit"] = &Unit{Name: "unit", Type: UnitTypeMigration, DependsOn: []string{"nothing"},
+		SQL: SQLSection{Postgres: "CREATE SCHEMA {{.schema}} AUTHORIZATION {{.owner}};"}}
+	graph.nodes["unit"].render(nil)
+	assert.EqualError(graph.ValidateNodes(), `Node unit has an invalid template: template: sql.postgres:1:42: `+
+		`executing "sql.postgres" at <.owner>: map has no entry for key "owner"`)
+
+	graph.nodes["unit"].render(map[string]string{"schema": "forum", "owner": "arke"})
+	assert.NoError(graph.ValidateNodes())
+	assert.Equal("CREATE SCHEMA forum AUTHORIZATION arke;", graph.nodes["unit"].SQL.Postgres)
+}
+
+func TestUnit_render_Defaults(t *testing.T) {
+	assert := require.New(t)
+
+	unit := Unit{SQL: SQLSection{Postgres: "CREATE TABLE {{.schema}}.topics (title varchar({{.varchar_size}}));"}}
+	unit.render(nil)
+	assert.NoError(unit.templateErr)
+	assert.Equal("CREATE TABLE public.topics (title varchar(1024));", unit.SQL.Postgres)
+
+	// The built-in units render to their SQL from before they were templates
+	graph := NewGraph()
+	assert.NoError(graph.Load("arke"))
+	users, err := graph.GetUnit("db_setup/create_users")
+	assert.NoError(err)
+	assert.Contains(users.SQL.Postgres, "username\tvarchar(1024)\tNOT NULL")
+	assert.Contains(users.SQL.MySQL, "username\tvarchar(768)\tNOT NULL")
+	assert.Equal("ff28c274dc25defc9feeb406a94e070773a56e2ba1be8b93cf9d26fdcf509f11", users.Checksum(DialectPostgres))
+
+	graph = NewGraph()
+	graph.SetVars(map[string]string{"varchar_size": "255"})
+	assert.NoError(graph.Load("arke"))
+	users, err = graph.GetUnit("db_setup/create_users")
+	assert.NoError(err)
+	assert.Contains(users.SQL.Postgres, "username\tvarchar(255)\tNOT NULL")
+	assert.Contains(users.SQL.SQLite, "email\t\tvarchar(255),")
+	assert.Contains(users.SQL.MySQL, "username\tvarchar(768)\tNOT NULL")
+}
@@ -0,0 +1,76 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TenantStatus is the outcome of migrating a tenant
+type TenantStatus string
+
+const (
+	// TenantMigrated is the status of a tenant that had pending units which have all been executed
+	TenantMigrated TenantStatus = "migrated"
+	// TenantCurrent is the status of a tenant that had no pending units
+	TenantCurrent TenantStatus = "current"
+	// TenantFailed is the status of a tenant whose migration failed
+	TenantFailed TenantStatus = "failed"
+)
+
+// TenantFunc migrates a single tenant and returns the executed units, targets excluded
+type TenantFunc func(ctx context.Context, tenant string) ([]string, error)
+
+// TenantResult is the result of migrating a tenant
+type TenantResult struct {
+	Tenant string
+	Status TenantStatus
+	// Executed contains the executed units, for failed tenants the units committed before the failure
+	Executed []string
+	Duration time.Duration
+	Err      error
+}
+
+// RunTenants migrates the tenants with migrate, at most parallel tenants at a time. A failed tenant does not stop
+// the others, every tenant is migrated in its own transactions. Tenants not started before the context is
+// cancelled fail with the error of the context. The results are returned in the order of the tenants.
+func RunTenants(ctx context.Context, tenants []string, parallel int, migrate TenantFunc) []TenantResult {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var results = make([]TenantResult, len(tenants))
+	var slots = make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, tenant := range tenants {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = TenantResult{Tenant: tenant, Status: TenantFailed, Executed: []string{}, Err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, tenant string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			start := time.Now()
+			executed, err := migrate(ctx, tenant)
+			if executed == nil {
+				executed = []string{}
+			}
+			var result = TenantResult{Tenant: tenant, Executed: executed, Duration: time.Since(start), Err: err}
+			switch {
+			case err != nil:
+				result.Status = TenantFailed
+			case len(executed) == 0:
+				result.Status = TenantCurrent
+			default:
+				result.Status = TenantMigrated
+			}
+			results[i] = result
+		}(i, tenant)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,65 @@
+package mig
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestRunTenants(t *testing.T) {
+	assert := require.New(t)
+
+	var mutex sync.Mutex
+	var running, maxRunning int
+	results := RunTenants(context.Background(), []string{"a", "b", "c", "d"}, 2,
+		func(ctx context.Context, tenant string) ([]string, error) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			defer func() {
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+			}()
+			switch tenant {
+			case "a":
+				return []string{"unit"}, nil
+			case "b":
+				return nil, nil
+			case "c":
+				return []string{"unit"}, errors.New("Test error")
+			}
+			return nil, errors.New("Test error")
+		})
+	assert.True(maxRunning <= 2, "%d tenants ran at the same time", maxRunning)
+
+	assert.Len(results, 4)
+	assert.Equal("a", results[0].Tenant)
+	assert.Equal(TenantMigrated, results[0].Status)
+	assert.EqualValues([]string{"unit"}, results[0].Executed)
+	assert.Equal(TenantCurrent, results[1].Status)
+	assert.EqualValues([]string{}, results[1].Executed)
+	assert.Equal(TenantFailed, results[2].Status)
+	assert.EqualValues([]string{"unit"}, results[2].Executed)
+	assert.EqualError(results[3].Err, "Test error")
+	assert.Equal(TenantFailed, results[3].Status)
+}
+
+func TestRunTenants_Cancelled(t *testing.T) {
+	assert := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := RunTenants(ctx, []string{"a", "b"}, 0, func(ctx context.Context, tenant string) ([]string, error) {
+		return nil, ctx.Err()
+	})
+	for _, result := range results {
+		assert.Equal(TenantFailed, result.Status)
+		assert.Equal(context.Canceled, result.Err)
+	}
+}
@@ -0,0 +1,238 @@
+package mig // import "iris.arke.works/forum/db/mig"
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	queryTableRegexp       = regexp.MustCompile(`(?i)\b(?:INTO|FROM|UPDATE)\s+([\w."]+)`)
+	queryInsertRegexp      = regexp.MustCompile(`(?i)\bINSERT\s+INTO\s+[\w."]+\s*\(([^)]*)\)`)
+	querySetRegexp         = regexp.MustCompile(`(?i)\bSET\s*\(([^)]*)\)`)
+	queryConflictRegexp    = regexp.MustCompile(`(?i)\bON\s+CONFLICT\s*\(([^)]*)\)`)
+	querySelectRegexp      = regexp.MustCompile(`(?is)^\s*SELECT\s+(.*?)\s+FROM\b`)
+	queryConditionRegexp   = regexp.MustCompile(`(\w+)\s*(?:=|<>|<=|>=|<|>)\s*\$\d+`)
+	queryPlaceholderRegexp = regexp.MustCompile(`\$(\d+)`)
+)
+
+// VerifyModels compares the models with the schema of a database that has been migrated with the migration
+// units. Every problem is returned as a line of the report, an empty report means the models match the schema.
+//
+// The report covers tables and columns missing on either side, columns whose type or nullability cannot be
+// represented by the Go type of their field, queries referencing unknown columns or listing a column twice and
+// lookup functions generated from indexes that do not exist. Index names are only compared on Postgres, the
+// database the models are generated from, since other databases name the indexes of constraints differently.
+// Tables of the migration toolkit are ignored.
+func VerifyModels(schema *Schema, models []Model, dialect string) []string {
+	var problems = []string{}
+	var modelTables = map[string]bool{}
+	for _, model := range models {
+		modelTables[model.Table] = true
+		prefix := fmt.Sprintf("%s (%s): ", model.Struct, model.Table)
+		table, ok := schema.Tables[model.Table]
+		if !ok {
+			problems = append(problems, prefix+"Table does not exist")
+			continue
+		}
+
+		var fields = map[string]bool{}
+		for _, field := range model.Fields {
+			fields[field.Column] = true
+			column := table.Column(field.Column)
+			if column == nil {
+				problems = append(problems, fmt.Sprintf("%sField %s maps to column %s which does not exist",
+					prefix, field.Name, field.Column))
+				continue
+			}
+			if problem := checkFieldType(field, *column); problem != "" {
+				problems = append(problems, prefix+problem)
+			}
+		}
+		for _, column := range table.Columns {
+			if !fields[column.Name] {
+				problems = append(problems, fmt.Sprintf("%sColumn %s has no field", prefix, column.Name))
+			}
+		}
+
+		if dialect == DialectPostgres {
+			for _, index := range model.Indexes {
+				if schema.IndexTable(index.Name) != model.Table {
+					problems = append(problems, fmt.Sprintf("%s%s is generated from index %s which does not exist",
+						prefix, index.Func, index.Name))
+				}
+			}
+		}
+
+		for _, query := range model.Queries {
+			for _, problem := range checkModelQuery(schema, table, query.SQL) {
+				problems = append(problems, fmt.Sprintf("%sQuery of %s %s", prefix, query.Func, problem))
+			}
+		}
+	}
+
+	var tables = []string{}
+	for name := range schema.Tables {
+		if !modelTables[name] && !strings.HasPrefix(name, "vape_") && !strings.HasPrefix(name, "sqlite_") {
+			tables = append(tables, name)
+		}
+	}
+	sort.Strings(tables)
+	for _, name := range tables {
+		problems = append(problems, fmt.Sprintf("Table %s has no model", name))
+	}
+	return problems
+}
+
+// checkFieldType returns a problem if the Go type of the field cannot hold the values of the column
+func checkFieldType(field ModelField, column SchemaColumn) string {
+	goFamily, goNullable, goStrict := goTypeFamily(field.GoType)
+	dbFamily := columnTypeFamily(column.Type)
+	if goFamily != "" && dbFamily != "" && goFamily != dbFamily {
+		return fmt.Sprintf("Field %s has type %s but column %s has type %s", field.Name, field.GoType,
+			column.Name, column.Type)
+	}
+	if column.Nullable && !goNullable {
+		return fmt.Sprintf("Field %s has type %s but column %s is nullable", field.Name, field.GoType, column.Name)
+	}
+	if !column.Nullable && goNullable && goStrict {
+		return fmt.Sprintf("Field %s has type %s but column %s is not nullable", field.Name, field.GoType,
+			column.Name)
+	}
+	return ""
+}
+
+// goTypeFamily returns the family of values a Go type holds and if it can hold NULL. Strict is set for the
+// sql.Null types, which are only generated for nullable columns, while pointers and slices are also used for
+// columns with defaults.
+func goTypeFamily(goType string) (family string, nullable bool, strict bool) {
+	switch goType {
+	case "int", "int16", "int32", "int64":
+		return "integer", false, false
+	case "sql.NullInt64":
+		return "integer", true, true
+	case "string":
+		return "text", false, false
+	case "sql.NullString":
+		return "text", true, true
+	case "bool":
+		return "bool", false, false
+	case "sql.NullBool":
+		return "bool", true, true
+	case "float32", "float64":
+		return "float", false, false
+	case "sql.NullFloat64":
+		return "float", true, true
+	case "time.Time":
+		return "time", false, false
+	case "*time.Time":
+		return "time", true, false
+	case "pq.NullTime":
+		return "time", true, true
+	case "[]byte":
+		return "bytes", true, false
+	}
+	if strings.HasPrefix(goType, "*") {
+		return "", true, false
+	}
+	return "", false, false
+}
+
+// columnTypeFamily returns the family of values a database type holds, or an empty string for unknown types
+func columnTypeFamily(columnType string) string {
+	switch {
+	case strings.Contains(columnType, "int"):
+		return "integer"
+	case strings.Contains(columnType, "char"), strings.Contains(columnType, "text"), columnType == "clob":
+		return "text"
+	case strings.Contains(columnType, "time"), strings.Contains(columnType, "date"):
+		return "time"
+	case strings.Contains(columnType, "bytea"), strings.Contains(columnType, "blob"),
+		strings.Contains(columnType, "binary"):
+		return "bytes"
+	case strings.Contains(columnType, "bool"):
+		return "bool"
+	case strings.Contains(columnType, "real"), strings.Contains(columnType, "double"),
+		strings.Contains(columnType, "float"), strings.Contains(columnType, "numeric"),
+		strings.Contains(columnType, "decimal"):
+		return "float"
+	}
+	return ""
+}
+
+// checkModelQuery returns the problems of a query on the table of a model: unknown tables and columns, columns
+// listed twice and inserts whose number of columns and placeholders differ
+func checkModelQuery(schema *Schema, table *SchemaTable, query string) []string {
+	var problems = []string{}
+	if match := queryTableRegexp.FindStringSubmatch(query); match != nil {
+		if name := normalizeName(match[1]); name != table.Name {
+			if other, ok := schema.Tables[name]; ok {
+				table = other
+			} else {
+				return append(problems, fmt.Sprintf("uses table %s which does not exist", name))
+			}
+		}
+	}
+
+	var lists = [][]string{}
+	for _, re := range []*regexp.Regexp{queryInsertRegexp, querySetRegexp, queryConflictRegexp, querySelectRegexp} {
+		for _, match := range re.FindAllStringSubmatch(query, -1) {
+			lists = append(lists, splitColumnList(match[1]))
+		}
+	}
+	var conditions = []string{}
+	for _, match := range queryConditionRegexp.FindAllStringSubmatch(query, -1) {
+		conditions = append(conditions, strings.ToLower(match[1]))
+	}
+	lists = append(lists, conditions)
+
+	var reported = map[string]bool{}
+	report := func(problem string) {
+		if !reported[problem] {
+			reported[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+	for i, list := range lists {
+		var seen = map[string]bool{}
+		for _, column := range list {
+			if !table.HasColumn(column) {
+				report(fmt.Sprintf("uses column %s which does not exist", column))
+			}
+			// Conditions may compare a column twice, column lists may not
+			if seen[column] && i < len(lists)-1 {
+				report(fmt.Sprintf("lists column %s more than once", column))
+			}
+			seen[column] = true
+		}
+	}
+
+	if match := queryInsertRegexp.FindStringSubmatch(query); match != nil {
+		columns := len(splitColumnList(match[1]))
+		placeholders := 0
+		for _, placeholder := range queryPlaceholderRegexp.FindAllStringSubmatch(query, -1) {
+			var n int
+			fmt.Sscan(placeholder[1], &n)
+			if n > placeholders {
+				placeholders = n
+			}
+		}
+		if placeholders > 0 && columns != placeholders {
+			report(fmt.Sprintf("inserts %d columns but has %d parameters", columns, placeholders))
+		}
+	}
+	return problems
+}
+
+// splitColumnList splits a comma separated list of column names, qualified names like EXCLUDED.name are skipped
+func splitColumnList(list string) []string {
+	var columns = []string{}
+	for _, column := range strings.Split(list, ",") {
+		column = strings.TrimSpace(column)
+		if column != "" && !strings.ContainsAny(column, " .$()") {
+			columns = append(columns, normalizeName(column))
+		}
+	}
+	return columns
+}
@@ -0,0 +1,90 @@
+package mig
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func verifyTestSchema() *Schema {
+	return &Schema{Tables: map[string]*SchemaTable{
+		"users": {Name: "users", Columns: []SchemaColumn{
+			{Name: "snowflake", Type: "bigint"},
+			{Name: "name", Type: "character varying"},
+			{Name: "email", Type: "text", Nullable: true},
+		}, Indexes: []string{"users_pkey"}},
+		"vape_units": {Name: "vape_units", Columns: []SchemaColumn{{Name: "name", Type: "text"}}},
+	}}
+}
+
+func TestVerifyModels(t *testing.T) {
+	assert := require.New(t)
+
+	models := []Model{{
+		Struct: "User", Table: "users",
+		Fields: []ModelField{
+			{Name: "Snowflake", Column: "snowflake", GoType: "int64"},
+			{Name: "Name", Column: "name", GoType: "string"},
+			{Name: "Email", Column: "email", GoType: "sql.NullString"},
+		},
+		Indexes: []ModelIndex{{Func: "UserBySnowflake", Name: "users_pkey"}},
+		Queries: []ModelQuery{
+			{Func: "User.Insert", SQL: `INSERT INTO public.users (snowflake, name, email) VALUES ($1, $2, $3)`},
+			{Func: "User.Update", SQL: `UPDATE public.users SET (name, email) = ($1, $2) WHERE snowflake = $3`},
+			{Func: "UserBySnowflake", SQL: `SELECT snowflake, name, email FROM public.users WHERE snowflake = $1`},
+		},
+	}}
+	assert.Empty(VerifyModels(verifyTestSchema(), models, DialectPostgres))
+}
+
+func TestVerifyModels_Mismatches(t *testing.T) {
+	assert := require.New(t)
+
+	schema := verifyTestSchema()
+	schema.Tables["groups"] = &SchemaTable{Name: "groups", Columns: []SchemaColumn{{Name: "name", Type: "text"}}}
+	models := []Model{{
+		Struct: "User", Table: "users",
+		Fields: []ModelField{
+			{Name: "Snowflake", Column: "snowflake", GoType: "string"},
+			{Name: "Email", Column: "email", GoType: "string"},
+			{Name: "Avatar", Column: "avatar", GoType: "[]byte"},
+		},
+		Indexes: []ModelIndex{{Func: "UserByName", Name: "users_name_index"}},
+		Queries: []ModelQuery{
+			{Func: "User.Insert", SQL: `INSERT INTO public.users (snowflake, snowflake, name) VALUES ($1, $2)`},
+			{Func: "UserByAvatar", SQL: `SELECT snowflake FROM public.users WHERE avatar = $1`},
+			{Func: "Login", SQL: `SELECT snowflake FROM public.logins WHERE snowflake = $1`},
+		},
+	}, {
+		Struct: "Post", Table: "posts",
+	}}
+
+	assert.EqualValues([]string{
+		"User (users): Field Snowflake has type string but column snowflake has type bigint",
+		"User (users): Field Email has type string but column email is nullable",
+		"User (users): Field Avatar maps to column avatar which does not exist",
+		"User (users): Column name has no field",
+		"User (users): UserByName is generated from index users_name_index which does not exist",
+		"User (users): Query of User.Insert lists column snowflake more than once",
+		"User (users): Query of User.Insert inserts 3 columns but has 2 parameters",
+		"User (users): Query of UserByAvatar uses column avatar which does not exist",
+		"User (users): Query of Login uses table logins which does not exist",
+		"Post (posts): Table does not exist",
+		"Table groups has no model",
+	}, VerifyModels(schema, models, DialectPostgres))
+
+	// Index names are only compared on Postgres
+	problems := VerifyModels(schema, models, DialectSQLite)
+	assert.NotContains(problems, "User (users): UserByName is generated from index users_name_index which does not exist")
+}
+
+func TestCheckFieldType(t *testing.T) {
+	assert := require.New(t)
+
+	column := SchemaColumn{Name: "created_at", Type: "timestamp with time zone"}
+	assert.Empty(checkFieldType(ModelField{Name: "CreatedAt", GoType: "time.Time"}, column))
+	// Pointers are also generated for columns with defaults
+	assert.Empty(checkFieldType(ModelField{Name: "CreatedAt", GoType: "*time.Time"}, column))
+	assert.Equal("Field CreatedAt has type pq.NullTime but column created_at is not nullable",
+		checkFieldType(ModelField{Name: "CreatedAt", GoType: "pq.NullTime"}, column))
+	assert.Empty(checkFieldType(ModelField{Name: "Data", GoType: "CustomType"}, column))
+}
@@ -6,7 +6,11 @@ import (
 	"os"
 )
 
+// version is set by goreleaser at build time
+var version = "dev"
+
 func main() {
+	cmd.Version = version
 	if err := cmd.RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -13,6 +13,10 @@ const (
 	counterMask = -1 ^ (-1 << counterLen)
 )
 
+// MigrationInstanceID is the instance ID reserved for the snowflakes of rows created by migrations, like the
+// rows of seed units. Forum instances must use a different instance ID, otherwise their snowflakes can collide.
+const MigrationInstanceID int8 = 127
+
 var (
 	errNoFuture    = errors.New("Start Time cannot be set in the future")
 	errBadInstance = errors.New("Instance ID must be smaller than 129")